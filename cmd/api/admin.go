@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"github.com/96malhar/greenlight/internal/data"
+	"github.com/96malhar/greenlight/internal/validator"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"time"
+)
+
+// listUsersHandler returns the users whose name or email address contains the "search"
+// query string parameter, optionally filtered by their activation state.
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Search    string
+		Activated *bool
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Search = app.readString(qs, "search", "")
+	input.Activated = app.readBool(qs, "activated", v)
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.modelStore.Users.GetAll(input.Search, input.Activated, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showUserHandler returns the details of a specific user, together with their roles and
+// the permissions granted to them directly or through those roles.
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	permissions, err := app.modelStore.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	roles, err := app.modelStore.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"user": user, "roles": roles, "permissions": permissions}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateUserActivationHandler activates or deactivates a specific user account.
+// Deactivating an account disables it, so that the user can neither log in nor activate
+// it again themselves, and revokes all of its sessions and API keys.
+func (app *application) updateUserActivationHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Activated *bool `json:"activated"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Activated != nil, "activated", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	before := envelope{"activated": user.Activated, "disabled_at": user.DisabledAt}
+
+	user.Activated = *input.Activated
+	user.DisabledAt = nil
+
+	if !user.Activated {
+		now := time.Now().UTC()
+		user.DisabledAt = &now
+	}
+
+	err = app.modelStore.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	action := data.AuditUserActivate
+
+	if !user.Activated {
+		action = data.AuditUserDeactivate
+
+		err = app.revokeAllCredentials(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	after := envelope{"activated": user.Activated, "disabled_at": user.DisabledAt}
+	app.auditChange(r, data.NewAuditEvent(action, data.AuditTargetUser, user.ID), before, after)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// grantUserPermissionsHandler grants one or more permission codes to a specific user.
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	knownPermissions, err := app.modelStore.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	for _, code := range input.Permissions {
+		v.Check(knownPermissions.Include(code), "permissions", "must only contain known permission codes")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	before, err := app.modelStore.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.modelStore.Permissions.AddForUser(user.ID, input.Permissions...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeUserPermissions(w, r, data.NewAuditEvent(data.AuditPermissionsGrant, data.AuditTargetUser, user.ID), before)
+}
+
+// revokeUserPermissionHandler revokes a permission code which was granted to a specific
+// user directly. The user keeps the permission if one of their roles bundles it.
+func (app *application) revokeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	before, err := app.modelStore.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.modelStore.Permissions.RemoveForUser(user.ID, chi.URLParam(r, "code"))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeUserPermissions(w, r, data.NewAuditEvent(data.AuditPermissionsRevoke, data.AuditTargetUser, user.ID), before)
+}
+
+// expireUserTokensHandler revokes every session and API key of a specific user, along
+// with any outstanding two-factor, password reset and email change tokens.
+func (app *application) expireUserTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.revokeAllCredentials(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, scope := range []string{data.ScopePasswordReset, data.ScopeEmailChange} {
+		err = app.modelStore.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.audit(r, data.NewAuditEvent(data.AuditUserExpireTokens, data.AuditTargetUser, user.ID))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all tokens and API keys of the user have been revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// unlockUserAccountHandler lifts the lockout of a specific user account after too many
+// failed login attempts, and forgets those attempts.
+func (app *application) unlockUserAccountHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.unlockUser(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.NewAuditEvent(data.AuditUserUnlock, data.AuditTargetUser, user.ID))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "the user account has been unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// disableUserTwoFactorHandler disables two-factor authentication for a specific user, for
+// example when they have lost both their authenticator app and their recovery codes.
+func (app *application) disableUserTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.modelStore.TwoFactor.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.NewAuditEvent(data.AuditUserDisableTwoFactor, data.AuditTargetUser, user.ID))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication of the user has been disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readUserParam reads the user identified by the "id" URL parameter. If the user
+// doesn't exist, an error response is sent and the boolean result is false.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.modelStore.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+// writeUserPermissions records a change to the permissions of a user in the audit log and
+// sends the permissions the user has now in the response.
+func (app *application) writeUserPermissions(w http.ResponseWriter, r *http.Request, event *data.AuditEvent, before data.Permissions) {
+	permissions, err := app.modelStore.Permissions.GetAllForUser(*event.TargetID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.auditChange(r, event, envelope{"permissions": before}, envelope{"permissions": permissions})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+type listUsersResponse struct {
+	Users    []user             `json:"users"`
+	Metadata paginationMetadata `json:"metadata"`
+}
+
+type userPermissionsResponse struct {
+	Permissions []string `json:"permissions"`
+}
+
+func TestAdminEndpoints_ShouldRequireAdminPermission(t *testing.T) {
+	ts := newTestServer(t)
+	viewerToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		roles: []string{"viewer", "editor"},
+	})
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Anonymous user",
+			requestUrlPath:         "/v1/admin/users",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:                   "User without users:admin",
+			requestUrlPath:         "/v1/admin/users",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          map[string]string{"Authorization": "Bearer " + viewerToken},
+			wantResponseStatusCode: http.StatusForbidden,
+			wantResponse: errorResponse{
+				Error: "your user account doesn't have the necessary permissions to access this resource",
+			},
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+}
+
+func TestListUsersHandler(t *testing.T) {
+	ts := newTestServer(t)
+	adminToken := ts.insertUser(t, dummyUser{
+		name: "Admin", email: "admin@greenlight.net", password: "pa55word1234", activated: true, authenticated: true,
+		roles: []string{"admin"},
+	})
+	ts.insertUser(t, dummyUser{name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true})
+	ts.insertUser(t, dummyUser{name: "Bob", email: "bob@example.org", password: "pa55word1234", activated: false})
+
+	adminHeader := map[string]string{"Authorization": "Bearer " + adminToken}
+
+	listUsers := func(wantNames ...string) func(t *testing.T, res *http.Response) {
+		return func(t *testing.T, res *http.Response) {
+			dst := &listUsersResponse{}
+			readJsonResponse(t, res.Body, dst)
+
+			var gotNames []string
+			for _, u := range dst.Users {
+				gotNames = append(gotNames, u.Name)
+			}
+			assert.Equal(t, wantNames, gotNames)
+			assert.Equal(t, len(wantNames), dst.Metadata.TotalRecords)
+		}
+	}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "All users",
+			requestUrlPath:         "/v1/admin/users",
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks:       listUsers("Admin", "Alice", "Bob"),
+		},
+		{
+			name:                   "Search by name",
+			requestUrlPath:         "/v1/admin/users?search=ali",
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks:       listUsers("Alice"),
+		},
+		{
+			name:                   "Search by email",
+			requestUrlPath:         "/v1/admin/users?search=example.org",
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks:       listUsers("Bob"),
+		},
+		{
+			name:                   "Activated users sorted by name descending",
+			requestUrlPath:         "/v1/admin/users?activated=true&sort=-name",
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks:       listUsers("Alice", "Admin"),
+		},
+		{
+			name:                   "Invalid query parameters",
+			requestUrlPath:         "/v1/admin/users?activated=maybe&sort=password_hash",
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"activated": "must be a boolean value",
+					"sort":      "invalid sort value",
+				},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodGet
+		tc.requestHeader = adminHeader
+		testHandler(t, ts, tc)
+	}
+}
+
+func TestShowUserHandler(t *testing.T) {
+	ts := newTestServer(t)
+	adminToken := ts.insertUser(t, dummyUser{
+		name: "Admin", email: "admin@greenlight.net", password: "pa55word1234", activated: true, authenticated: true,
+		roles: []string{"admin"},
+	})
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Existing user",
+			requestUrlPath:         "/v1/admin/users/1",
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst struct {
+					User        user     `json:"user"`
+					Roles       []string `json:"roles"`
+					Permissions []string `json:"permissions"`
+				}
+				readJsonResponse(t, res.Body, &dst)
+				assert.Equal(t, "admin@greenlight.net", dst.User.Email)
+				assert.Equal(t, []string{"admin"}, dst.Roles)
+				assert.Equal(t, []string{"movies:read", "movies:write", "users:admin"}, dst.Permissions)
+			},
+		},
+		{
+			name:                   "Non-existent user",
+			requestUrlPath:         "/v1/admin/users/42",
+			wantResponseStatusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodGet
+		tc.requestHeader = map[string]string{"Authorization": "Bearer " + adminToken}
+		testHandler(t, ts, tc)
+	}
+}
+
+func TestUpdateUserActivationHandler(t *testing.T) {
+	ts := newTestServer(t)
+	adminToken := ts.insertUser(t, dummyUser{
+		name: "Admin", email: "admin@greenlight.net", password: "pa55word1234", activated: true, authenticated: true,
+		roles: []string{"admin"},
+	})
+	aliceToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		permCodes: []string{"movies:read"},
+	})
+	aliceKey := ts.createAPIKey(t, aliceToken, `{"name":"importer", "permissions":["movies:read"]}`)
+
+	adminHeader := map[string]string{"Authorization": "Bearer " + adminToken}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Missing activated",
+			requestUrlPath:         "/v1/admin/users/2/activated",
+			requestMethodType:      http.MethodPut,
+			requestBody:            `{}`,
+			requestHeader:          adminHeader,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{"activated": "must be provided"},
+			},
+		},
+		{
+			name:                   "Deactivate",
+			requestUrlPath:         "/v1/admin/users/2/activated",
+			requestMethodType:      http.MethodPut,
+			requestBody:            `{"activated": false}`,
+			requestHeader:          adminHeader,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				dst := &userResponse{}
+				readJsonResponse(t, res.Body, dst)
+				assert.False(t, dst.User.Activated)
+				assert.NotNil(t, dst.User.DisabledAt)
+			},
+		},
+		{
+			name:                   "Deactivation revokes sessions",
+			requestUrlPath:         "/v1/users/me",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          map[string]string{"Authorization": "Bearer " + aliceToken},
+			wantResponseStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:                   "Deactivation revokes API keys",
+			requestUrlPath:         "/v1/movies",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          map[string]string{"Authorization": "ApiKey " + aliceKey.Key},
+			wantResponseStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:                   "Deactivated user cannot log in",
+			requestUrlPath:         "/v1/tokens/authentication",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"email":"alice@gmail.com", "password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusForbidden,
+			wantResponse:           errorResponse{Error: "your user account has been disabled"},
+		},
+		{
+			name:                   "Activate",
+			requestUrlPath:         "/v1/admin/users/2/activated",
+			requestMethodType:      http.MethodPut,
+			requestBody:            `{"activated": true}`,
+			requestHeader:          adminHeader,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				dst := &userResponse{}
+				readJsonResponse(t, res.Body, dst)
+				assert.True(t, dst.User.Activated)
+				assert.Nil(t, dst.User.DisabledAt)
+			},
+		},
+		{
+			name:                   "Non-existent user",
+			requestUrlPath:         "/v1/admin/users/42/activated",
+			requestMethodType:      http.MethodPut,
+			requestBody:            `{"activated": true}`,
+			requestHeader:          adminHeader,
+			wantResponseStatusCode: http.StatusNotFound,
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+
+	u, err := ts.app.modelStore.Users.Get(2)
+	require.NoError(t, err)
+	assert.True(t, u.Activated)
+	assert.False(t, u.IsDisabled())
+
+	ts.login(t, "alice@gmail.com", "pa55word1234", nil)
+}
+
+func TestUserPermissionHandlers(t *testing.T) {
+	ts := newTestServer(t)
+	adminToken := ts.insertUser(t, dummyUser{
+		name: "Admin", email: "admin@greenlight.net", password: "pa55word1234", activated: true, authenticated: true,
+		roles: []string{"admin"},
+	})
+	ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		roles: []string{"viewer"},
+	})
+
+	adminHeader := map[string]string{"Authorization": "Bearer " + adminToken}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Grant unknown permission",
+			requestUrlPath:         "/v1/admin/users/2/permissions",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"permissions": ["movies:write", "movies:delete"]}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{"permissions": "must only contain known permission codes"},
+			},
+		},
+		{
+			name:                   "Grant no permissions",
+			requestUrlPath:         "/v1/admin/users/2/permissions",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"permissions": []}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{"permissions": "must contain at least 1 permission"},
+			},
+		},
+		{
+			name:                   "Grant permission",
+			requestUrlPath:         "/v1/admin/users/2/permissions",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"permissions": ["movies:write"]}`,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse:           userPermissionsResponse{Permissions: []string{"movies:read", "movies:write"}},
+		},
+		{
+			name:                   "Grant permission again",
+			requestUrlPath:         "/v1/admin/users/2/permissions",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"permissions": ["movies:write"]}`,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse:           userPermissionsResponse{Permissions: []string{"movies:read", "movies:write"}},
+		},
+		{
+			name:                   "Revoke permission",
+			requestUrlPath:         "/v1/admin/users/2/permissions/movies:write",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse:           userPermissionsResponse{Permissions: []string{"movies:read"}},
+		},
+		{
+			name:                   "Revoking a role permission has no effect",
+			requestUrlPath:         "/v1/admin/users/2/permissions/movies:read",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse:           userPermissionsResponse{Permissions: []string{"movies:read"}},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestHeader = adminHeader
+		testHandler(t, ts, tc)
+	}
+}
+
+func TestExpireUserTokensHandler(t *testing.T) {
+	ts := newTestServer(t)
+	adminToken := ts.insertUser(t, dummyUser{
+		name: "Admin", email: "admin@greenlight.net", password: "pa55word1234", activated: true, authenticated: true,
+		roles: []string{"admin"},
+	})
+	ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		permCodes: []string{"movies:read"},
+	})
+
+	aliceToken, aliceRefreshToken := ts.login(t, "alice@gmail.com", "pa55word1234", nil)
+	aliceKey := ts.createAPIKey(t, aliceToken, `{"name":"importer", "permissions":["movies:read"]}`)
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Expire tokens",
+			requestUrlPath:         "/v1/admin/users/2/tokens",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          map[string]string{"Authorization": "Bearer " + adminToken},
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "all tokens and API keys of the user have been revoked",
+			},
+		},
+		{
+			name:                   "Authentication token is revoked",
+			requestUrlPath:         "/v1/users/me",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          map[string]string{"Authorization": "Bearer " + aliceToken},
+			wantResponseStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:                   "Refresh token is revoked",
+			requestUrlPath:         "/v1/tokens/refresh",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"token":"` + aliceRefreshToken + `"}`,
+			wantResponseStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:                   "API key is revoked",
+			requestUrlPath:         "/v1/movies",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          map[string]string{"Authorization": "ApiKey " + aliceKey.Key},
+			wantResponseStatusCode: http.StatusUnauthorized,
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/96malhar/greenlight/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type apiKey struct {
+	ID          int64      `json:"id"`
+	Name        string     `json:"name"`
+	Prefix      string     `json:"prefix"`
+	Key         string     `json:"key"`
+	Permissions []string   `json:"permissions"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Expiry      *time.Time `json:"expiry"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+}
+
+func (ts *testServer) createAPIKey(t *testing.T, authToken, body string) apiKey {
+	res, err := ts.executeRequest(http.MethodPost, "/v1/users/me/api-keys", body, map[string]string{"Authorization": "Bearer " + authToken})
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	var dst struct {
+		APIKey apiKey `json:"api_key"`
+	}
+	readJsonResponse(t, res.Body, &dst)
+	return dst.APIKey
+}
+
+func TestCreateAPIKeyHandler(t *testing.T) {
+	ts := newTestServer(t)
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		permCodes: []string{"movies:read", "movies:write"},
+	})
+
+	key := ts.createAPIKey(t, authToken, `{"name":"importer", "permissions":["movies:read"], "expiry":"2099-01-01T00:00:00Z"}`)
+	assert.Equal(t, "importer", key.Name)
+	assert.True(t, strings.HasPrefix(key.Key, "gl_"+key.Prefix+"_"))
+	assert.Equal(t, []string{"movies:read"}, key.Permissions)
+	require.NotNil(t, key.Expiry)
+	assert.Equal(t, 2099, key.Expiry.Year())
+
+	bearer := map[string]string{"Authorization": "Bearer " + authToken}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Missing fields",
+			requestBody:            `{}`,
+			requestHeader:          bearer,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"name":        "must be provided",
+					"permissions": "must contain at least 1 permission",
+				},
+			},
+		},
+		{
+			name:                   "Expiry in the past",
+			requestBody:            `{"name":"importer", "permissions":["movies:read"], "expiry":"2000-01-01T00:00:00Z"}`,
+			requestHeader:          bearer,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"expiry": "must be in the future",
+				},
+			},
+		},
+		{
+			name:                   "Permission the user doesn't have",
+			requestBody:            `{"name":"importer", "permissions":["movies:read", "users:admin"]}`,
+			requestHeader:          bearer,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"permissions": "must only contain permissions that you have",
+				},
+			},
+		},
+		{
+			name:                   "API key can't create API keys",
+			requestBody:            `{"name":"importer", "permissions":["movies:read"]}`,
+			requestHeader:          map[string]string{"Authorization": "ApiKey " + key.Key},
+			wantResponseStatusCode: http.StatusForbidden,
+			wantResponse: errorResponse{
+				Error: "this resource can't be accessed with an API key",
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodPost
+		tc.requestUrlPath = "/v1/users/me/api-keys"
+		testHandler(t, ts, tc)
+	}
+}
+
+func TestAuthenticate_APIKey(t *testing.T) {
+	ts := newTestServer(t)
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		permCodes: []string{"movies:read", "movies:write"},
+	})
+	ts.insertMovie(t, "Moana", 2016, 107, []string{"animation"})
+
+	readKey := ts.createAPIKey(t, authToken, `{"name":"reader", "permissions":["movies:read"]}`)
+	writeKey := ts.createAPIKey(t, authToken, `{"name":"writer", "permissions":["movies:read", "movies:write"]}`)
+
+	expiry := time.Now().Add(-time.Hour)
+	expiredKey := data.NewAPIKey(1, "expired", data.Permissions{"movies:read"}, &expiry)
+	require.NoError(t, ts.app.modelStore.APIKeys.Insert(expiredKey))
+
+	apiKeyHeader := func(key string) map[string]string {
+		return map[string]string{"Authorization": "ApiKey " + key}
+	}
+
+	invalidTokenResponse := errorResponse{Error: "invalid or missing authentication token"}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Key grants its permissions",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          apiKeyHeader(readKey.Key),
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "Key doesn't grant other permissions of the user",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          apiKeyHeader(readKey.Key),
+			wantResponseStatusCode: http.StatusForbidden,
+		},
+		{
+			name:                   "Unknown key",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          apiKeyHeader("gl_abcdefgh_ABCDEFGHIJKLMNOPQRSTUVWXYZ"),
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse:           invalidTokenResponse,
+		},
+		{
+			name:                   "Wrong secret",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          apiKeyHeader("gl_" + readKey.Prefix + "_ABCDEFGHIJKLMNOPQRSTUVWXYZ"),
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse:           invalidTokenResponse,
+		},
+		{
+			name:                   "Expired key",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          apiKeyHeader(expiredKey.Plaintext),
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse:           invalidTokenResponse,
+		},
+		{
+			name:                   "Key can't manage the account",
+			requestUrlPath:         "/v1/users/me/sessions",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          apiKeyHeader(readKey.Key),
+			wantResponseStatusCode: http.StatusForbidden,
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+
+	// A key loses the permissions that are removed from its user.
+	_, err := ts.db.Exec(context.Background(), `
+        DELETE FROM users_permissions
+        WHERE permission_id = (SELECT id FROM permissions WHERE code = 'movies:write')`)
+	require.NoError(t, err)
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "Key loses revoked user permissions",
+		requestUrlPath:         "/v1/movies/1",
+		requestMethodType:      http.MethodDelete,
+		requestHeader:          apiKeyHeader(writeKey.Key),
+		wantResponseStatusCode: http.StatusForbidden,
+	})
+}
+
+func TestListAndDeleteAPIKeyHandlers(t *testing.T) {
+	ts := newTestServer(t)
+	aliceToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		permCodes: []string{"movies:read"},
+	})
+	bobToken := ts.insertUser(t, dummyUser{
+		name: "Bob", email: "bob@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		permCodes: []string{"movies:read"},
+	})
+
+	first := ts.createAPIKey(t, aliceToken, `{"name":"first", "permissions":["movies:read"]}`)
+	second := ts.createAPIKey(t, aliceToken, `{"name":"second", "permissions":["movies:read"]}`)
+
+	// use the first key so that its last used time is recorded in the background
+	res, err := ts.executeRequest(http.MethodGet, "/v1/users/me", "", map[string]string{"Authorization": "ApiKey " + first.Key})
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	time.Sleep(200 * time.Millisecond)
+
+	aliceHeader := map[string]string{"Authorization": "Bearer " + aliceToken}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "List keys",
+			requestUrlPath:         "/v1/users/me/api-keys",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          aliceHeader,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst struct {
+					APIKeys []apiKey `json:"api_keys"`
+				}
+				readJsonResponse(t, res.Body, &dst)
+				require.Len(t, dst.APIKeys, 2)
+
+				// Keys are listed with the most recently created first, without their secret.
+				assert.Equal(t, second.ID, dst.APIKeys[0].ID)
+				assert.Empty(t, dst.APIKeys[0].Key)
+				assert.Nil(t, dst.APIKeys[0].LastUsedAt)
+
+				assert.Equal(t, first.Prefix, dst.APIKeys[1].Prefix)
+				require.NotNil(t, dst.APIKeys[1].LastUsedAt)
+				assert.WithinDuration(t, time.Now().UTC(), *dst.APIKeys[1].LastUsedAt, 2*time.Second)
+			},
+		},
+		{
+			name:                   "Revoke a key of another user",
+			requestUrlPath:         fmt.Sprintf("/v1/users/me/api-keys/%d", first.ID),
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          map[string]string{"Authorization": "Bearer " + bobToken},
+			wantResponseStatusCode: http.StatusNotFound,
+		},
+		{
+			name:                   "Revoke a key",
+			requestUrlPath:         fmt.Sprintf("/v1/users/me/api-keys/%d", first.ID),
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          aliceHeader,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "API key successfully revoked",
+			},
+		},
+		{
+			name:                   "Revoked key is rejected",
+			requestUrlPath:         "/v1/users/me",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          map[string]string{"Authorization": "ApiKey " + first.Key},
+			wantResponseStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:                   "Other keys are still valid",
+			requestUrlPath:         "/v1/users/me",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          map[string]string{"Authorization": "ApiKey " + second.Key},
+			wantResponseStatusCode: http.StatusOK,
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+}
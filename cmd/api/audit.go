@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/96malhar/greenlight/internal/data"
+	"github.com/96malhar/greenlight/internal/validator"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/tomasen/realip"
+	"net/http"
+)
+
+// audit records an event in the audit log, along with the IP address of the client and
+// the id of the request. The actor is the authenticated user, unless the event names one
+// already, as it does for logins. The change which the event describes has been made by
+// the time it is recorded, so failing to record it only gets logged.
+func (app *application) audit(r *http.Request, event *data.AuditEvent) {
+	if user := app.contextGetUser(r); event.ActorID == nil && !user.IsAnonymous() {
+		event.ActorID = &user.ID
+	}
+
+	event.ClientIP = realip.FromRequest(r)
+	event.RequestID = middleware.GetReqID(r.Context())
+
+	err := app.modelStore.Audit.Insert(event)
+	if err != nil {
+		app.logger.Error("failed to record audit event", "action", event.Action, "request_id", event.RequestID, "error", err.Error())
+	}
+}
+
+// auditChange records an event for a change from one version of a record to another.
+func (app *application) auditChange(r *http.Request, event *data.AuditEvent, before, after any) {
+	changes, err := data.AuditChanges(before, after)
+	if err != nil {
+		app.logger.Error("failed to compute audit changes", "action", event.Action, "error", err.Error())
+	}
+
+	event.Changes = changes
+	app.audit(r, event)
+}
+
+// auditLogin records a login by a user.
+func (app *application) auditLogin(r *http.Request, user *data.User) {
+	app.auditSelf(r, data.AuditUserLogin, user)
+}
+
+// auditSelf records an action of a user on their own account. The user is the actor of
+// the event, even if the request isn't authenticated, as for logins and for requests
+// which are authorized by a token that was emailed to the user.
+func (app *application) auditSelf(r *http.Request, action string, user *data.User) {
+	event := data.NewAuditEvent(action, data.AuditTargetUser, user.ID)
+	event.ActorID = &user.ID
+	app.audit(r, event)
+}
+
+// listAuditEventsHandler returns the audit log, most recent events first by default. The
+// events can be filtered by actor, action and target.
+func (app *application) listAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.AuditFilter
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.ActorID = int64(app.readInt(qs, "actor_id", 0, v))
+	input.Action = app.readString(qs, "action", "")
+	input.TargetType = app.readString(qs, "target_type", "")
+	input.TargetID = int64(app.readInt(qs, "target_id", 0, v))
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = []string{"id", "created_at", "-id", "-created_at"}
+
+	v.Check(input.ActorID >= 0, "actor_id", "must not be negative")
+	v.Check(input.TargetID >= 0, "target_id", "must not be negative")
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	events, metadata, err := app.modelStore.Audit.GetAll(input.AuditFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"audit_events": events, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"github.com/96malhar/greenlight/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type auditEventsResponse struct {
+	AuditEvents []*data.AuditEvent      `json:"audit_events"`
+	Metadata    data.PaginationMetadata `json:"metadata"`
+}
+
+func TestAuditLog(t *testing.T) {
+	ts := newTestServer(t)
+
+	adminToken := ts.insertUser(t, dummyUser{
+		name: "Admin", email: "admin@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		permCodes: []string{"users:admin", "movies:read", "movies:write"},
+	})
+	adminHeader := map[string]string{"Authorization": "Bearer " + adminToken, "X-Request-Id": "req-123"}
+
+	ts.insertUser(t, dummyUser{name: "Bob", email: "bob@gmail.com", password: "pa55word1234", activated: true})
+
+	// Make some changes which are recorded in the audit log.
+	testcases := []handlerTestcase{
+		{
+			name:                   "Create movie",
+			requestUrlPath:         "/v1/movies",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"title":"Die Hard","year":1988,"runtime":"207 mins","genres":["Action", "Thriller"]}`,
+			wantResponseStatusCode: http.StatusCreated,
+		},
+		{
+			name:                   "Update movie",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodPatch,
+			requestBody:            `{"year":1989}`,
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "Delete movie",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "Grant permission",
+			requestUrlPath:         "/v1/admin/users/2/permissions",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"permissions":["movies:write"]}`,
+			wantResponseStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestHeader = adminHeader
+		testHandler(t, ts, tc)
+	}
+
+	ts.failLogin(t, "bob@gmail.com", 1)
+	ts.login(t, "bob@gmail.com", "pa55word1234", nil)
+
+	listEvents := func(t *testing.T, query string) []*data.AuditEvent {
+		res, err := ts.executeRequest(http.MethodGet, "/v1/admin/audit"+query, "", adminHeader)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		var dst auditEventsResponse
+		readJsonResponse(t, res.Body, &dst)
+		return dst.AuditEvents
+	}
+
+	t.Run("Movie events", func(t *testing.T) {
+		events := listEvents(t, "?target_type=movie&sort=id")
+		require.Len(t, events, 3)
+
+		for _, event := range events {
+			require.NotNil(t, event.ActorID)
+			assert.Equal(t, int64(1), *event.ActorID)
+			require.NotNil(t, event.TargetID)
+			assert.Equal(t, int64(1), *event.TargetID)
+			assert.Equal(t, "req-123", event.RequestID)
+			assert.WithinDuration(t, time.Now(), event.CreatedAt, 5*time.Second)
+		}
+
+		assert.Equal(t, data.AuditMovieCreate, events[0].Action)
+		assert.Equal(t, data.AuditChange{Before: nil, After: "Die Hard"}, events[0].Changes["title"])
+
+		assert.Equal(t, data.AuditMovieUpdate, events[1].Action)
+		assert.Equal(t, map[string]data.AuditChange{
+			"year":    {Before: float64(1988), After: float64(1989)},
+			"version": {Before: float64(1), After: float64(2)},
+		}, events[1].Changes)
+
+		assert.Equal(t, data.AuditMovieDelete, events[2].Action)
+		assert.Equal(t, data.AuditChange{Before: "Die Hard", After: nil}, events[2].Changes["title"])
+	})
+
+	t.Run("Permission events", func(t *testing.T) {
+		events := listEvents(t, "?action=user.permissions.grant")
+		require.Len(t, events, 1)
+
+		assert.Equal(t, int64(2), *events[0].TargetID)
+		assert.Equal(t, data.AuditChange{
+			Before: []any{"movies:read"},
+			After:  []any{"movies:read", "movies:write"},
+		}, events[0].Changes["permissions"])
+	})
+
+	t.Run("Login events", func(t *testing.T) {
+		events := listEvents(t, "?target_type=user&target_id=2&sort=id")
+		require.Len(t, events, 3)
+
+		assert.Equal(t, data.AuditUserLoginFailed, events[1].Action)
+		assert.Nil(t, events[1].ActorID)
+
+		assert.Equal(t, data.AuditUserLogin, events[2].Action)
+		require.NotNil(t, events[2].ActorID)
+		assert.Equal(t, int64(2), *events[2].ActorID)
+	})
+
+	t.Run("Filter by actor", func(t *testing.T) {
+		events := listEvents(t, "?actor_id=2")
+		require.Len(t, events, 1)
+		assert.Equal(t, data.AuditUserLogin, events[0].Action)
+	})
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "Invalid filters",
+		requestUrlPath:         "/v1/admin/audit?sort=action&actor_id=-1",
+		requestMethodType:      http.MethodGet,
+		requestHeader:          adminHeader,
+		wantResponseStatusCode: http.StatusUnprocessableEntity,
+		wantResponse: validationErrorResponse{
+			Error: map[string]string{
+				"sort":     "invalid sort value",
+				"actor_id": "must not be negative",
+			},
+		},
+	})
+}
+
+func TestAuditLog_AccountEvents(t *testing.T) {
+	ts := newTestServer(t)
+
+	adminToken := ts.insertUser(t, dummyUser{
+		name: "Admin", email: "admin@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		permCodes: []string{"users:admin"},
+	})
+	adminHeader := map[string]string{"Authorization": "Bearer " + adminToken}
+
+	ts.insertUser(t, dummyUser{
+		name: "Bob", email: "bob@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		permCodes: []string{"movies:read"},
+	})
+
+	// Make some changes to the account of Bob as an administrator.
+	testcases := []handlerTestcase{
+		{
+			name:                   "Deactivate user",
+			requestUrlPath:         "/v1/admin/users/2/activated",
+			requestMethodType:      http.MethodPut,
+			requestBody:            `{"activated":false}`,
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "Activate user",
+			requestUrlPath:         "/v1/admin/users/2/activated",
+			requestMethodType:      http.MethodPut,
+			requestBody:            `{"activated":true}`,
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "Expire tokens",
+			requestUrlPath:         "/v1/admin/users/2/tokens",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "Unlock user",
+			requestUrlPath:         "/v1/admin/users/2/lockout",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "Disable two-factor authentication",
+			requestUrlPath:         "/v1/admin/users/2/2fa",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestHeader = adminHeader
+		testHandler(t, ts, tc)
+	}
+
+	// Bob manages his own API keys.
+	authToken, _ := ts.login(t, "bob@gmail.com", "pa55word1234", nil)
+	key := ts.createAPIKey(t, authToken, `{"name":"importer", "permissions":["movies:read"]}`)
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "Delete API key",
+		requestUrlPath:         fmt.Sprintf("/v1/users/me/api-keys/%d", key.ID),
+		requestMethodType:      http.MethodDelete,
+		requestHeader:          map[string]string{"Authorization": "Bearer " + authToken},
+		wantResponseStatusCode: http.StatusOK,
+	})
+
+	listEvents := func(t *testing.T, query string) []*data.AuditEvent {
+		res, err := ts.executeRequest(http.MethodGet, "/v1/admin/audit"+query, "", adminHeader)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		var dst auditEventsResponse
+		readJsonResponse(t, res.Body, &dst)
+		return dst.AuditEvents
+	}
+
+	t.Run("Admin events", func(t *testing.T) {
+		events := listEvents(t, "?actor_id=1&sort=id")
+		require.Len(t, events, 5)
+
+		wantActions := []string{
+			data.AuditUserDeactivate,
+			data.AuditUserActivate,
+			data.AuditUserExpireTokens,
+			data.AuditUserUnlock,
+			data.AuditUserDisableTwoFactor,
+		}
+
+		for i, event := range events {
+			assert.Equal(t, wantActions[i], event.Action)
+			assert.Equal(t, data.AuditTargetUser, event.TargetType)
+			require.NotNil(t, event.TargetID)
+			assert.Equal(t, int64(2), *event.TargetID)
+		}
+
+		assert.Equal(t, data.AuditChange{Before: true, After: false}, events[0].Changes["activated"])
+		assert.Nil(t, events[0].Changes["disabled_at"].Before)
+		assert.NotNil(t, events[0].Changes["disabled_at"].After)
+
+		assert.Equal(t, data.AuditChange{Before: false, After: true}, events[1].Changes["activated"])
+		assert.Nil(t, events[1].Changes["disabled_at"].After)
+	})
+
+	t.Run("API key events", func(t *testing.T) {
+		events := listEvents(t, "?target_type=api_key&sort=id")
+		require.Len(t, events, 2)
+
+		for _, event := range events {
+			require.NotNil(t, event.ActorID)
+			assert.Equal(t, int64(2), *event.ActorID)
+			require.NotNil(t, event.TargetID)
+			assert.Equal(t, key.ID, *event.TargetID)
+		}
+
+		assert.Equal(t, data.AuditAPIKeyCreate, events[0].Action)
+		assert.Equal(t, data.AuditChange{Before: nil, After: "importer"}, events[0].Changes["name"])
+		assert.NotContains(t, events[0].Changes, "key")
+
+		assert.Equal(t, data.AuditAPIKeyDelete, events[1].Action)
+	})
+}
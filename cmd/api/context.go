@@ -15,6 +15,21 @@ type contextKey string
 // in the request context.
 const userContextKey = contextKey("user")
 
+// tokenHashContextKey is the key for getting and setting the hash of the authentication
+// token that was used to authenticate the request.
+const tokenHashContextKey = contextKey("tokenHash")
+
+// sessionFamilyContextKey and permissionsContextKey are the keys for getting and setting
+// the session and the permissions carried by a JWT, for requests authenticated with one.
+const (
+	sessionFamilyContextKey = contextKey("sessionFamily")
+	permissionsContextKey   = contextKey("permissions")
+)
+
+// apiKeyContextKey is the key for getting and setting the API key that was used to
+// authenticate the request.
+const apiKeyContextKey = contextKey("apiKey")
+
 // contextSetUser returns a new copy of the request with the provided
 // User struct added to the context. Note that we use our userContextKey constant as the
 // key.
@@ -35,3 +50,65 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// contextSetTokenHash returns a new copy of the request with the hash of the
+// authentication token added to the context.
+func (app *application) contextSetTokenHash(r *http.Request, hash []byte) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenHashContextKey, hash)
+	return r.WithContext(ctx)
+}
+
+// contextGetTokenHash retrieves the hash of the authentication token from the request
+// context. Like contextGetUser, it should only be called for requests that were
+// authenticated with a token.
+func (app *application) contextGetTokenHash(r *http.Request) []byte {
+	hash, ok := r.Context().Value(tokenHashContextKey).([]byte)
+	if !ok {
+		panic("missing token hash value in request context")
+	}
+
+	return hash
+}
+
+// contextSetSessionFamily returns a new copy of the request with the token family of the
+// session that the request was authenticated with added to the context.
+func (app *application) contextSetSessionFamily(r *http.Request, family string) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionFamilyContextKey, family)
+	return r.WithContext(ctx)
+}
+
+// contextGetSessionFamily retrieves the token family of the session from the request
+// context. The boolean result is false if the family isn't known without looking up the
+// authentication token in the database.
+func (app *application) contextGetSessionFamily(r *http.Request) (string, bool) {
+	family, ok := r.Context().Value(sessionFamilyContextKey).(string)
+	return family, ok
+}
+
+// contextSetPermissions returns a new copy of the request with the permissions of the
+// user added to the context.
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// contextGetPermissions retrieves the permissions of the user from the request context.
+// The boolean result is false if they have to be looked up in the database instead.
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return permissions, ok
+}
+
+// contextSetAPIKey returns a new copy of the request with the API key used to
+// authenticate the request added to the context.
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey retrieves the API key from the request context. The boolean result is
+// false if the request wasn't authenticated with an API key.
+func (app *application) contextGetAPIKey(r *http.Request) (*data.APIKey, bool) {
+	key, ok := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key, ok
+}
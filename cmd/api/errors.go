@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func (app *application) logError(r *http.Request, err error) {
@@ -82,6 +85,12 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+// invalidRefreshTokenResponse will be used to send a 401 Unauthorized status code and JSON response to the client.
+func (app *application) invalidRefreshTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or expired refresh token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
 // authenticationRequiredResponse will be used to send a 401 Unauthorized status code and JSON response to the client.
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
@@ -94,8 +103,56 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+// disabledAccountResponse will be used to send a 403 Forbidden status code and JSON response to the client.
+func (app *application) disabledAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been disabled"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 // notPermittedResponse will be used to send a 403 Forbidden status code and JSON response to the client.
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+// apiKeyNotAllowedResponse will be used to send a 403 Forbidden status code and JSON response to the client.
+func (app *application) apiKeyNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with an API key"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// tooManyLoginAttemptsResponse will be used to send a 429 Too Many Requests status code and JSON response to the client,
+// along with a Retry-After header telling the client how many seconds to wait before trying again.
+func (app *application) tooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// activationEmailThrottledResponse will be used to send a 429 Too Many Requests status code and JSON response to the client,
+// along with a Retry-After header telling the client how many seconds to wait before trying again.
+func (app *application) activationEmailThrottledResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	message := "an activation email was sent recently, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// oidcLoginFailedResponse will be used to send a 401 Unauthorized status code and JSON response to the client.
+func (app *application) oidcLoginFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "unable to log in with the identity provider"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// oidcAccountNotFoundResponse will be used to send a 403 Forbidden status code and JSON response to the client.
+func (app *application) oidcAccountNotFoundResponse(w http.ResponseWriter, r *http.Request) {
+	message := "no user account matches your identity at the identity provider"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// registrationClosedResponse will be used to send a 403 Forbidden status code and JSON response to the client.
+func (app *application) registrationClosedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "registration of new user accounts is closed"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/96malhar/greenlight/internal/data"
+	"net/http"
+	"time"
+)
+
+// exportCurrentUserHandler returns an archive of the personal data held about the
+// authenticated user, as a JSON file to download. Secrets such as password hashes,
+// tokens and two-factor authentication secrets are left out.
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	export, err := app.userExport(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="greenlight-export-%d.json"`, user.ID))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"export": export}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// userExport collects the personal data held about a user. Every kind of data which is
+// stored for users, including any content they create, belongs in here.
+func (app *application) userExport(user *data.User) (envelope, error) {
+	roles, err := app.modelStore.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := app.modelStore.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := app.modelStore.Tokens.GetAllSessionsForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeys, err := app.modelStore.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	identities, err := app.modelStore.OIDC.GetIdentitiesForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	reviews, err := app.modelStore.Reviews.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	watchlist, err := app.modelStore.Watchlist.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	watched, err := app.modelStore.Watched.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	lists, err := app.modelStore.Lists.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	twoFactor := envelope{"enabled": false}
+
+	tf, err := app.modelStore.TwoFactor.Get(user.ID)
+	switch {
+	case err == nil && tf.Confirmed:
+		twoFactor = envelope{"enabled": true, "enrolled_at": tf.CreatedAt}
+	case err != nil && !errors.Is(err, data.ErrRecordNotFound):
+		return nil, err
+	}
+
+	export := envelope{
+		"exported_at": time.Now().UTC(),
+		"user":        user,
+		"roles":       roles,
+		"permissions": permissions,
+		"sessions":    sessions,
+		"api_keys":    apiKeys,
+		"identities":  identities,
+		"two_factor":  twoFactor,
+		"reviews":     reviews,
+		"watchlist":   watchlist,
+		"watched":     watched,
+		"lists":       lists,
+	}
+
+	return export, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type userExportResponse struct {
+	Export struct {
+		ExportedAt  time.Time         `json:"exported_at"`
+		User        user              `json:"user"`
+		Roles       []string          `json:"roles"`
+		Permissions []string          `json:"permissions"`
+		Sessions    []json.RawMessage `json:"sessions"`
+		APIKeys     []json.RawMessage `json:"api_keys"`
+		Identities  []json.RawMessage `json:"identities"`
+		TwoFactor   struct {
+			Enabled    bool       `json:"enabled"`
+			EnrolledAt *time.Time `json:"enrolled_at"`
+		} `json:"two_factor"`
+		Reviews   []json.RawMessage `json:"reviews"`
+		Watchlist []json.RawMessage `json:"watchlist"`
+		Watched   []json.RawMessage `json:"watched"`
+		Lists     []json.RawMessage `json:"lists"`
+	} `json:"export"`
+}
+
+func TestExportCurrentUserHandler(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true,
+		permCodes: []string{"movies:write"}, roles: []string{"viewer"},
+	})
+	authToken, _ := ts.login(t, "alice@gmail.com", "pa55word1234", nil)
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Export",
+			requestHeader:          map[string]string{"Authorization": "Bearer " + authToken},
+			wantResponseStatusCode: http.StatusOK,
+			wantResponseHeader: map[string]string{
+				"Content-Disposition": `attachment; filename="greenlight-export-1.json"`,
+			},
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst userExportResponse
+				readJsonResponse(t, res.Body, &dst)
+
+				assert.WithinDuration(t, time.Now(), dst.Export.ExportedAt, 2*time.Second)
+				assert.Equal(t, "alice@gmail.com", dst.Export.User.Email)
+				assert.Equal(t, []string{"viewer"}, dst.Export.Roles)
+				assert.Equal(t, []string{"movies:read", "movies:write"}, dst.Export.Permissions)
+				require.Len(t, dst.Export.Sessions, 1)
+				assert.Empty(t, dst.Export.APIKeys)
+				assert.Empty(t, dst.Export.Identities)
+				assert.False(t, dst.Export.TwoFactor.Enabled)
+				assert.Empty(t, dst.Export.Reviews)
+				assert.Empty(t, dst.Export.Watchlist)
+				assert.Empty(t, dst.Export.Watched)
+				assert.Empty(t, dst.Export.Lists)
+			},
+		},
+		{
+			name:                   "Unauthenticated",
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse: errorResponse{
+				Error: "you must be authenticated to access this resource",
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodGet
+		tc.requestUrlPath = "/v1/users/me/export"
+		testHandler(t, ts, tc)
+	}
+}
+
+func TestExportCurrentUserHandler_TrashedMovies(t *testing.T) {
+	ts := newTestServer(t)
+	ts.insertMovie(t, "Die Hard", 1988, 207, []string{"Action", "Thriller"})
+	ts.insertMovie(t, "Heat", 1995, 170, []string{"Crime", "Thriller"})
+
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234",
+		activated: true, authenticated: true, permCodes: []string{"movies:read", "movies:write"},
+	})
+	authHeader := map[string]string{"Authorization": "Bearer " + authToken}
+
+	for _, id := range []string{"1", "2"} {
+		testHandler(t, ts, handlerTestcase{
+			name:                   "Add movie " + id + " to watchlist",
+			requestUrlPath:         "/v1/users/me/watchlist/" + id,
+			requestMethodType:      http.MethodPut,
+			requestHeader:          authHeader,
+			wantResponseStatusCode: http.StatusOK,
+		})
+		testHandler(t, ts, handlerTestcase{
+			name:                   "Mark movie " + id + " as watched",
+			requestUrlPath:         "/v1/users/me/watched/" + id,
+			requestMethodType:      http.MethodPut,
+			requestHeader:          authHeader,
+			requestBody:            `{"watched_on": "2020-05-17"}`,
+			wantResponseStatusCode: http.StatusOK,
+		})
+	}
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "Delete movie",
+		requestUrlPath:         "/v1/movies/2",
+		requestMethodType:      http.MethodDelete,
+		requestHeader:          authHeader,
+		wantResponseStatusCode: http.StatusOK,
+	})
+
+	// The movie in the trash is left out of the watchlist, but its entries are still
+	// personal data of the user and belong in the export.
+	type exportedMovie struct {
+		ID        int        `json:"id"`
+		DeletedAt *time.Time `json:"deleted_at"`
+	}
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "Export",
+		requestUrlPath:         "/v1/users/me/export",
+		requestMethodType:      http.MethodGet,
+		requestHeader:          authHeader,
+		wantResponseStatusCode: http.StatusOK,
+		additionalChecks: func(t *testing.T, res *http.Response) {
+			var dst userExportResponse
+			readJsonResponse(t, res.Body, &dst)
+
+			for name, entries := range map[string][]json.RawMessage{
+				"watchlist": dst.Export.Watchlist,
+				"watched":   dst.Export.Watched,
+			} {
+				require.Len(t, entries, 2, name)
+
+				var movies []exportedMovie
+				for _, entry := range entries {
+					var e struct {
+						Movie exportedMovie `json:"movie"`
+					}
+					require.NoError(t, json.Unmarshal(entry, &e))
+					movies = append(movies, e.Movie)
+				}
+
+				assert.Equal(t, 1, movies[0].ID, name)
+				assert.Nil(t, movies[0].DeletedAt, name)
+				assert.Equal(t, 2, movies[1].ID, name)
+				assert.NotNil(t, movies[1].DeletedAt, name)
+			}
+		},
+	})
+}
@@ -23,6 +23,36 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// readVersionParam is a helper that reads a 'version' parameter from the URL and converts it to an integer.
+func (app *application) readVersionParam(r *http.Request) (int32, error) {
+	version, err := strconv.ParseInt(chi.URLParam(r, "version"), 10, 32)
+	if err != nil || version < 1 {
+		return 0, errors.New("invalid version parameter")
+	}
+
+	return int32(version), nil
+}
+
+// readCreditIDParam is a helper that reads a 'creditID' parameter from the URL and converts it to an integer.
+func (app *application) readCreditIDParam(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "creditID"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid credit id parameter")
+	}
+
+	return id, nil
+}
+
+// readMovieIDParam is a helper that reads a 'movieID' parameter from the URL and converts it to an integer.
+func (app *application) readMovieIDParam(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "movieID"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid movie id parameter")
+	}
+
+	return id, nil
+}
+
 // writeJSON is a helper that writes the provided data to the client in JSON format.
 // The status code will always be included, and the header map is optional (and may be nil).
 // It will also include the "Content-Type: application/json" header in the response.
@@ -181,6 +211,25 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// readBool reads a boolean value from the query string. If no matching key could be
+// found it returns nil. If the value couldn't be converted to a boolean, then we record
+// an error message in the provided Validator instance.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+
+	return &b
+}
+
 // background is a helper that wraps the provided function in a new goroutine and runs it in the background.
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
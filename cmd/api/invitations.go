@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/96malhar/greenlight/internal/data"
+	"github.com/96malhar/greenlight/internal/validator"
+	"net/http"
+	"time"
+)
+
+// defaultInvitationTTL is how long an invitation is valid if no expiry is given.
+const defaultInvitationTTL = 7 * 24 * time.Hour
+
+// createInvitationHandler invites an email address to register a user account, which is
+// granted the given permission codes. The invitation token is emailed to the invitee.
+func (app *application) createInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email       string     `json:"email"`
+		Permissions []string   `json:"permissions"`
+		Expiry      *time.Time `json:"expiry"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Permissions == nil {
+		input.Permissions = []string{}
+	}
+
+	expiry := time.Now().UTC().Add(defaultInvitationTTL)
+	if input.Expiry != nil {
+		expiry = *input.Expiry
+	}
+
+	invitation := data.NewInvitation(input.Email, input.Permissions, app.contextGetUser(r).ID, expiry)
+
+	knownPermissions, err := app.modelStore.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateInvitation(v, invitation)
+	for _, code := range invitation.Permissions {
+		v.Check(knownPermissions.Include(code), "permissions", "must only contain known permission codes")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.modelStore.Users.GetByEmail(invitation.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.modelStore.Invitations.Insert(invitation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		invitationData := map[string]any{
+			"invitationToken": invitation.Plaintext,
+			"email":           invitation.Email,
+			"expiry":          invitation.Expiry.Format(time.RFC1123),
+		}
+		err := app.mailer.Send(invitation.Email, "user_invitation.tmpl", invitationData)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to send invitation email to (%s). Err = %s", invitation.Email, err.Error())
+			app.logger.Error(msg)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"invitation": invitation}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listInvitationsHandler returns the invitations which haven't been used or expired yet.
+func (app *application) listInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	invitations, err := app.modelStore.Invitations.GetAllPending()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"invitations": invitations}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteInvitationHandler revokes a specific invitation.
+func (app *application) deleteInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.modelStore.Invitations.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "invitation successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/96malhar/greenlight/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type invitation struct {
+	ID          int64     `json:"id"`
+	Email       string    `json:"email"`
+	Permissions []string  `json:"permissions"`
+	InvitedBy   *int64    `json:"invited_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	Expiry      time.Time `json:"expiry"`
+}
+
+func (ts *testServer) insertInvitation(t *testing.T, email string, permissions []string, invitedBy int64) string {
+	inv := data.NewInvitation(email, permissions, invitedBy, time.Now().Add(time.Hour))
+	require.NoError(t, ts.app.modelStore.Invitations.Insert(inv))
+	return inv.Plaintext
+}
+
+func TestInvitationHandlers(t *testing.T) {
+	ts := newTestServer(t)
+	mailer := &mockMailer{}
+	ts.app.mailer = mailer
+
+	adminToken := ts.insertUser(t, dummyUser{
+		name: "Admin", email: "admin@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		permCodes: []string{"users:admin"},
+	})
+	adminHeader := map[string]string{"Authorization": "Bearer " + adminToken}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Invalid fields",
+			requestBody:            `{"email":"alice", "permissions":["movies:read", "movies:fly"], "expiry":"2000-01-01T00:00:00Z"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"email":       "must be a valid email address",
+					"permissions": "must only contain known permission codes",
+					"expiry":      "must be in the future",
+				},
+			},
+		},
+		{
+			name:                   "Existing user",
+			requestBody:            `{"email":"admin@gmail.com"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"email": "a user with this email address already exists",
+				},
+			},
+		},
+		{
+			name:                   "Valid invitation",
+			requestBody:            `{"email":"alice@gmail.com", "permissions":["movies:write"]}`,
+			wantResponseStatusCode: http.StatusCreated,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst struct {
+					Invitation invitation `json:"invitation"`
+				}
+				readJsonResponse(t, res.Body, &dst)
+				assert.Equal(t, "alice@gmail.com", dst.Invitation.Email)
+				assert.Equal(t, []string{"movies:write"}, dst.Invitation.Permissions)
+				require.NotNil(t, dst.Invitation.InvitedBy)
+				assert.Equal(t, int64(1), *dst.Invitation.InvitedBy)
+				assert.WithinDuration(t, time.Now().Add(7*24*time.Hour), dst.Invitation.Expiry, 2*time.Second)
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodPost
+		tc.requestUrlPath = "/v1/admin/invitations"
+		tc.requestHeader = adminHeader
+		testHandler(t, ts, tc)
+	}
+
+	// wait for the invitee to get the invitation email
+	time.Sleep(200 * time.Millisecond)
+	assert.True(t, mailer.SendInvoked)
+	assert.Equal(t, "alice@gmail.com", mailer.Recipient)
+	assert.Equal(t, "user_invitation.tmpl", mailer.TemplateFile)
+	assert.Len(t, mailer.TokenPlainText, 26)
+
+	testcases = []handlerTestcase{
+		{
+			name:                   "List invitations",
+			requestUrlPath:         "/v1/admin/invitations",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst struct {
+					Invitations []invitation `json:"invitations"`
+				}
+				readJsonResponse(t, res.Body, &dst)
+				require.Len(t, dst.Invitations, 1)
+				assert.Equal(t, "alice@gmail.com", dst.Invitations[0].Email)
+			},
+		},
+		{
+			name:                   "Revoke invitation",
+			requestUrlPath:         "/v1/admin/invitations/1",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "invitation successfully revoked",
+			},
+		},
+		{
+			name:                   "Revoke non-existent invitation",
+			requestUrlPath:         "/v1/admin/invitations/1",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestHeader = adminHeader
+		testHandler(t, ts, tc)
+	}
+}
+
+func TestRegisterUserHandler_InviteMode(t *testing.T) {
+	ts := newTestServer(t)
+	ts.app.config.registration.mode = registrationModeInvite
+	mailer := &mockMailer{}
+	ts.app.mailer = mailer
+
+	ts.insertUser(t, dummyUser{
+		name: "Admin", email: "admin@gmail.com", password: "pa55word1234", activated: true,
+	})
+	token := ts.insertInvitation(t, "alice@gmail.com", []string{"movies:write"}, 1)
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Missing invitation token",
+			requestBody:            `{"name":"Alice", "email":"alice@gmail.com", "password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"invitation_token": "must be provided",
+				},
+			},
+		},
+		{
+			name:                   "Invalid invitation token",
+			requestBody:            `{"name":"Alice", "email":"alice@gmail.com", "password":"pa55word1234", "invitation_token":"ABCDEFGHIJKLMNOPQRSTUVWXYZ"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"invitation_token": "invalid or expired invitation token",
+				},
+			},
+		},
+		{
+			name:                   "Different email address",
+			requestBody:            fmt.Sprintf(`{"name":"Bob", "email":"bob@gmail.com", "password":"pa55word1234", "invitation_token":%q}`, token),
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"email": "must match the email address of the invitation",
+				},
+			},
+		},
+		{
+			name:                   "Valid invitation",
+			requestBody:            fmt.Sprintf(`{"name":"Alice", "email":"ALICE@gmail.com", "password":"pa55word1234", "invitation_token":%q}`, token),
+			wantResponseStatusCode: http.StatusCreated,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst userResponse
+				readJsonResponse(t, res.Body, &dst)
+				assert.True(t, dst.User.Activated)
+
+				permissions, err := ts.app.modelStore.Permissions.GetAllForUser(dst.User.ID)
+				require.NoError(t, err)
+				assert.Equal(t, data.Permissions{"movies:read", "movies:write"}, permissions)
+			},
+		},
+		{
+			name:                   "Invitation can only be used once",
+			requestBody:            fmt.Sprintf(`{"name":"Alice", "email":"alice2@gmail.com", "password":"pa55word1234", "invitation_token":%q}`, token),
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"invitation_token": "invalid or expired invitation token",
+				},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodPost
+		tc.requestUrlPath = "/v1/users"
+		testHandler(t, ts, tc)
+	}
+
+	// No activation email is sent for an account registered with an invitation.
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, mailer.SendInvoked)
+
+	ts.login(t, "alice@gmail.com", "pa55word1234", nil)
+}
+
+func TestInvitationStore_Accept(t *testing.T) {
+	ts := newTestServer(t)
+	ts.insertUser(t, dummyUser{
+		name: "Admin", email: "admin@gmail.com", password: "pa55word1234", activated: true,
+	})
+
+	newUser := func(t *testing.T, name, email string) *data.User {
+		user := &data.User{Name: name, Email: email, Activated: true}
+		require.NoError(t, user.Password.Set("pa55word1234", ts.app.passwordHasher))
+		return user
+	}
+
+	// If the user can't be inserted, nothing is granted and the invitation can still be used.
+	token := ts.insertInvitation(t, "admin@gmail.com", []string{"movies:write"}, 1)
+	inv, err := ts.app.modelStore.Invitations.GetForToken(token)
+	require.NoError(t, err)
+
+	err = ts.app.modelStore.Invitations.Accept(inv.ID, newUser(t, "Admin", "admin@gmail.com"), "viewer")
+	assert.ErrorIs(t, err, data.ErrDuplicateEmail)
+
+	_, err = ts.app.modelStore.Invitations.GetForToken(token)
+	assert.NoError(t, err)
+
+	// An invitation which is used concurrently is only accepted once.
+	token = ts.insertInvitation(t, "alice@gmail.com", []string{"movies:write"}, 1)
+	inv, err = ts.app.modelStore.Invitations.GetForToken(token)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+
+	for i := range errs {
+		user := newUser(t, "Alice", fmt.Sprintf("alice%d@gmail.com", i))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = ts.app.modelStore.Invitations.Accept(inv.ID, user, "viewer")
+		}()
+	}
+	wg.Wait()
+
+	accepted := 0
+	for _, err := range errs {
+		if err == nil {
+			accepted++
+			continue
+		}
+		assert.ErrorIs(t, err, data.ErrRecordNotFound)
+	}
+	assert.Equal(t, 1, accepted)
+
+	var users int
+	err = ts.db.QueryRow(context.Background(), "SELECT count(*) FROM users").Scan(&users)
+	require.NoError(t, err)
+	assert.Equal(t, 2, users)
+
+	_, err = ts.app.modelStore.Invitations.GetForToken(token)
+	assert.ErrorIs(t, err, data.ErrRecordNotFound)
+}
+
+func TestRegisterUserHandler_ClosedMode(t *testing.T) {
+	ts := newTestServer(t)
+	ts.app.config.registration.mode = registrationModeClosed
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "Registration closed",
+		requestUrlPath:         "/v1/users",
+		requestMethodType:      http.MethodPost,
+		requestBody:            `{"name":"Alice", "email":"alice@gmail.com", "password":"pa55word1234"}`,
+		wantResponseStatusCode: http.StatusForbidden,
+		wantResponse: errorResponse{
+			Error: "registration of new user accounts is closed",
+		},
+	})
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type movieList struct {
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	UserID      int64     `json:"user_id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Public      bool      `json:"public"`
+	MovieCount  int32     `json:"movie_count"`
+	Version     int32     `json:"version"`
+}
+
+type listItem struct {
+	Position int32     `json:"position"`
+	AddedAt  time.Time `json:"added_at"`
+	Movie    movie     `json:"movie"`
+}
+
+type movieListResponse struct {
+	List movieList `json:"list"`
+}
+
+type showListResponse struct {
+	List               movieList          `json:"list"`
+	Movies             []listItem         `json:"movies"`
+	PaginationMetadata paginationMetadata `json:"metadata"`
+}
+
+type listListsResponse struct {
+	Lists              []movieList        `json:"lists"`
+	PaginationMetadata paginationMetadata `json:"metadata"`
+}
+
+func TestListHandlers(t *testing.T) {
+	ts := newTestServer(t)
+	ts.insertMovie(t, "Pulp Fiction", 1994, 154, []string{"Crime"})
+	ts.insertMovie(t, "Forrest Gump", 1994, 142, []string{"Drama"})
+	ts.insertMovie(t, "Speed", 1994, 116, []string{"Action"})
+
+	editorToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234",
+		activated: true, authenticated: true, permCodes: []string{"movies:read", "movies:write"},
+	})
+	editorHeader := map[string]string{"Authorization": "Bearer " + editorToken}
+
+	viewerToken := ts.insertUser(t, dummyUser{
+		name: "Bob", email: "bob@gmail.com", password: "pa55word1234",
+		activated: true, authenticated: true, permCodes: []string{"movies:read"},
+	})
+	viewerHeader := map[string]string{"Authorization": "Bearer " + viewerToken}
+
+	showList := func(t *testing.T, path string, header map[string]string) showListResponse {
+		res, err := ts.executeRequest(http.MethodGet, path, "", header)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		var dst showListResponse
+		readJsonResponse(t, res.Body, &dst)
+		return dst
+	}
+
+	listLists := func(t *testing.T, query string, header map[string]string) listListsResponse {
+		res, err := ts.executeRequest(http.MethodGet, "/v1/lists"+query, "", header)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		var dst listListsResponse
+		readJsonResponse(t, res.Body, &dst)
+		return dst
+	}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Create public list",
+			requestUrlPath:         "/v1/lists",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          editorHeader,
+			requestBody:            `{"title":"Best of 1994","description":"A vintage year.","public":true}`,
+			wantResponseStatusCode: http.StatusCreated,
+			wantResponseHeader:     map[string]string{"Location": "/v1/lists/1"},
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst movieListResponse
+				readJsonResponse(t, res.Body, &dst)
+				assert.Equal(t, int64(1), dst.List.UserID)
+				assert.Equal(t, "Best of 1994", dst.List.Title)
+				assert.True(t, dst.List.Public)
+				assert.Equal(t, int32(0), dst.List.MovieCount)
+				assert.Equal(t, int32(1), dst.List.Version)
+			},
+		},
+		{
+			name:                   "Create private list",
+			requestUrlPath:         "/v1/lists",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          viewerHeader,
+			requestBody:            `{"title":"To rewatch"}`,
+			wantResponseStatusCode: http.StatusCreated,
+			wantResponseHeader:     map[string]string{"Location": "/v1/lists/2"},
+		},
+		{
+			name:                   "Viewer cannot publish a list",
+			requestUrlPath:         "/v1/lists",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          viewerHeader,
+			requestBody:            `{"title":"My favourites","public":true}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"public": "only editors can publish lists",
+				},
+			},
+		},
+		{
+			name:                   "Viewer cannot publish their list by updating it",
+			requestUrlPath:         "/v1/lists/2",
+			requestMethodType:      http.MethodPatch,
+			requestHeader:          viewerHeader,
+			requestBody:            `{"public":true}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"public": "only editors can publish lists",
+				},
+			},
+		},
+		{
+			name:                   "Invalid list",
+			requestUrlPath:         "/v1/lists",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          editorHeader,
+			requestBody:            `{"title":""}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"title": "must be provided",
+				},
+			},
+		},
+		{
+			name:                   "Private list of another user",
+			requestUrlPath:         "/v1/lists/2",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          editorHeader,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+		{
+			name:                   "Update public list of another user",
+			requestUrlPath:         "/v1/lists/1",
+			requestMethodType:      http.MethodPatch,
+			requestHeader:          viewerHeader,
+			requestBody:            `{"title":"Worst of 1994"}`,
+			wantResponseStatusCode: http.StatusForbidden,
+			wantResponse: errorResponse{
+				Error: "your user account doesn't have the necessary permissions to access this resource",
+			},
+		},
+		{
+			name:                   "Add movies to public list of another user",
+			requestUrlPath:         "/v1/lists/1/movies",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          viewerHeader,
+			requestBody:            `{"movie_ids":[1]}`,
+			wantResponseStatusCode: http.StatusForbidden,
+			wantResponse: errorResponse{
+				Error: "your user account doesn't have the necessary permissions to access this resource",
+			},
+		},
+		{
+			name:                   "Add movies",
+			requestUrlPath:         "/v1/lists/1/movies",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          editorHeader,
+			requestBody:            `{"movie_ids":[1,2,3]}`,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst movieListResponse
+				readJsonResponse(t, res.Body, &dst)
+				assert.Equal(t, int32(3), dst.List.MovieCount)
+			},
+		},
+		{
+			name:                   "Add movies which are on the list already",
+			requestUrlPath:         "/v1/lists/1/movies",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          editorHeader,
+			requestBody:            `{"movie_ids":[2]}`,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst movieListResponse
+				readJsonResponse(t, res.Body, &dst)
+				assert.Equal(t, int32(3), dst.List.MovieCount)
+			},
+		},
+		{
+			name:                   "Add movies which do not exist",
+			requestUrlPath:         "/v1/lists/1/movies",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          editorHeader,
+			requestBody:            `{"movie_ids":[1,9]}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"movie_ids": "must only contain existing movies",
+				},
+			},
+		},
+		{
+			name:                   "Add duplicate movies",
+			requestUrlPath:         "/v1/lists/1/movies",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          editorHeader,
+			requestBody:            `{"movie_ids":[1,1]}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"movie_ids": "must not contain duplicate values",
+				},
+			},
+		},
+		{
+			name:                   "Reorder movies",
+			requestUrlPath:         "/v1/lists/1/movies",
+			requestMethodType:      http.MethodPut,
+			requestHeader:          editorHeader,
+			requestBody:            `{"movie_ids":[3,1,2]}`,
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "Reorder with movies missing",
+			requestUrlPath:         "/v1/lists/1/movies",
+			requestMethodType:      http.MethodPut,
+			requestHeader:          editorHeader,
+			requestBody:            `{"movie_ids":[3,1]}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"movie_ids": "must contain every movie on the list exactly once",
+				},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		testHandler(t, ts, tc)
+	}
+
+	t.Run("Show list", func(t *testing.T) {
+		dst := showList(t, "/v1/lists/1", viewerHeader)
+		assert.Equal(t, "Best of 1994", dst.List.Title)
+		assert.Equal(t, newPaginationMetadata(1, 20, 3), dst.PaginationMetadata)
+		require.Len(t, dst.Movies, 3)
+
+		for i, title := range []string{"Speed", "Pulp Fiction", "Forrest Gump"} {
+			assert.Equal(t, int32(i+1), dst.Movies[i].Position)
+			assert.Equal(t, title, dst.Movies[i].Movie.Title)
+		}
+	})
+
+	t.Run("Paginate list", func(t *testing.T) {
+		dst := showList(t, "/v1/lists/1?page=2&page_size=2&sort=title", viewerHeader)
+		assert.Equal(t, newPaginationMetadata(2, 2, 3), dst.PaginationMetadata)
+		require.Len(t, dst.Movies, 1)
+		assert.Equal(t, "Speed", dst.Movies[0].Movie.Title)
+	})
+
+	t.Run("List lists", func(t *testing.T) {
+		dst := listLists(t, "?sort=id", viewerHeader)
+		assert.Equal(t, newPaginationMetadata(1, 20, 2), dst.PaginationMetadata)
+		require.Len(t, dst.Lists, 2)
+		assert.Equal(t, "Best of 1994", dst.Lists[0].Title)
+		assert.Equal(t, "To rewatch", dst.Lists[1].Title)
+
+		dst = listLists(t, "", editorHeader)
+		require.Len(t, dst.Lists, 1)
+		assert.Equal(t, "Best of 1994", dst.Lists[0].Title)
+
+		dst = listLists(t, "?user_id=2", viewerHeader)
+		require.Len(t, dst.Lists, 1)
+		assert.Equal(t, "To rewatch", dst.Lists[0].Title)
+	})
+
+	t.Run("Remove movie", func(t *testing.T) {
+		testHandler(t, ts, handlerTestcase{
+			name:                   "Remove movie",
+			requestUrlPath:         "/v1/lists/1/movies/1",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          editorHeader,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "movie removed from list",
+			},
+		})
+
+		testHandler(t, ts, handlerTestcase{
+			name:                   "Remove movie which is not on the list",
+			requestUrlPath:         "/v1/lists/1/movies/1",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          editorHeader,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		})
+
+		dst := showList(t, "/v1/lists/1", editorHeader)
+		require.Len(t, dst.Movies, 2)
+		assert.Equal(t, "Speed", dst.Movies[0].Movie.Title)
+		assert.Equal(t, "Forrest Gump", dst.Movies[1].Movie.Title)
+	})
+
+	t.Run("Delete list", func(t *testing.T) {
+		testHandler(t, ts, handlerTestcase{
+			name:                   "Delete list of another user",
+			requestUrlPath:         "/v1/lists/1",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          viewerHeader,
+			wantResponseStatusCode: http.StatusForbidden,
+			wantResponse: errorResponse{
+				Error: "your user account doesn't have the necessary permissions to access this resource",
+			},
+		})
+
+		testHandler(t, ts, handlerTestcase{
+			name:                   "Delete list",
+			requestUrlPath:         "/v1/lists/2",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          viewerHeader,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "list successfully deleted",
+			},
+		})
+
+		testHandler(t, ts, handlerTestcase{
+			name:                   "Show deleted list",
+			requestUrlPath:         "/v1/lists/2",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          viewerHeader,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		})
+	})
+}
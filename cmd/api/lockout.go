@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/96malhar/greenlight/internal/data"
+	"github.com/96malhar/greenlight/internal/validator"
+	"net/http"
+	"time"
+)
+
+const (
+	// loginFreeAttempts is the number of consecutive failed logins for an email address
+	// which are allowed before further attempts are delayed.
+	loginFreeAttempts = 3
+	// loginBackoffBase is the delay imposed after the first failed login beyond
+	// loginFreeAttempts. The delay doubles with every further failure.
+	loginBackoffBase = time.Second
+)
+
+// claimLoginAttempt claims an attempt to log in with a specific email address before the
+// credentials are checked. The claimed attempt counts as a failure until it is released
+// with releaseLoginAttempt or the address is unlocked, so that concurrent guesses can't
+// get past the backoff and the lockout. If the client has to wait before it may try again,
+// nothing is claimed and the returned duration is non-zero.
+func (app *application) claimLoginAttempt(email string) (*data.LoginAttempt, time.Duration, error) {
+	throttle := data.LoginThrottle{
+		FreeAttempts:    loginFreeAttempts,
+		BackoffBase:     loginBackoffBase,
+		Threshold:       app.config.auth.lockout.threshold,
+		LockoutDuration: app.config.auth.lockout.duration,
+	}
+
+	return app.modelStore.LoginAttempts.Claim(email, time.Now().UTC(), throttle)
+}
+
+// releaseLoginAttempt releases a claimed attempt to log in with a specific email address
+// which didn't fail, but which didn't complete the login either.
+func (app *application) releaseLoginAttempt(email string) error {
+	return app.modelStore.LoginAttempts.Release(email)
+}
+
+// recordFailedLogin locks the email address of a claimed login attempt which failed, once
+// the lockout threshold is reached. If the address belongs to a user, they are sent an
+// email containing a token which can be used to unlock it early. The user is nil if no
+// user has the email address.
+func (app *application) recordFailedLogin(attempt *data.LoginAttempt, user *data.User) error {
+	if attempt.FailedCount < app.config.auth.lockout.threshold {
+		return nil
+	}
+
+	email := attempt.Email
+	now := time.Now().UTC()
+	lockout := app.config.auth.lockout.duration
+
+	err := app.modelStore.LoginAttempts.Lock(email, now.Add(lockout))
+	if err != nil {
+		return err
+	}
+
+	app.logger.Warn("login locked after too many failed attempts", "email", email)
+
+	if user == nil {
+		return nil
+	}
+
+	token, err := app.modelStore.Tokens.New(user.ID, lockout, data.ScopeUnlock)
+	if err != nil {
+		return err
+	}
+
+	app.background(func() {
+		tokenData := map[string]any{
+			"unlockToken":     token.Plaintext,
+			"lockoutDuration": lockout.String(),
+		}
+		err := app.mailer.Send(user.Email, "user_locked.tmpl", tokenData)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to send account lockout email for user (%s). Err = %s", user.Email, err.Error())
+			app.logger.Error(msg)
+		}
+	})
+
+	return nil
+}
+
+// purgeStaleLoginAttempts removes the failed login attempts which are no longer counted,
+// once every purge interval. Attempts are recorded for any email address which is sent,
+// so they have to be removed even if no user ever logs in with the address. It never
+// returns, so it should be run in its own goroutine.
+func (app *application) purgeStaleLoginAttempts() {
+	ticker := time.NewTicker(app.config.auth.lockout.purgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.modelStore.LoginAttempts.PurgeStale(time.Now().UTC(), app.config.auth.lockout.duration)
+		if err != nil {
+			app.logger.Error("failed to purge stale login attempts", "error", err.Error())
+			continue
+		}
+
+		if n > 0 {
+			app.logger.Info("purged stale login attempts", "count", n)
+		}
+	}
+}
+
+// unlockUserHandler unlocks a locked account using the token which was emailed to the user
+// when the account was locked.
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.modelStore.Users.GetForToken(data.ScopeUnlock, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired unlock token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.unlockUser(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your account has been unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// unlockUser forgets the failed login attempts for the email address of a user, and
+// deletes any unlock tokens which were issued to them.
+func (app *application) unlockUser(user *data.User) error {
+	err := app.modelStore.LoginAttempts.Delete(user.Email)
+	if err != nil {
+		return err
+	}
+
+	return app.modelStore.Tokens.DeleteAllForUser(data.ScopeUnlock, user.ID)
+}
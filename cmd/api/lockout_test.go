@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func (ts *testServer) failLogin(t *testing.T, email string, times int) {
+	for range times {
+		body := fmt.Sprintf(`{"email":%q, "password":"wrongpa55word"}`, email)
+		res, err := ts.executeRequest(http.MethodPost, "/v1/tokens/authentication", body, nil)
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	}
+}
+
+func wantRetryAfter(lo, hi int) func(t *testing.T, res *http.Response) {
+	return func(t *testing.T, res *http.Response) {
+		retryAfter, err := strconv.Atoi(res.Header.Get("Retry-After"))
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, retryAfter, lo)
+		assert.LessOrEqual(t, retryAfter, hi)
+	}
+}
+
+func TestCreateAuthenticationTokenHandler_Backoff(t *testing.T) {
+	ts := newTestServer(t)
+	ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true,
+	})
+
+	// The first few failures are free, the one after them delays the next attempt.
+	ts.failLogin(t, "alice@gmail.com", 4)
+	ts.failLogin(t, "nobody@gmail.com", 4)
+
+	tooManyAttemptsResponse := errorResponse{Error: "too many failed login attempts, please try again later"}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Existing user",
+			requestBody:            `{"email":"alice@gmail.com", "password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusTooManyRequests,
+			wantResponse:           tooManyAttemptsResponse,
+			additionalChecks:       wantRetryAfter(1, 1),
+		},
+		{
+			name:                   "User does not exist",
+			requestBody:            `{"email":"nobody@gmail.com", "password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusTooManyRequests,
+			wantResponse:           tooManyAttemptsResponse,
+			additionalChecks:       wantRetryAfter(1, 1),
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodPost
+		tc.requestUrlPath = "/v1/tokens/authentication"
+		testHandler(t, ts, tc)
+	}
+
+	// Once the delay has passed, the user can log in again.
+	time.Sleep(1100 * time.Millisecond)
+	ts.login(t, "alice@gmail.com", "pa55word1234", nil)
+
+	// A successful login forgets the earlier failures.
+	ts.failLogin(t, "alice@gmail.com", 3)
+	ts.login(t, "alice@gmail.com", "pa55word1234", nil)
+}
+
+func TestCreateAuthenticationTokenHandler_Lockout(t *testing.T) {
+	ts := newTestServer(t)
+	ts.app.config.auth.lockout.threshold = 2
+	mailer := &mockMailer{}
+	ts.app.mailer = mailer
+
+	ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true,
+	})
+
+	ts.failLogin(t, "nobody@gmail.com", 2)
+
+	// wait for any lockout email to be sent
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, mailer.SendInvoked)
+
+	ts.failLogin(t, "alice@gmail.com", 2)
+
+	// wait for the user to get the lockout email
+	time.Sleep(200 * time.Millisecond)
+	assert.True(t, mailer.SendInvoked)
+	assert.Equal(t, "alice@gmail.com", mailer.Recipient)
+	assert.Equal(t, "user_locked.tmpl", mailer.TemplateFile)
+	assert.Len(t, mailer.TokenPlainText, 26)
+
+	tooManyAttemptsResponse := errorResponse{Error: "too many failed login attempts, please try again later"}
+	lockoutSeconds := int(ts.app.config.auth.lockout.duration.Seconds())
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Locked user with the right password",
+			requestUrlPath:         "/v1/tokens/authentication",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"email":"alice@gmail.com", "password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusTooManyRequests,
+			wantResponse:           tooManyAttemptsResponse,
+			additionalChecks:       wantRetryAfter(lockoutSeconds-5, lockoutSeconds),
+		},
+		{
+			name:                   "Locked email address without a user",
+			requestUrlPath:         "/v1/tokens/authentication",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"email":"nobody@gmail.com", "password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusTooManyRequests,
+			wantResponse:           tooManyAttemptsResponse,
+			additionalChecks:       wantRetryAfter(lockoutSeconds-5, lockoutSeconds),
+		},
+		{
+			name:                   "Invalid unlock token",
+			requestUrlPath:         "/v1/users/unlocked",
+			requestMethodType:      http.MethodPut,
+			requestBody:            `{"token":"ABCDEFGHIJKLMNOPQRSTUVWXYZ"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"token": "invalid or expired unlock token",
+				},
+			},
+		},
+		{
+			name:                   "Valid unlock token",
+			requestUrlPath:         "/v1/users/unlocked",
+			requestMethodType:      http.MethodPut,
+			requestBody:            fmt.Sprintf(`{"token":%q}`, mailer.TokenPlainText),
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "your account has been unlocked",
+			},
+		},
+		{
+			name:                   "Unlock token can only be used once",
+			requestUrlPath:         "/v1/users/unlocked",
+			requestMethodType:      http.MethodPut,
+			requestBody:            fmt.Sprintf(`{"token":%q}`, mailer.TokenPlainText),
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+
+	ts.login(t, "alice@gmail.com", "pa55word1234", nil)
+}
+
+func TestCreateAuthenticationTokenHandler_ConcurrentGuesses(t *testing.T) {
+	ts := newTestServer(t)
+	ts.app.config.auth.lockout.threshold = 2
+	ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true,
+	})
+
+	// Every guess is counted before any of them is checked, so only as many guesses as
+	// the lockout threshold allows get their password checked.
+	var wg sync.WaitGroup
+	var unauthorized, tooMany atomic.Int32
+
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := `{"email":"alice@gmail.com", "password":"wrongpa55word"}`
+			res, err := ts.executeRequest(http.MethodPost, "/v1/tokens/authentication", body, nil)
+			if !assert.NoError(t, err) {
+				return
+			}
+			res.Body.Close()
+
+			switch res.StatusCode {
+			case http.StatusUnauthorized:
+				unauthorized.Add(1)
+			case http.StatusTooManyRequests:
+				tooMany.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(2), unauthorized.Load())
+	assert.Equal(t, int32(8), tooMany.Load())
+
+	// The address is locked, so even the right password is refused.
+	res, err := ts.executeRequest(http.MethodPost, "/v1/tokens/authentication", `{"email":"alice@gmail.com", "password":"pa55word1234"}`, nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+}
+
+func TestPurgeStaleLoginAttempts(t *testing.T) {
+	ts := newTestServer(t)
+	now := time.Now().UTC()
+	lockout := ts.app.config.auth.lockout.duration
+
+	// Logins with addresses which belong to no user are recorded like any other.
+	ts.failLogin(t, "nobody@gmail.com", 1)
+
+	query := `
+        INSERT INTO login_attempts (email, failed_count, last_failed_at, locked_until)
+        VALUES ($1, $2, $3, $4)`
+
+	expiredLock, activeLock := now.Add(-time.Minute), now.Add(time.Minute)
+
+	rows := []struct {
+		email        string
+		lastFailedAt time.Time
+		lockedUntil  *time.Time
+	}{
+		{email: "stale@gmail.com", lastFailedAt: now.Add(-lockout - time.Minute)},
+		{email: "expired-lock@gmail.com", lastFailedAt: now.Add(-2 * lockout), lockedUntil: &expiredLock},
+		{email: "locked@gmail.com", lastFailedAt: now.Add(-2 * lockout), lockedUntil: &activeLock},
+		{email: "recent@gmail.com", lastFailedAt: now.Add(-lockout + time.Minute)},
+	}
+
+	for _, row := range rows {
+		_, err := ts.db.Exec(context.Background(), query, row.email, 3, row.lastFailedAt, row.lockedUntil)
+		require.NoError(t, err)
+	}
+
+	n, err := ts.app.modelStore.LoginAttempts.PurgeStale(now, lockout)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+
+	var emails []string
+	dbRows, err := ts.db.Query(context.Background(), "SELECT email FROM login_attempts ORDER BY email")
+	require.NoError(t, err)
+	defer dbRows.Close()
+
+	for dbRows.Next() {
+		var email string
+		require.NoError(t, dbRows.Scan(&email))
+		emails = append(emails, email)
+	}
+	require.NoError(t, dbRows.Err())
+
+	assert.Equal(t, []string{"locked@gmail.com", "nobody@gmail.com", "recent@gmail.com"}, emails)
+
+	// Once the lock has expired and every failure is older than the lockout, the rest are
+	// purged too.
+	n, err = ts.app.modelStore.LoginAttempts.PurgeStale(now.Add(lockout+time.Minute), lockout)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+}
+
+func TestUnlockUserAccountHandler(t *testing.T) {
+	ts := newTestServer(t)
+	ts.app.config.auth.lockout.threshold = 2
+	adminToken := ts.insertUser(t, dummyUser{
+		name: "Admin", email: "admin@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		permCodes: []string{"users:admin"},
+	})
+	ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true,
+	})
+
+	ts.failLogin(t, "alice@gmail.com", 2)
+
+	adminHeader := map[string]string{"Authorization": "Bearer " + adminToken}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Locked user",
+			requestUrlPath:         "/v1/tokens/authentication",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"email":"alice@gmail.com", "password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusTooManyRequests,
+		},
+		{
+			name:                   "Non-existent user",
+			requestUrlPath:         "/v1/admin/users/100/lockout",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          adminHeader,
+			wantResponseStatusCode: http.StatusNotFound,
+		},
+		{
+			name:                   "Unlock user",
+			requestUrlPath:         "/v1/admin/users/2/lockout",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          adminHeader,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "the user account has been unlocked",
+			},
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+
+	ts.login(t, "alice@gmail.com", "pa55word1234", nil)
+}
@@ -7,9 +7,14 @@ import (
 	"fmt"
 	"github.com/96malhar/greenlight/internal/data"
 	"github.com/96malhar/greenlight/internal/email"
+	"github.com/96malhar/greenlight/internal/jwt"
+	"github.com/96malhar/greenlight/internal/oidc"
 	"github.com/96malhar/greenlight/internal/vcs"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/crypto/bcrypt"
 	"log/slog"
+	"math"
+	"net/http"
 	"os"
 	"runtime"
 	"strings"
@@ -19,6 +24,30 @@ import (
 
 var version = vcs.Version()
 
+// The supported authentication modes. In token mode authentication tokens are opaque
+// random strings which are looked up in the database on every request, while in jwt mode
+// they are signed JWTs which are verified without touching the database.
+const (
+	authModeToken = "token"
+	authModeJWT   = "jwt"
+)
+
+// The supported password hashing algorithms. Hashes generated with either of them can
+// always be checked, and are upgraded to the configured algorithm when users log in.
+const (
+	passwordHasherArgon2id = "argon2id"
+	passwordHasherBcrypt   = "bcrypt"
+)
+
+// The supported registration modes. In open mode anyone can register a user account, in
+// invite mode only people who were invited by an administrator can, and in closed mode
+// nobody can.
+const (
+	registrationModeOpen   = "open"
+	registrationModeInvite = "invite"
+	registrationModeClosed = "closed"
+)
+
 type config struct {
 	port int
 	env  string
@@ -42,6 +71,52 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	auth struct {
+		mode            string
+		accessTokenTTL  time.Duration
+		refreshTokenTTL time.Duration
+		jwt             struct {
+			keysFile     string
+			signingKeyID string
+			issuer       string
+		}
+		lockout struct {
+			threshold     int
+			duration      time.Duration
+			purgeInterval time.Duration
+		}
+	}
+	password struct {
+		hasher       string
+		bcryptCost   int
+		minEntropy   float64
+		breachedList string
+		argon2       struct {
+			memory      uint
+			iterations  uint
+			parallelism uint
+		}
+	}
+	registration struct {
+		mode        string
+		defaultRole string
+	}
+	accountDeletion struct {
+		gracePeriod   time.Duration
+		purgeInterval time.Duration
+	}
+	movieTrash struct {
+		retention     time.Duration
+		purgeInterval time.Duration
+	}
+	oidc struct {
+		issuer           string
+		clientID         string
+		clientSecret     string
+		redirectURL      string
+		autoProvision    bool
+		trustProviderMFA bool
+	}
 	publishMetrics bool
 }
 
@@ -57,16 +132,50 @@ func (c config) LogValue() slog.Value {
 		slog.Int("limiter-burst", c.limiter.burst),
 		slog.Bool("limiter-enabled", c.limiter.enabled),
 
+		slog.String("auth-mode", c.auth.mode),
+		slog.Duration("auth-access-token-ttl", c.auth.accessTokenTTL),
+		slog.Duration("auth-refresh-token-ttl", c.auth.refreshTokenTTL),
+		slog.Int("auth-lockout-threshold", c.auth.lockout.threshold),
+		slog.Duration("auth-lockout-duration", c.auth.lockout.duration),
+		slog.Duration("auth-lockout-purge-interval", c.auth.lockout.purgeInterval),
+
+		slog.String("password-hasher", c.password.hasher),
+		slog.Int("password-bcrypt-cost", c.password.bcryptCost),
+		slog.Uint64("password-argon2-memory", uint64(c.password.argon2.memory)),
+		slog.Uint64("password-argon2-iterations", uint64(c.password.argon2.iterations)),
+		slog.Uint64("password-argon2-parallelism", uint64(c.password.argon2.parallelism)),
+		slog.Float64("password-min-entropy", c.password.minEntropy),
+		slog.String("password-breached-list", c.password.breachedList),
+
+		slog.String("registration-mode", c.registration.mode),
+		slog.String("registration-default-role", c.registration.defaultRole),
+
+		slog.Duration("account-deletion-grace-period", c.accountDeletion.gracePeriod),
+		slog.Duration("account-deletion-purge-interval", c.accountDeletion.purgeInterval),
+
+		slog.Duration("movie-trash-retention", c.movieTrash.retention),
+		slog.Duration("movie-trash-purge-interval", c.movieTrash.purgeInterval),
+
+		slog.String("oidc-issuer", c.oidc.issuer),
+		slog.String("oidc-client-id", c.oidc.clientID),
+		slog.String("oidc-redirect-url", c.oidc.redirectURL),
+		slog.Bool("oidc-auto-provision", c.oidc.autoProvision),
+		slog.Bool("oidc-trust-provider-mfa", c.oidc.trustProviderMFA),
+
 		slog.String("version", version),
 	)
 }
 
 type application struct {
-	config     config
-	logger     *slog.Logger
-	modelStore data.ModelStore
-	mailer     email.MailerInterface
-	wg         sync.WaitGroup
+	config         config
+	logger         *slog.Logger
+	modelStore     data.ModelStore
+	mailer         email.MailerInterface
+	jwtKeys        *jwt.KeySet
+	oidcProvider   *oidc.Provider
+	passwordHasher data.PasswordHasher
+	passwordPolicy data.PasswordPolicy
+	wg             sync.WaitGroup
 }
 
 type envelope map[string]any
@@ -90,8 +199,71 @@ func main() {
 		modelStore: data.NewModelStore(db),
 	}
 
+	switch cfg.auth.mode {
+	case authModeToken:
+	case authModeJWT:
+		app.jwtKeys, err = jwt.LoadKeySet(cfg.auth.jwt.keysFile, cfg.auth.jwt.signingKeyID)
+		if err != nil {
+			logger.Error(err.Error())
+			logger.Error("cannot load JWT key set", "file", cfg.auth.jwt.keysFile)
+			os.Exit(1)
+		}
+	default:
+		logger.Error("unsupported authentication mode", "mode", cfg.auth.mode)
+		os.Exit(1)
+	}
+
+	app.passwordHasher, err = newPasswordHasher(cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	app.passwordPolicy = data.PasswordPolicy{MinEntropy: cfg.password.minEntropy}
+	if cfg.password.breachedList != "" {
+		app.passwordPolicy.Breached, err = data.LoadBreachedPasswords(cfg.password.breachedList)
+		if err != nil {
+			logger.Error(err.Error())
+			logger.Error("cannot load breached password list", "file", cfg.password.breachedList)
+			os.Exit(1)
+		}
+		logger.Info("breached password list loaded", "passwords", app.passwordPolicy.Breached.Len())
+	}
+
+	switch cfg.registration.mode {
+	case registrationModeOpen, registrationModeInvite, registrationModeClosed:
+	default:
+		logger.Error("unsupported registration mode", "mode", cfg.registration.mode)
+		os.Exit(1)
+	}
+
+	if cfg.oidc.issuer != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		app.oidcProvider, err = oidc.Discover(ctx, cfg.oidc.issuer, oidc.Config{
+			ClientID:     cfg.oidc.clientID,
+			ClientSecret: cfg.oidc.clientSecret,
+			RedirectURL:  cfg.oidc.redirectURL,
+		}, &http.Client{Timeout: 10 * time.Second})
+		cancel()
+		if err != nil {
+			logger.Error(err.Error())
+			logger.Error("cannot discover OpenID Connect provider", "issuer", cfg.oidc.issuer)
+			os.Exit(1)
+		}
+	}
+
+	err = app.checkDefaultRole()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
 	monitorMetrics(db)
 
+	go app.purgeDeletedUsers()
+	go app.purgeStaleLoginAttempts()
+	go app.purgeDeletedMovies()
+
 	err = app.serve()
 	if err != nil {
 		logger.Error(err.Error())
@@ -119,6 +291,41 @@ func parseConfig() config {
 	flag.StringVar(&cfg.smtp.password, "smtp-password", os.Getenv("MAILTRAP_PASS"), "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.alexedwards.net>", "SMTP sender")
 
+	flag.StringVar(&cfg.auth.mode, "auth-mode", authModeToken, "Authentication mode (token|jwt)")
+	flag.DurationVar(&cfg.auth.accessTokenTTL, "auth-access-token-ttl", 15*time.Minute, "Lifetime of authentication (access) tokens")
+	flag.DurationVar(&cfg.auth.refreshTokenTTL, "auth-refresh-token-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+	flag.StringVar(&cfg.auth.jwt.keysFile, "auth-jwt-keys", os.Getenv("GREENLIGHT_JWT_KEYS"), "Path to the JSON file containing the JWT key set")
+	flag.StringVar(&cfg.auth.jwt.signingKeyID, "auth-jwt-signing-key", "", "Key id (kid) of the key used to sign JWTs (defaults to the first key in the key set)")
+	flag.StringVar(&cfg.auth.jwt.issuer, "auth-jwt-issuer", "greenlight", "Issuer (iss) of the JWTs")
+	flag.IntVar(&cfg.auth.lockout.threshold, "auth-lockout-threshold", 10, "Number of consecutive failed logins after which an account is locked")
+	flag.DurationVar(&cfg.auth.lockout.duration, "auth-lockout-duration", 15*time.Minute, "Duration of an account lockout")
+	flag.DurationVar(&cfg.auth.lockout.purgeInterval, "auth-lockout-purge-interval", time.Hour, "How often failed login attempts which are no longer counted are purged")
+
+	flag.StringVar(&cfg.password.hasher, "password-hasher", passwordHasherArgon2id, "Password hashing algorithm (argon2id|bcrypt)")
+	flag.IntVar(&cfg.password.bcryptCost, "password-bcrypt-cost", data.DefaultBcryptHasher.Cost, "bcrypt cost")
+	flag.UintVar(&cfg.password.argon2.memory, "password-argon2-memory", uint(data.DefaultArgon2idHasher.Memory), "Argon2id memory in KiB")
+	flag.UintVar(&cfg.password.argon2.iterations, "password-argon2-iterations", uint(data.DefaultArgon2idHasher.Iterations), "Argon2id number of iterations")
+	flag.UintVar(&cfg.password.argon2.parallelism, "password-argon2-parallelism", uint(data.DefaultArgon2idHasher.Parallelism), "Argon2id degree of parallelism")
+
+	flag.Float64Var(&cfg.password.minEntropy, "password-min-entropy", data.DefaultPasswordPolicy.MinEntropy, "Minimum estimated entropy of new passwords in bits")
+	flag.StringVar(&cfg.password.breachedList, "password-breached-list", os.Getenv("GREENLIGHT_BREACHED_PASSWORDS"), "Path to a file of SHA-1 hashes of breached passwords, which can't be used as new passwords (empty to disable)")
+
+	flag.StringVar(&cfg.registration.mode, "registration-mode", registrationModeOpen, "Registration mode (open|invite|closed)")
+	flag.StringVar(&cfg.registration.defaultRole, "registration-default-role", "viewer", "Role granted to newly registered users (empty for none)")
+
+	flag.DurationVar(&cfg.accountDeletion.gracePeriod, "account-deletion-grace-period", 30*24*time.Hour, "How long deleted accounts can be restored before they are purged")
+	flag.DurationVar(&cfg.accountDeletion.purgeInterval, "account-deletion-purge-interval", time.Hour, "How often accounts whose grace period is over are purged")
+
+	flag.DurationVar(&cfg.movieTrash.retention, "movie-trash-retention", 30*24*time.Hour, "How long deleted movies are kept in the trash before they are purged")
+	flag.DurationVar(&cfg.movieTrash.purgeInterval, "movie-trash-purge-interval", time.Hour, "How often movies whose retention is over are purged from the trash")
+
+	flag.StringVar(&cfg.oidc.issuer, "oidc-issuer", "", "Issuer URL of the OpenID Connect provider (empty to disable OpenID Connect login)")
+	flag.StringVar(&cfg.oidc.clientID, "oidc-client-id", "", "OpenID Connect client id")
+	flag.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", os.Getenv("GREENLIGHT_OIDC_CLIENT_SECRET"), "OpenID Connect client secret")
+	flag.StringVar(&cfg.oidc.redirectURL, "oidc-redirect-url", "http://localhost:4000/v1/auth/oidc/callback", "OpenID Connect redirect URL")
+	flag.BoolVar(&cfg.oidc.autoProvision, "oidc-auto-provision", true, "Create accounts for OpenID Connect users who don't have one")
+	flag.BoolVar(&cfg.oidc.trustProviderMFA, "oidc-trust-provider-mfa", false, "Skip two-factor authentication for OpenID Connect logins, trusting the provider to check a second factor")
+
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
 		cfg.cors.trustedOrigins = strings.Fields(val)
 		return nil
@@ -163,6 +370,27 @@ func openDB(cfg config) (*pgxpool.Pool, error) {
 	return db, nil
 }
 
+// checkDefaultRole returns an error if the role granted to newly registered users doesn't
+// exist, since they would silently be registered without any permissions otherwise.
+func (app *application) checkDefaultRole() error {
+	if app.config.registration.defaultRole == "" {
+		return nil
+	}
+
+	roles, err := app.modelStore.Roles.GetAll()
+	if err != nil {
+		return err
+	}
+
+	for _, role := range roles {
+		if role.Name == app.config.registration.defaultRole {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("default role %q does not exist", app.config.registration.defaultRole)
+}
+
 func monitorMetrics(pool *pgxpool.Pool) {
 	expvar.NewString("version").Set(version)
 
@@ -194,3 +422,36 @@ func monitorMetrics(pool *pgxpool.Pool) {
 		return time.Now().Unix()
 	}))
 }
+
+// newPasswordHasher returns the PasswordHasher for the configured algorithm and parameters.
+func newPasswordHasher(cfg config) (data.PasswordHasher, error) {
+	switch cfg.password.hasher {
+	case passwordHasherArgon2id:
+		p := cfg.password.argon2
+		if p.iterations < 1 || p.iterations > math.MaxUint32 {
+			return nil, fmt.Errorf("argon2id iterations must be between 1 and %d", uint32(math.MaxUint32))
+		}
+		if p.parallelism < 1 || p.parallelism > math.MaxUint8 {
+			return nil, fmt.Errorf("argon2id parallelism must be between 1 and %d", math.MaxUint8)
+		}
+		if p.memory < 8*p.parallelism || p.memory > math.MaxUint32 {
+			return nil, fmt.Errorf("argon2id memory must be between %d and %d KiB", 8*p.parallelism, uint32(math.MaxUint32))
+		}
+
+		return data.Argon2idHasher{
+			Memory:      uint32(p.memory),
+			Iterations:  uint32(p.iterations),
+			Parallelism: uint8(p.parallelism),
+			SaltLength:  data.DefaultArgon2idHasher.SaltLength,
+			KeyLength:   data.DefaultArgon2idHasher.KeyLength,
+		}, nil
+	case passwordHasherBcrypt:
+		if cfg.password.bcryptCost < bcrypt.MinCost || cfg.password.bcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+
+		return data.BcryptHasher{Cost: cfg.password.bcryptCost}, nil
+	default:
+		return nil, fmt.Errorf("unsupported password hasher %q", cfg.password.hasher)
+	}
+}
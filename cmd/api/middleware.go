@@ -86,11 +86,45 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 	})
 }
 
+// sessionTouchInterval is the minimum amount of time between two updates of the last
+// used time of an authentication token, so that not every authenticated request results
+// in a database write.
+const sessionTouchInterval = 5 * time.Minute
+
 // authenticate extracts the authentication token from the request header, checks its validity, and looks up the
 // corresponding user record from the database. It sets the user record (or the anonymous user record if no
 // corresponding record was found) in the request context so that it can be retrieved by later handlers.
 // If an invalid or expired token is provided, or the token isn't found in the database, then a 401 Unauthorized response is sent to the client.
 func (app *application) authenticate(next http.Handler) http.Handler {
+	// lastTouched holds the time at which the last used time of each recently used token
+	// or API key was updated, keyed by its hash.
+	var (
+		mu          sync.Mutex
+		lastTouched = make(map[string]time.Time)
+	)
+
+	// touch reports whether the last used time of the credential with the given hash
+	// should be updated, which is at most once per sessionTouchInterval. Entries for
+	// credentials which haven't been used for a while are removed at the same time, so
+	// that the lastTouched map doesn't grow indefinitely.
+	touch := func(hash []byte, now time.Time) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if now.Sub(lastTouched[string(hash)]) < sessionTouchInterval {
+			return false
+		}
+
+		for h, touchedAt := range lastTouched {
+			if now.Sub(touchedAt) >= sessionTouchInterval {
+				delete(lastTouched, h)
+			}
+		}
+		lastTouched[string(hash)] = now
+
+		return true
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Add the "Vary: Authorization" header to the response. This indicates to any
 		// caches that the response may vary based on the value of the Authorization
@@ -117,7 +151,61 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// using the invalidAuthenticationTokenResponse() helper (which we will create
 		// in a moment).
 		headerParts := strings.Split(authorizationHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		if len(headerParts) != 2 {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		// API keys are sent as "ApiKey <key>" instead. The request is only granted the
+		// permissions of the key which the user still has.
+		if headerParts[0] == "ApiKey" {
+			key, user, err := app.modelStore.APIKeys.GetForPlaintext(headerParts[1])
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			if user.IsDisabled() {
+				app.disabledAccountResponse(w, r)
+				return
+			}
+
+			userPermissions, err := app.modelStore.Permissions.GetAllForUser(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			permissions := make(data.Permissions, 0, len(key.Permissions))
+			for _, code := range key.Permissions {
+				if userPermissions.Include(code) {
+					permissions = append(permissions, code)
+				}
+			}
+
+			if now := time.Now().UTC(); touch(key.Hash, now) {
+				app.background(func() {
+					err := app.modelStore.APIKeys.UpdateLastUsed(key.ID, now)
+					if err != nil {
+						app.logger.Error(fmt.Sprintf("Failed to update last used time of API key (%d). Err = %s", key.ID, err.Error()))
+					}
+				})
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetPermissions(r, permissions)
+			r = app.contextSetAPIKey(r, key)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
@@ -125,6 +213,25 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// Extract the actual authentication token from the header parts.
 		tokenPlaintext := headerParts[1]
 
+		// In jwt mode the token is verified using its signature alone, and the user
+		// record and permissions are built from its claims rather than read from the
+		// database. A JWT issued before the account was disabled therefore stays valid
+		// until it expires, though it can no longer be refreshed.
+		if app.config.auth.mode == authModeJWT {
+			user, claims, err := app.verifyJWT(tokenPlaintext)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetPermissions(r, claims.Permissions)
+			r = app.contextSetSessionFamily(r, claims.SessionID)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// Validate the token to make sure it is in a sensible format.
 		v := validator.New()
 
@@ -151,9 +258,29 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		// Disabling an account revokes its tokens, but check anyway in case a token was
+		// issued concurrently.
+		if user.IsDisabled() {
+			app.disabledAccountResponse(w, r)
+			return
+		}
+
+		tokenHash := data.HashTokenPlaintext(tokenPlaintext)
+
+		// Record when the token was last used, at most once per sessionTouchInterval.
+		if now := time.Now().UTC(); touch(tokenHash, now) {
+			app.background(func() {
+				err := app.modelStore.Tokens.UpdateLastUsed(tokenHash, now)
+				if err != nil {
+					app.logger.Error(fmt.Sprintf("Failed to update last used time of token for user (%d). Err = %s", user.ID, err.Error()))
+				}
+			})
+		}
+
 		// Call the contextSetUser() helper to add the user information to the request
-		// context.
+		// context, along with the hash of the token so that it can be revoked later.
 		r = app.contextSetUser(r, user)
+		r = app.contextSetTokenHash(r, tokenHash)
 
 		// Call the next handler in the chain.
 		next.ServeHTTP(w, r)
@@ -174,6 +301,24 @@ func (app *application) requireAuthenticatedUser(next http.Handler) http.Handler
 	})
 }
 
+// requireSessionAuthentication checks that a user is authenticated with a login session
+// rather than an API key. It guards the endpoints which manage the account and its
+// credentials, so that an API key can't be used to take over the account or to create
+// keys with more permissions than its own. If the request was authenticated with an API
+// key, then a 403 Forbidden response is sent to the client.
+func (app *application) requireSessionAuthentication(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := app.contextGetAPIKey(r); ok {
+			app.apiKeyNotAllowedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireAuthenticatedUser(http.HandlerFunc(fn))
+}
+
 // requireActivatedUser checks that a user is both authenticated and activated. If the user is not authenticated, then a 401 Unauthorized response is sent to the client.
 // If the user is authenticated but has not activated their account, then a 403 Forbidden response is sent to the client.
 func (app *application) requireActivatedUser(next http.Handler) http.Handler {
@@ -193,16 +338,23 @@ func (app *application) requireActivatedUser(next http.Handler) http.Handler {
 	return app.requireAuthenticatedUser(http.HandlerFunc(fn))
 }
 
+// requestPermissions returns the permissions of the user who made the request, unless
+// they were already provided by the token that the request was authenticated with.
+func (app *application) requestPermissions(r *http.Request) (data.Permissions, error) {
+	permissions, ok := app.contextGetPermissions(r)
+	if ok {
+		return permissions, nil
+	}
+
+	return app.modelStore.Permissions.GetAllForUser(app.contextGetUser(r).ID)
+}
+
 // requirePermission checks that a user is authenticated, activated and has the required permissions.
 // If not, a 403 Forbidden response is sent to the client.
 func (app *application) requirePermission(code string) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
-			// Retrieve the user from the request context.
-			user := app.contextGetUser(r)
-
-			// Get the slice of permissions for the user.
-			permissions, err := app.modelStore.Permissions.GetAllForUser(user.ID)
+			permissions, err := app.requestPermissions(r)
 			if err != nil {
 				app.serverErrorResponse(w, r, err)
 				return
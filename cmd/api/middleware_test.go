@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"github.com/96malhar/greenlight/internal/jwt"
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -179,6 +181,112 @@ func TestAuthenticate(t *testing.T) {
 	}
 }
 
+func TestAuthenticate_JWTMode(t *testing.T) {
+	// Verifying a JWT doesn't need the database, so the application is created without one.
+	app := newTestApplication(nil)
+	app.config.auth.mode = authModeJWT
+	app.config.auth.jwt.issuer = "greenlight"
+
+	oldKey, err := jwt.NewHS256Key("2024-01", bytes.Repeat([]byte("s"), 32))
+	require.NoError(t, err)
+	currentKey, err := jwt.NewEdDSAKey("2024-06", bytes.Repeat([]byte("e"), 32))
+	require.NoError(t, err)
+	unknownKey, err := jwt.NewEdDSAKey("2024-12", bytes.Repeat([]byte("u"), 32))
+	require.NoError(t, err)
+
+	app.jwtKeys, err = jwt.NewKeySet(currentKey.ID, oldKey, currentKey)
+	require.NoError(t, err)
+	oldKeySet, err := jwt.NewKeySet(oldKey.ID, oldKey)
+	require.NoError(t, err)
+	unknownKeySet, err := jwt.NewKeySet(unknownKey.ID, unknownKey)
+	require.NoError(t, err)
+
+	router := chi.NewRouter()
+	router.Use(app.authenticate)
+	router.With(app.requirePermission("movies:read")).Get("/test-auth", func(w http.ResponseWriter, r *http.Request) {
+		app.writeJSON(w, http.StatusOK, envelope{"message": "This is a logged in user."}, nil)
+	})
+
+	ts := &testServer{router: router, app: app}
+
+	sign := func(ks *jwt.KeySet, modify func(claims *jwt.Claims)) map[string]string {
+		claims := jwt.NewClaims("greenlight", "1", time.Hour)
+		claims.Activated = true
+		claims.Permissions = []string{"movies:read"}
+		if modify != nil {
+			modify(&claims)
+		}
+
+		token, err := ks.Sign(claims)
+		require.NoError(t, err)
+
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	invalidTokenResponse := errorResponse{Error: "invalid or missing authentication token"}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Valid token",
+			requestHeader:          sign(app.jwtKeys, nil),
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse:           map[string]string{"message": "This is a logged in user."},
+		},
+		{
+			name:                   "Token signed with a rotated key",
+			requestHeader:          sign(oldKeySet, nil),
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse:           map[string]string{"message": "This is a logged in user."},
+		},
+		{
+			name:                   "Token signed with an unknown key",
+			requestHeader:          sign(unknownKeySet, nil),
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse:           invalidTokenResponse,
+		},
+		{
+			name: "Tampered token",
+			requestHeader: func() map[string]string {
+				header := sign(app.jwtKeys, nil)
+				header["Authorization"] += "x"
+				return header
+			}(),
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse:           invalidTokenResponse,
+		},
+		{
+			name:                   "Expired token",
+			requestHeader:          sign(app.jwtKeys, func(c *jwt.Claims) { c.Expiry = time.Now().Add(-time.Minute).Unix() }),
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse:           invalidTokenResponse,
+		},
+		{
+			name:                   "Token from another issuer",
+			requestHeader:          sign(app.jwtKeys, func(c *jwt.Claims) { c.Issuer = "someone-else" }),
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse:           invalidTokenResponse,
+		},
+		{
+			name:                   "Inactive user",
+			requestHeader:          sign(app.jwtKeys, func(c *jwt.Claims) { c.Activated = false }),
+			wantResponseStatusCode: http.StatusForbidden,
+			wantResponse:           errorResponse{Error: "your user account must be activated to access this resource"},
+		},
+		{
+			name:                   "Missing permission",
+			requestHeader:          sign(app.jwtKeys, func(c *jwt.Claims) { c.Permissions = nil }),
+			wantResponseStatusCode: http.StatusForbidden,
+			wantResponse:           errorResponse{Error: "your user account doesn't have the necessary permissions to access this resource"},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodGet
+		tc.requestUrlPath = "/test-auth"
+		testHandler(t, ts, tc)
+	}
+}
+
 func TestEnableCORS_SimpleRequests(t *testing.T) {
 	ts := newTestServer(t)
 	ts.app.config.cors.trustedOrigins = []string{"https://example.com"}
@@ -6,6 +6,7 @@ import (
 	"github.com/96malhar/greenlight/internal/data"
 	"github.com/96malhar/greenlight/internal/validator"
 	"net/http"
+	"time"
 )
 
 // createMovieHandler creates a new movie record in the database.
@@ -42,6 +43,8 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	app.auditChange(r, data.NewAuditEvent(data.AuditMovieCreate, data.AuditTargetMovie, movie.ID), nil, movie)
+
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
 
@@ -51,7 +54,8 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
-// showMovieHandler retrieves the details of a specific movie from the database.
+// showMovieHandler retrieves the details of a specific movie from the database, along
+// with its cast and crew.
 func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
@@ -70,6 +74,12 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	movie.Credits, err = app.modelStore.Credits.GetAllForMovie(movie.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -95,6 +105,9 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Keep a copy of the movie as it was for the audit log.
+	before := *movie
+
 	// Declare an input struct to hold the expected data from the client.
 	// The pointer fields are used to support partial updates
 	var input struct {
@@ -140,13 +153,16 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	app.auditChange(r, data.NewAuditEvent(data.AuditMovieUpdate, data.AuditTargetMovie, movie.ID), &before, movie)
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
-// deleteMovieHandler deletes a specific movie from the database.
+// deleteMovieHandler moves a specific movie to the trash. It can be restored with
+// restoreMovieHandler until it's purged by purgeDeletedMovies.
 func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
@@ -154,7 +170,11 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.modelStore.Movies.Delete(id)
+	// The movie is read first so that the audit log records what was deleted.
+	movie, err := app.modelStore.Movies.Get(id)
+	if err == nil {
+		err = app.modelStore.Movies.Delete(id)
+	}
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -165,17 +185,100 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	app.auditChange(r, data.NewAuditEvent(data.AuditMovieDelete, data.AuditTargetMovie, movie.ID), movie, nil)
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// restoreMovieHandler takes a specific movie out of the trash.
+func (app *application) restoreMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.modelStore.Movies.Restore(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.NewAuditEvent(data.AuditMovieUndelete, data.AuditTargetMovie, movie.ID))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listDeletedMoviesHandler returns the movies in the trash, most recently deleted first
+// by default.
+func (app *application) listDeletedMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-deleted_at")
+	input.Filters.SortSafelist = []string{"id", "title", "deleted_at", "-id", "-title", "-deleted_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies, metadata, err := app.modelStore.Movies.GetAllDeleted(input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// purgeDeletedMovies permanently removes the movies which have been in the trash for longer
+// than the retention period, once every purge interval. It never returns, so it should be
+// run in its own goroutine.
+func (app *application) purgeDeletedMovies() {
+	ticker := time.NewTicker(app.config.movieTrash.purgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.modelStore.Movies.PurgeDeleted(time.Now().UTC().Add(-app.config.movieTrash.retention))
+		if err != nil {
+			app.logger.Error("failed to purge deleted movies", "error", err.Error())
+			continue
+		}
+
+		if n > 0 {
+			app.logger.Info("purged deleted movies", "count", n)
+		}
+	}
+}
+
 // listMoviesHandler returns a list of movies from the database.
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title  string
-		Genres []string
+		Title    string
+		Genres   []string
+		PersonID int64
 		data.Filters
 	}
 
@@ -185,17 +288,23 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 
 	input.Title = app.readString(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.PersonID = int64(app.readInt(qs, "person", 0, v))
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Filters.SortSafelist = []string{
+		"id", "title", "year", "runtime", "average_rating", "rating_count",
+		"-id", "-title", "-year", "-runtime", "-average_rating", "-rating_count",
+	}
+
+	v.Check(input.PersonID >= 0, "person", "must not be negative")
 
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	movies, metadata, err := app.modelStore.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.modelStore.Movies.GetAll(input.Title, input.Genres, input.PersonID, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -206,3 +315,14 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// readMovie fetches the movie named by the 'id' parameter of the URL. It returns a
+// ErrRecordNotFound if the parameter is invalid.
+func (app *application) readMovie(r *http.Request) (*data.Movie, error) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return app.modelStore.Movies.Get(id)
+}
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"math"
 	"net/http"
 	"testing"
+	"time"
 )
 
 type movie struct {
-	ID      int      `json:"id"`
-	Title   string   `json:"title"`
-	Year    int      `json:"year"`
-	Runtime string   `json:"runtime"`
-	Genres  []string `json:"genres"`
-	Version int      `json:"version"`
+	ID            int      `json:"id"`
+	Title         string   `json:"title"`
+	Year          int      `json:"year"`
+	Runtime       string   `json:"runtime"`
+	Genres        []string `json:"genres"`
+	AverageRating float64  `json:"average_rating"`
+	RatingCount   int      `json:"rating_count"`
+	Version       int      `json:"version"`
+	Credits       []credit `json:"credits,omitempty"`
 }
 
 type movieResponse struct {
@@ -172,6 +178,12 @@ func TestDeleteMovieHandler(t *testing.T) {
 				"message": "movie successfully deleted",
 			},
 		},
+		{
+			name:                   "Already deleted",
+			requestUrlPath:         "/v1/movies/1",
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
 		{
 			name:                   "Resource not found",
 			requestUrlPath:         "/v1/movies/6",
@@ -202,6 +214,148 @@ func TestDeleteMovieHandler(t *testing.T) {
 	}
 }
 
+type deletedMovie struct {
+	movie
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+type listDeletedMoviesResponse struct {
+	Movies             []deletedMovie     `json:"movies"`
+	PaginationMetadata paginationMetadata `json:"metadata"`
+}
+
+func TestMovieTrash(t *testing.T) {
+	ts := newTestServer(t)
+	ts.insertMovie(t, "Die Hard", 1988, 207, []string{"Action", "Thriller"})
+	ts.insertMovie(t, "Titanic", 1997, 196, []string{"Romance"})
+	ts.insertMovie(t, "Heat", 1995, 170, []string{"Crime"})
+
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234",
+		activated: true, authenticated: true,
+		permCodes: []string{"movies:read", "movies:write"},
+	})
+	authHeader := map[string]string{"Authorization": "Bearer " + authToken}
+
+	listTrash := func(t *testing.T) listDeletedMoviesResponse {
+		res, err := ts.executeRequest(http.MethodGet, "/v1/movies/trash", "", authHeader)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		var dst listDeletedMoviesResponse
+		readJsonResponse(t, res.Body, &dst)
+		return dst
+	}
+
+	for _, id := range []string{"1", "2"} {
+		testHandler(t, ts, handlerTestcase{
+			name:                   "Delete movie " + id,
+			requestUrlPath:         "/v1/movies/" + id,
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          authHeader,
+			wantResponseStatusCode: http.StatusOK,
+		})
+	}
+
+	t.Run("Deleted movies are hidden", func(t *testing.T) {
+		res, err := ts.executeRequest(http.MethodGet, "/v1/movies", "", authHeader)
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		var dst listMovieResponse
+		readJsonResponse(t, res.Body, &dst)
+		require.Len(t, dst.Movies, 1)
+		assert.Equal(t, "Heat", dst.Movies[0].Title)
+	})
+
+	t.Run("List trash", func(t *testing.T) {
+		dst := listTrash(t)
+		require.Len(t, dst.Movies, 2)
+		assert.Equal(t, newPaginationMetadata(1, 20, 2), dst.PaginationMetadata)
+		for _, m := range dst.Movies {
+			assert.Equal(t, 2, m.Version)
+			assert.WithinDuration(t, time.Now(), m.DeletedAt, 5*time.Second)
+		}
+	})
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Show deleted movie",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+		{
+			name:                   "Update deleted movie",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodPatch,
+			requestBody:            `{"year": 1990}`,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+		{
+			name:                   "Restore movie",
+			requestUrlPath:         "/v1/movies/1/restore",
+			requestMethodType:      http.MethodPost,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: movieResponse{
+				Movie: movie{
+					ID: 1, Title: "Die Hard", Year: 1988, Runtime: "207 mins",
+					Genres: []string{"Action", "Thriller"}, Version: 3,
+				},
+			},
+		},
+		{
+			name:                   "Restore movie which is not deleted",
+			requestUrlPath:         "/v1/movies/3/restore",
+			requestMethodType:      http.MethodPost,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+		{
+			name:                   "Show restored movie",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "Invalid trash sort",
+			requestUrlPath:         "/v1/movies/trash?sort=year",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"sort": "invalid sort value",
+				},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestHeader = authHeader
+		testHandler(t, ts, tc)
+	}
+
+	t.Run("Purge", func(t *testing.T) {
+		n, err := ts.app.modelStore.Movies.PurgeDeleted(time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+
+		assert.Empty(t, listTrash(t).Movies)
+
+		testHandler(t, ts, handlerTestcase{
+			name:                   "Restore purged movie",
+			requestUrlPath:         "/v1/movies/2/restore",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          authHeader,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		})
+	})
+}
+
 func TestUpdateMovieHandler(t *testing.T) {
 	ts := newTestServer(t)
 	ts.insertMovie(t, "Die Hard", 1988, 207, []string{"Action", "Thriller"})
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"github.com/96malhar/greenlight/internal/data"
+	"github.com/96malhar/greenlight/internal/oidc"
+	"github.com/96malhar/greenlight/internal/validator"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// oidcLoginTTL is how long a user has to log in with the provider.
+	oidcLoginTTL = 10 * time.Minute
+	// oidcStateCookie is the name of the cookie which binds a login to the browser that
+	// started it, so that a callback URL can't be used to log someone else in.
+	oidcStateCookie = "greenlight_oidc_state"
+)
+
+// oidcLoginHandler starts a login with the OpenID Connect provider by redirecting the
+// user to its authorization endpoint.
+func (app *application) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidcProvider == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	verifier, challenge := oidc.NewPKCE()
+
+	login := &data.OIDCLogin{
+		State:        rand.Text(),
+		Nonce:        rand.Text(),
+		CodeVerifier: verifier,
+		Expiry:       time.Now().UTC().Add(oidcLoginTTL),
+	}
+
+	err := app.modelStore.OIDC.InsertLogin(login)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, app.oidcStateCookie(login.State, int(oidcLoginTTL.Seconds())))
+	http.Redirect(w, r, app.oidcProvider.AuthCodeURL(login.State, login.Nonce, challenge), http.StatusFound)
+}
+
+// oidcCallbackHandler completes a login with the OpenID Connect provider. It exchanges
+// the authorization code for an ID token, finds or creates the user for the identity in
+// the token and starts a new session for them. Users who have enabled two-factor
+// authentication get a 2fa-pending token instead, as after logging in with a password,
+// unless the provider is trusted to check a second factor.
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidcProvider == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+
+	// The provider redirects with an error parameter instead of a code if the user
+	// didn't log in or refused to grant access.
+	if providerError := qs.Get("error"); providerError != "" {
+		app.logger.Warn("OpenID Connect login failed at the provider", "error", providerError, "description", qs.Get("error_description"))
+		app.oidcLoginFailedResponse(w, r)
+		return
+	}
+
+	state := app.readString(qs, "state", "")
+	code := app.readString(qs, "code", "")
+
+	v := validator.New()
+
+	v.Check(state != "", "state", "must be provided")
+	v.Check(code != "", "code", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The login is over whatever happens next, so the cookie is cleared right away.
+	cookie, err := r.Cookie(oidcStateCookie)
+	http.SetCookie(w, app.oidcStateCookie("", -1))
+
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		v.AddError("state", "invalid or expired login state")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	login, err := app.modelStore.OIDC.ConsumeLogin(state)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("state", "invalid or expired login state")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	rawIDToken, err := app.oidcProvider.Exchange(ctx, code, login.CodeVerifier)
+	if err != nil {
+		app.logger.Warn("OpenID Connect code exchange failed", "error", err.Error())
+		app.oidcLoginFailedResponse(w, r)
+		return
+	}
+
+	claims, err := app.oidcProvider.VerifyIDToken(ctx, rawIDToken, login.Nonce, time.Now())
+	if err != nil {
+		app.logger.Warn("OpenID Connect ID token rejected", "error", err.Error())
+		app.oidcLoginFailedResponse(w, r)
+		return
+	}
+
+	user, err := app.userForOIDCClaims(claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oidcAccountNotFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.IsDisabled() {
+		app.disabledAccountResponse(w, r)
+		return
+	}
+
+	if !app.config.oidc.trustProviderMFA {
+		tf, err := app.modelStore.TwoFactor.Get(user.ID)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if tf != nil && tf.Confirmed {
+			app.twoFactorPendingResponse(w, r, user)
+			return
+		}
+	}
+
+	authToken, refreshToken, err := app.newSessionTokens(r, user, data.NewTokenFamily())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.auditLogin(r, user)
+
+	env := envelope{"authentication_token": authToken, "refresh_token": refreshToken}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// userForOIDCClaims returns the user for the identity in a verified ID token. A user who
+// has logged in with the identity before is found by it. Otherwise, the identity is linked
+// to the user with the same email address, or a new activated user is created for it if
+// auto-provisioning is enabled and registration is open. Email addresses are only trusted
+// once the provider has verified them. It returns a ErrRecordNotFound if there is no user
+// for the identity.
+func (app *application) userForOIDCClaims(claims *oidc.Claims) (*data.User, error) {
+	user, err := app.modelStore.OIDC.GetUserForIdentity(claims.Issuer, claims.Subject)
+	if err == nil || !errors.Is(err, data.ErrRecordNotFound) {
+		return user, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, data.ErrRecordNotFound
+	}
+
+	user, err = app.modelStore.Users.GetByEmail(claims.Email)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound) && app.config.oidc.autoProvision && app.config.registration.mode == registrationModeOpen:
+		user, err = app.provisionOIDCUser(claims)
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
+
+	err = app.modelStore.OIDC.LinkIdentity(user.ID, claims.Issuer, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	app.logger.Info("OpenID Connect identity linked", "user_id", user.ID, "issuer", claims.Issuer)
+
+	return user, nil
+}
+
+// provisionOIDCUser creates an activated user for an identity at the provider, with the
+// default role of newly registered users. The user gets a random password, which they
+// can replace through a password reset if they ever need to log in without the provider.
+func (app *application) provisionOIDCUser(claims *oidc.Claims) (*data.User, error) {
+	name := strings.TrimSpace(claims.Name)
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	user := &data.User{
+		Name:      name,
+		Email:     claims.Email,
+		Activated: true,
+	}
+
+	err := user.Password.Set(rand.Text(), app.passwordHasher)
+	if err != nil {
+		return nil, err
+	}
+
+	// The email address can only be taken by an account which is scheduled for deletion,
+	// since GetByEmail didn't find it.
+	err = app.modelStore.Users.Insert(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			return nil, data.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if app.config.registration.defaultRole != "" {
+		err = app.modelStore.Roles.AddForUser(user.ID, app.config.registration.defaultRole)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+// oidcStateCookie returns the cookie holding the state of a login in progress. A negative
+// maxAge deletes the cookie.
+func (app *application) oidcStateCookie(state string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/v1/auth/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(app.config.oidc.redirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/96malhar/greenlight/internal/oidc"
+	"github.com/96malhar/greenlight/internal/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeOIDCProvider is an in-process OpenID Connect provider. Instead of showing a login
+// page, its authorization endpoint is skipped: authorize issues a code for the claims of
+// a test identity directly, and returns the callback URL the browser would be sent to.
+type fakeOIDCProvider struct {
+	server       *httptest.Server
+	clientID     string
+	clientSecret string
+
+	// signingKey signs the ID tokens, while only the public part of publishedKey is
+	// served from the JWKS endpoint. Setting signingKey to another key makes the
+	// provider issue ID tokens with invalid signatures.
+	signingKey   *rsa.PrivateKey
+	publishedKey *rsa.PrivateKey
+
+	mu             sync.Mutex
+	authorizations map[string]fakeAuthorization
+}
+
+type fakeAuthorization struct {
+	challenge   string
+	redirectURI string
+	claims      map[string]any
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	p := &fakeOIDCProvider{
+		clientID:       "greenlight",
+		clientSecret:   "s3cr3t",
+		signingKey:     key,
+		publishedKey:   key,
+		authorizations: make(map[string]fakeAuthorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/authorize",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test-key",
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(p.publishedKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.publishedKey.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("POST /token", p.tokenHandler)
+
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+// tokenHandler exchanges an authorization code for an ID token, after checking the
+// client credentials and the PKCE code verifier.
+func (p *fakeOIDCProvider) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != p.clientID || clientSecret != p.clientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	p.mu.Lock()
+	auth, found := p.authorizations[r.PostFormValue("code")]
+	delete(p.authorizations, r.PostFormValue("code"))
+	p.mu.Unlock()
+
+	if !found ||
+		r.PostFormValue("grant_type") != "authorization_code" ||
+		r.PostFormValue("redirect_uri") != auth.redirectURI ||
+		oidc.S256Challenge(r.PostFormValue("code_verifier")) != auth.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "unused",
+		"token_type":   "Bearer",
+		"id_token":     p.sign(auth.claims),
+	})
+}
+
+func (p *fakeOIDCProvider) sign(claims map[string]any) string {
+	h, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test-key"})
+	c, _ := json.Marshal(claims)
+
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(input))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, p.signingKey, crypto.SHA256, digest[:])
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// authorize simulates a user logging in at the authorization URL that the API redirected
+// them to. It issues a code for an ID token with the given claims on top of the standard
+// ones, and returns the path of the callback on the API.
+func (p *fakeOIDCProvider) authorize(t *testing.T, authURL string, claims map[string]any) string {
+	u, err := url.Parse(authURL)
+	require.NoError(t, err)
+	qs := u.Query()
+
+	require.Equal(t, p.server.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	require.Equal(t, p.clientID, qs.Get("client_id"))
+	require.Equal(t, "code", qs.Get("response_type"))
+	require.Equal(t, "S256", qs.Get("code_challenge_method"))
+
+	allClaims := map[string]any{
+		"iss":   p.server.URL,
+		"aud":   p.clientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(5 * time.Minute).Unix(),
+		"nonce": qs.Get("nonce"),
+	}
+	for k, v := range claims {
+		allClaims[k] = v
+	}
+
+	code := rand.Text()
+
+	p.mu.Lock()
+	p.authorizations[code] = fakeAuthorization{
+		challenge:   qs.Get("code_challenge"),
+		redirectURI: qs.Get("redirect_uri"),
+		claims:      allClaims,
+	}
+	p.mu.Unlock()
+
+	redirectURI, err := url.Parse(qs.Get("redirect_uri"))
+	require.NoError(t, err)
+
+	return redirectURI.Path + "?" + url.Values{"code": {code}, "state": {qs.Get("state")}}.Encode()
+}
+
+// enableOIDC configures the test server to log users in with a fake provider.
+func (ts *testServer) enableOIDC(t *testing.T, p *fakeOIDCProvider) {
+	ts.app.config.oidc.redirectURL = "http://localhost:4000/v1/auth/oidc/callback"
+	ts.app.config.oidc.autoProvision = true
+
+	provider, err := oidc.Discover(context.Background(), p.server.URL, oidc.Config{
+		ClientID:     p.clientID,
+		ClientSecret: p.clientSecret,
+		RedirectURL:  ts.app.config.oidc.redirectURL,
+	}, p.server.Client())
+	require.NoError(t, err)
+
+	ts.app.oidcProvider = provider
+}
+
+// startOIDCLogin starts a login with the provider and returns the URL of the
+// authorization endpoint and the cookie header binding the login to the client.
+func (ts *testServer) startOIDCLogin(t *testing.T) (string, map[string]string) {
+	res, err := ts.executeRequest(http.MethodGet, "/v1/auth/oidc/login", "", nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusFound, res.StatusCode)
+
+	cookies := res.Cookies()
+	require.Len(t, cookies, 1)
+	assert.True(t, cookies[0].HttpOnly)
+
+	return res.Header.Get("Location"), map[string]string{"Cookie": cookies[0].Name + "=" + cookies[0].Value}
+}
+
+// completeOIDCLogin logs in through the provider with the given claims and returns the
+// authentication token issued by the API.
+func (ts *testServer) completeOIDCLogin(t *testing.T, p *fakeOIDCProvider, claims map[string]any) string {
+	authURL, cookie := ts.startOIDCLogin(t)
+
+	res, err := ts.executeRequest(http.MethodGet, p.authorize(t, authURL, claims), "", cookie)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	var dst authenticationTokenResponse
+	readJsonResponse(t, res.Body, &dst)
+	return dst.AuthenticationToken.Token
+}
+
+func TestOIDCHandlers_Disabled(t *testing.T) {
+	ts := newTestServer(t)
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "Login",
+		requestUrlPath:         "/v1/auth/oidc/login",
+		requestMethodType:      http.MethodGet,
+		wantResponseStatusCode: http.StatusNotFound,
+	}, handlerTestcase{
+		name:                   "Callback",
+		requestUrlPath:         "/v1/auth/oidc/callback?code=abc&state=def",
+		requestMethodType:      http.MethodGet,
+		wantResponseStatusCode: http.StatusNotFound,
+	})
+}
+
+func TestOIDCCallbackHandler_ProvisionsAndLinksUsers(t *testing.T) {
+	ts := newTestServer(t)
+	provider := newFakeOIDCProvider(t)
+	ts.enableOIDC(t, provider)
+
+	ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true,
+	})
+
+	currentUser := func(authToken string) user {
+		res, err := ts.executeRequest(http.MethodGet, "/v1/users/me", "", map[string]string{"Authorization": "Bearer " + authToken})
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		var dst userResponse
+		readJsonResponse(t, res.Body, &dst)
+		return dst.User
+	}
+
+	// An existing user is linked by their verified email address.
+	authToken := ts.completeOIDCLogin(t, provider, map[string]any{
+		"sub": "alice-id", "email": "alice@gmail.com", "email_verified": true, "name": "Alice A.",
+	})
+	alice := currentUser(authToken)
+	assert.Equal(t, int64(1), alice.ID)
+	assert.Equal(t, "Alice", alice.Name)
+
+	// A new user is created with the default role.
+	authToken = ts.completeOIDCLogin(t, provider, map[string]any{
+		"sub": "bob-id", "email": "bob@gmail.com", "email_verified": true, "name": "Bob",
+	})
+	bob := currentUser(authToken)
+	assert.Equal(t, "bob@gmail.com", bob.Email)
+	assert.Equal(t, "Bob", bob.Name)
+	assert.True(t, bob.Activated)
+
+	roles, err := ts.app.modelStore.Roles.GetAllForUser(bob.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"viewer"}, roles)
+
+	// Once linked, a user is found by their identity even if the email address at the
+	// provider changes.
+	authToken = ts.completeOIDCLogin(t, provider, map[string]any{
+		"sub": "alice-id", "email": "alice@company.com", "email_verified": true,
+	})
+	assert.Equal(t, alice.ID, currentUser(authToken).ID)
+}
+
+func TestOIDCCallbackHandler_TwoFactor(t *testing.T) {
+	ts := newTestServer(t)
+	provider := newFakeOIDCProvider(t)
+	ts.enableOIDC(t, provider)
+
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+	})
+	secret, _ := ts.enableTwoFactor(t, authToken, "pa55word1234")
+
+	claims := map[string]any{"sub": "alice-id", "email": "alice@gmail.com", "email_verified": true}
+
+	oidcLogin := func(t *testing.T) *http.Response {
+		authURL, cookie := ts.startOIDCLogin(t)
+		res, err := ts.executeRequest(http.MethodGet, provider.authorize(t, authURL, claims), "", cookie)
+		require.NoError(t, err)
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	t.Run("Code required", func(t *testing.T) {
+		// Logging in with the provider skips the password, but not the second factor.
+		res := oidcLogin(t)
+		require.Equal(t, http.StatusAccepted, res.StatusCode)
+
+		var dst twoFactorTokenResponse
+		readJsonResponse(t, res.Body, &dst)
+
+		code, err := totp.Code(secret, totp.Step(time.Now())+1)
+		require.NoError(t, err)
+
+		body := fmt.Sprintf(`{"token":%q, "code":%q}`, dst.TwoFactorToken.Token, code)
+		res, err = ts.executeRequest(http.MethodPost, "/v1/tokens/2fa", body, nil)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+	})
+
+	t.Run("Provider trusted", func(t *testing.T) {
+		ts.app.config.oidc.trustProviderMFA = true
+		defer func() { ts.app.config.oidc.trustProviderMFA = false }()
+
+		res := oidcLogin(t)
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+	})
+}
+
+func TestOIDCCallbackHandler_InvalidLogins(t *testing.T) {
+	ts := newTestServer(t)
+	provider := newFakeOIDCProvider(t)
+	ts.enableOIDC(t, provider)
+
+	claims := map[string]any{"sub": "carol-id", "email": "carol@gmail.com", "email_verified": true}
+
+	loginFailedResponse := errorResponse{Error: "unable to log in with the identity provider"}
+	invalidStateResponse := validationErrorResponse{Error: map[string]string{"state": "invalid or expired login state"}}
+
+	authURL, cookie := ts.startOIDCLogin(t)
+	callback := provider.authorize(t, authURL, claims)
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Missing parameters",
+			requestUrlPath:         "/v1/auth/oidc/callback",
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"state": "must be provided",
+					"code":  "must be provided",
+				},
+			},
+		},
+		{
+			name:                   "Error from the provider",
+			requestUrlPath:         "/v1/auth/oidc/callback?error=access_denied",
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse:           loginFailedResponse,
+		},
+		{
+			name:                   "Missing state cookie",
+			requestUrlPath:         callback,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse:           invalidStateResponse,
+		},
+		{
+			name:                   "Valid login",
+			requestUrlPath:         callback,
+			requestHeader:          cookie,
+			wantResponseStatusCode: http.StatusCreated,
+		},
+		{
+			name:                   "Login can only be completed once",
+			requestUrlPath:         callback,
+			requestHeader:          cookie,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse:           invalidStateResponse,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodGet
+		testHandler(t, ts, tc)
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	logins := []struct {
+		name     string
+		claims   map[string]any
+		setup    func()
+		wantCode int
+		wantBody any
+	}{
+		{
+			name:     "Wrong nonce",
+			claims:   map[string]any{"sub": "carol-id", "nonce": "replayed"},
+			wantCode: http.StatusUnauthorized,
+			wantBody: loginFailedResponse,
+		},
+		{
+			name:     "Wrong audience",
+			claims:   map[string]any{"sub": "carol-id", "aud": "another-client"},
+			wantCode: http.StatusUnauthorized,
+			wantBody: loginFailedResponse,
+		},
+		{
+			name:     "Expired ID token",
+			claims:   map[string]any{"sub": "carol-id", "exp": time.Now().Add(-time.Hour).Unix()},
+			wantCode: http.StatusUnauthorized,
+			wantBody: loginFailedResponse,
+		},
+		{
+			name:     "Invalid signature",
+			claims:   claims,
+			setup:    func() { provider.signingKey = otherKey },
+			wantCode: http.StatusUnauthorized,
+			wantBody: loginFailedResponse,
+		},
+		{
+			name:     "Unverified email address",
+			claims:   map[string]any{"sub": "dave-id", "email": "dave@gmail.com", "email_verified": false},
+			setup:    func() { provider.signingKey = provider.publishedKey },
+			wantCode: http.StatusForbidden,
+			wantBody: errorResponse{Error: "no user account matches your identity at the identity provider"},
+		},
+		{
+			name:     "Auto-provisioning disabled",
+			claims:   map[string]any{"sub": "erin-id", "email": "erin@gmail.com", "email_verified": true},
+			setup:    func() { ts.app.config.oidc.autoProvision = false },
+			wantCode: http.StatusForbidden,
+			wantBody: errorResponse{Error: "no user account matches your identity at the identity provider"},
+		},
+		{
+			name:     "Linked user with auto-provisioning disabled",
+			claims:   claims,
+			wantCode: http.StatusCreated,
+		},
+	}
+
+	for _, login := range logins {
+		if login.setup != nil {
+			login.setup()
+		}
+
+		authURL, cookie := ts.startOIDCLogin(t)
+
+		testHandler(t, ts, handlerTestcase{
+			name:                   login.name,
+			requestUrlPath:         provider.authorize(t, authURL, login.claims),
+			requestMethodType:      http.MethodGet,
+			requestHeader:          cookie,
+			wantResponseStatusCode: login.wantCode,
+			wantResponse:           login.wantBody,
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+type person struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Bio     string `json:"bio"`
+	Version int    `json:"version"`
+}
+
+type personResponse struct {
+	Person person `json:"person"`
+}
+
+type credit struct {
+	ID           int    `json:"id"`
+	MovieID      int    `json:"movie_id"`
+	PersonID     int    `json:"person_id"`
+	Name         string `json:"name"`
+	Role         string `json:"role"`
+	Character    string `json:"character"`
+	BillingOrder int    `json:"billing_order"`
+}
+
+type showPersonResponse struct {
+	Person  person   `json:"person"`
+	Credits []credit `json:"credits"`
+}
+
+type listPeopleResponse struct {
+	People             []person           `json:"people"`
+	PaginationMetadata paginationMetadata `json:"metadata"`
+}
+
+func TestPeopleHandlers(t *testing.T) {
+	ts := newTestServer(t)
+
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234",
+		activated: true, authenticated: true, permCodes: []string{"movies:read", "movies:write"},
+	})
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Create person",
+			requestUrlPath:         "/v1/people",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"name": "John McTiernan", "bio": "American film director."}`,
+			wantResponseStatusCode: http.StatusCreated,
+			wantResponseHeader: map[string]string{
+				"Location": "/v1/people/1",
+			},
+			wantResponse: personResponse{
+				Person: person{ID: 1, Name: "John McTiernan", Bio: "American film director.", Version: 1},
+			},
+		},
+		{
+			name:                   "Create another person",
+			requestUrlPath:         "/v1/people",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"name": "Bruce Willis"}`,
+			wantResponseStatusCode: http.StatusCreated,
+		},
+		{
+			name:                   "Create person without a name",
+			requestUrlPath:         "/v1/people",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"bio": "Nobody"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"name": "must be provided",
+				},
+			},
+		},
+		{
+			name:                   "Update person",
+			requestUrlPath:         "/v1/people/2",
+			requestMethodType:      http.MethodPatch,
+			requestBody:            `{"bio": "American actor."}`,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: personResponse{
+				Person: person{ID: 2, Name: "Bruce Willis", Bio: "American actor.", Version: 2},
+			},
+		},
+		{
+			name:                   "Show person",
+			requestUrlPath:         "/v1/people/1",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: showPersonResponse{
+				Person:  person{ID: 1, Name: "John McTiernan", Bio: "American film director.", Version: 1},
+				Credits: []credit{},
+			},
+		},
+		{
+			name:                   "List people",
+			requestUrlPath:         "/v1/people?name=bruce",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: listPeopleResponse{
+				People:             []person{{ID: 2, Name: "Bruce Willis", Bio: "American actor.", Version: 2}},
+				PaginationMetadata: newPaginationMetadata(1, 20, 1),
+			},
+		},
+		{
+			name:                   "Delete person",
+			requestUrlPath:         "/v1/people/1",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "person successfully deleted",
+			},
+		},
+		{
+			name:                   "Show deleted person",
+			requestUrlPath:         "/v1/people/1",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestHeader = map[string]string{"Authorization": "Bearer " + authToken}
+		testHandler(t, ts, tc)
+	}
+}
+
+func TestCreditHandlers(t *testing.T) {
+	ts := newTestServer(t)
+	ts.insertMovie(t, "Die Hard", 1988, 207, []string{"Action", "Thriller"})
+	ts.insertMovie(t, "Heat", 1995, 170, []string{"Crime"})
+
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234",
+		activated: true, authenticated: true, permCodes: []string{"movies:read", "movies:write"},
+	})
+	authHeader := map[string]string{"Authorization": "Bearer " + authToken}
+
+	for _, body := range []string{`{"name": "John McTiernan"}`, `{"name": "Bruce Willis"}`, `{"name": "Alan Rickman"}`} {
+		testHandler(t, ts, handlerTestcase{
+			name:                   "Create person",
+			requestUrlPath:         "/v1/people",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          authHeader,
+			requestBody:            body,
+			wantResponseStatusCode: http.StatusCreated,
+		})
+	}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Credit actor",
+			requestUrlPath:         "/v1/movies/1/credits",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"person_id": 3, "role": "actor", "character": "Hans Gruber", "billing_order": 2}`,
+			wantResponseStatusCode: http.StatusCreated,
+			wantResponse: map[string]credit{
+				"credit": {ID: 1, MovieID: 1, PersonID: 3, Name: "Alan Rickman", Role: "actor", Character: "Hans Gruber", BillingOrder: 2},
+			},
+		},
+		{
+			name:                   "Credit lead actor",
+			requestUrlPath:         "/v1/movies/1/credits",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"person_id": 2, "role": "actor", "character": "John McClane", "billing_order": 1}`,
+			wantResponseStatusCode: http.StatusCreated,
+		},
+		{
+			name:                   "Credit director",
+			requestUrlPath:         "/v1/movies/1/credits",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"person_id": 1, "role": "director"}`,
+			wantResponseStatusCode: http.StatusCreated,
+		},
+		{
+			name:                   "Duplicate credit",
+			requestUrlPath:         "/v1/movies/1/credits",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"person_id": 1, "role": "director"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"credit": "this person already has this credit on the movie",
+				},
+			},
+		},
+		{
+			name:                   "Invalid credit",
+			requestUrlPath:         "/v1/movies/1/credits",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"person_id": 1, "role": "producer", "character": "Himself"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"role":      "must be one of director, writer or actor",
+					"character": "must only be provided for actors",
+				},
+			},
+		},
+		{
+			name:                   "Credit person who does not exist",
+			requestUrlPath:         "/v1/movies/1/credits",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"person_id": 9, "role": "writer"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"person_id": "must refer to an existing person",
+				},
+			},
+		},
+		{
+			name:                   "Credit on movie which does not exist",
+			requestUrlPath:         "/v1/movies/9/credits",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"person_id": 1, "role": "writer"}`,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+		{
+			name:                   "Show movie with credits",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: movieResponse{
+				Movie: movie{
+					ID: 1, Title: "Die Hard", Year: 1988, Runtime: "207 mins", Genres: []string{"Action", "Thriller"}, Version: 1,
+					Credits: []credit{
+						{ID: 3, MovieID: 1, PersonID: 1, Name: "John McTiernan", Role: "director"},
+						{ID: 2, MovieID: 1, PersonID: 2, Name: "Bruce Willis", Role: "actor", Character: "John McClane", BillingOrder: 1},
+						{ID: 1, MovieID: 1, PersonID: 3, Name: "Alan Rickman", Role: "actor", Character: "Hans Gruber", BillingOrder: 2},
+					},
+				},
+			},
+		},
+		{
+			name:                   "Filter movies by person",
+			requestUrlPath:         "/v1/movies?person=2",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst listMovieResponse
+				readJsonResponse(t, res.Body, &dst)
+
+				require.Len(t, dst.Movies, 1)
+				assert.Equal(t, "Die Hard", dst.Movies[0].Title)
+			},
+		},
+		{
+			name:                   "Filter movies by invalid person",
+			requestUrlPath:         "/v1/movies?person=-2",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"person": "must not be negative",
+				},
+			},
+		},
+		{
+			name:                   "Show person with credits",
+			requestUrlPath:         "/v1/people/2",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: showPersonResponse{
+				Person: person{ID: 2, Name: "Bruce Willis", Version: 1},
+				Credits: []credit{
+					{ID: 2, MovieID: 1, PersonID: 2, Name: "Bruce Willis", Role: "actor", Character: "John McClane", BillingOrder: 1},
+				},
+			},
+		},
+		{
+			name:                   "Delete credit",
+			requestUrlPath:         "/v1/movies/1/credits/2",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "credit successfully deleted",
+			},
+		},
+		{
+			name:                   "Delete credit of another movie",
+			requestUrlPath:         "/v1/movies/2/credits/1",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestHeader = authHeader
+		testHandler(t, ts, tc)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type review struct {
+	ID        int       `json:"id"`
+	MovieID   int       `json:"movie_id"`
+	UserID    int       `json:"user_id"`
+	Rating    int       `json:"rating"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Version   int       `json:"version"`
+}
+
+type reviewResponse struct {
+	Review review `json:"review"`
+}
+
+type listReviewsResponse struct {
+	Reviews            []review           `json:"reviews"`
+	PaginationMetadata paginationMetadata `json:"metadata"`
+}
+
+func TestReviewHandlers(t *testing.T) {
+	ts := newTestServer(t)
+	ts.insertMovie(t, "Die Hard", 1988, 207, []string{"Action", "Thriller"})
+	ts.insertMovie(t, "Heat", 1995, 170, []string{"Crime"})
+
+	aliceToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234",
+		activated: true, authenticated: true, permCodes: []string{"movies:read"},
+	})
+	aliceHeader := map[string]string{"Authorization": "Bearer " + aliceToken}
+
+	bobToken := ts.insertUser(t, dummyUser{
+		name: "Bob", email: "bob@gmail.com", password: "pa55word1234",
+		activated: true, authenticated: true, permCodes: []string{"movies:read"},
+	})
+	bobHeader := map[string]string{"Authorization": "Bearer " + bobToken}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Create review",
+			requestUrlPath:         "/v1/movies/1/reviews",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          aliceHeader,
+			requestBody:            `{"rating": 9, "body": "Yippee-ki-yay"}`,
+			wantResponseStatusCode: http.StatusCreated,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst reviewResponse
+				readJsonResponse(t, res.Body, &dst)
+
+				assert.Equal(t, 1, dst.Review.MovieID)
+				assert.Equal(t, 1, dst.Review.UserID)
+				assert.Equal(t, 9, dst.Review.Rating)
+				assert.Equal(t, "Yippee-ki-yay", dst.Review.Body)
+				assert.Equal(t, 1, dst.Review.Version)
+			},
+		},
+		{
+			name:                   "Create review without a body",
+			requestUrlPath:         "/v1/movies/1/reviews",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          bobHeader,
+			requestBody:            `{"rating": 6}`,
+			wantResponseStatusCode: http.StatusCreated,
+		},
+		{
+			name:                   "Duplicate review",
+			requestUrlPath:         "/v1/movies/1/reviews",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          aliceHeader,
+			requestBody:            `{"rating": 3}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"review": "you have already reviewed this movie",
+				},
+			},
+		},
+		{
+			name:                   "Invalid rating",
+			requestUrlPath:         "/v1/movies/2/reviews",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          aliceHeader,
+			requestBody:            `{"rating": 11}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"rating": "must be between 1 and 10",
+				},
+			},
+		},
+		{
+			name:                   "Review movie which does not exist",
+			requestUrlPath:         "/v1/movies/5/reviews",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          aliceHeader,
+			requestBody:            `{"rating": 5}`,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+		{
+			name:                   "Update review",
+			requestUrlPath:         "/v1/movies/1/reviews",
+			requestMethodType:      http.MethodPatch,
+			requestHeader:          bobHeader,
+			requestBody:            `{"rating": 8}`,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst reviewResponse
+				readJsonResponse(t, res.Body, &dst)
+
+				assert.Equal(t, 2, dst.Review.UserID)
+				assert.Equal(t, 8, dst.Review.Rating)
+				assert.Equal(t, 2, dst.Review.Version)
+			},
+		},
+		{
+			name:                   "Update review which does not exist",
+			requestUrlPath:         "/v1/movies/2/reviews",
+			requestMethodType:      http.MethodPatch,
+			requestHeader:          bobHeader,
+			requestBody:            `{"rating": 8}`,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+		{
+			name:                   "Show movie with ratings",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          aliceHeader,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: movieResponse{
+				Movie: movie{
+					ID: 1, Title: "Die Hard", Year: 1988, Runtime: "207 mins", Genres: []string{"Action", "Thriller"},
+					AverageRating: 8.5, RatingCount: 2, Version: 1,
+				},
+			},
+		},
+		{
+			name:                   "List reviews",
+			requestUrlPath:         "/v1/movies/1/reviews?sort=-rating",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          aliceHeader,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst listReviewsResponse
+				readJsonResponse(t, res.Body, &dst)
+
+				require.Len(t, dst.Reviews, 2)
+				assert.Equal(t, newPaginationMetadata(1, 20, 2), dst.PaginationMetadata)
+				assert.Equal(t, 9, dst.Reviews[0].Rating)
+				assert.Equal(t, 8, dst.Reviews[1].Rating)
+			},
+		},
+		{
+			name:                   "List movies sorted by rating",
+			requestUrlPath:         "/v1/movies?sort=-average_rating",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          aliceHeader,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst listMovieResponse
+				readJsonResponse(t, res.Body, &dst)
+
+				require.Len(t, dst.Movies, 2)
+				assert.Equal(t, "Die Hard", dst.Movies[0].Title)
+				assert.Equal(t, "Heat", dst.Movies[1].Title)
+				assert.Zero(t, dst.Movies[1].RatingCount)
+			},
+		},
+		{
+			name:                   "Delete review",
+			requestUrlPath:         "/v1/movies/1/reviews",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          aliceHeader,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "review successfully deleted",
+			},
+		},
+		{
+			name:                   "Delete review which does not exist",
+			requestUrlPath:         "/v1/movies/1/reviews",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          aliceHeader,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+		{
+			name:                   "Ratings after deleting a review",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          aliceHeader,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: movieResponse{
+				Movie: movie{
+					ID: 1, Title: "Die Hard", Year: 1988, Runtime: "207 mins", Genres: []string{"Action", "Thriller"},
+					AverageRating: 8, RatingCount: 1, Version: 1,
+				},
+			},
+		},
+		{
+			name:                   "Invalid sort",
+			requestUrlPath:         "/v1/movies/1/reviews?sort=body",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          aliceHeader,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"sort": "invalid sort value",
+				},
+			},
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"github.com/96malhar/greenlight/internal/data"
+	"github.com/96malhar/greenlight/internal/validator"
+	"net/http"
+)
+
+// listMovieRevisionsHandler returns the revisions of a specific movie, most recent first
+// by default. The revisions of deleted movies can still be listed by editors.
+func (app *application) listMovieRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.checkMovieHistoryAccess(r, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-version")
+	input.Filters.SortSafelist = []string{"version", "-version"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	revisions, metadata, err := app.modelStore.Movies.GetRevisions(id, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// A movie without any revisions on the first page has never existed.
+	if len(revisions) == 0 && input.Filters.Page == 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"revisions": revisions, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showMovieRevisionHandler returns a specific revision of a movie.
+func (app *application) showMovieRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	revision, err := app.readMovieRevision(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"revision": revision}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// restoreMovieRevisionHandler reverts a movie to the state it was in at a previous
+// revision. The restore is an ordinary update of the current version of the movie, so it
+// is validated, fails with an edit conflict if the movie changes in the meantime, and is
+// recorded as a new revision rather than rewriting the history.
+func (app *application) restoreMovieRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	revision, err := app.readMovieRevision(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	movie, err := app.modelStore.Movies.Get(revision.MovieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Keep a copy of the movie as it was for the audit log.
+	before := *movie
+
+	movie.Title = revision.Title
+	movie.Year = revision.Year
+	movie.Runtime = revision.Runtime
+	movie.Genres = revision.Genres
+
+	v := validator.New()
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.modelStore.Movies.Update(movie)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.auditChange(r, data.NewAuditEvent(data.AuditMovieRestore, data.AuditTargetMovie, movie.ID), &before, movie)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readMovieRevision fetches the revision named by the 'id' and 'version' parameters of the
+// URL. It returns a ErrRecordNotFound if either parameter is invalid.
+func (app *application) readMovieRevision(r *http.Request) (*data.MovieRevision, error) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		return nil, data.ErrRecordNotFound
+	}
+
+	version, err := app.readVersionParam(r)
+	if err != nil {
+		return nil, data.ErrRecordNotFound
+	}
+
+	err = app.checkMovieHistoryAccess(r, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.modelStore.Movies.GetRevision(id, version)
+}
+
+// checkMovieHistoryAccess returns a ErrRecordNotFound if the revisions of a specific movie
+// are hidden from the client. Like the trash, the revisions of deleted movies are only
+// visible to editors, so that deleted movies can't be read through their history.
+func (app *application) checkMovieHistoryAccess(r *http.Request, id int64) error {
+	permissions, err := app.requestPermissions(r)
+	if err != nil {
+		return err
+	}
+
+	if permissions.Include("movies:write") {
+		return nil
+	}
+
+	_, err = app.modelStore.Movies.Get(id)
+	return err
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type movieRevision struct {
+	MovieID   int       `json:"movie_id"`
+	Version   int       `json:"version"`
+	Operation string    `json:"operation"`
+	CreatedAt time.Time `json:"created_at"`
+	Title     string    `json:"title"`
+	Year      int       `json:"year"`
+	Runtime   string    `json:"runtime"`
+	Genres    []string  `json:"genres"`
+}
+
+type movieRevisionResponse struct {
+	Revision movieRevision `json:"revision"`
+}
+
+type listMovieRevisionsResponse struct {
+	Revisions          []movieRevision    `json:"revisions"`
+	PaginationMetadata paginationMetadata `json:"metadata"`
+}
+
+func TestMovieRevisionHandlers(t *testing.T) {
+	ts := newTestServer(t)
+	ts.insertMovie(t, "Die Hard", 1988, 207, []string{"Action", "Thriller"})
+	ts.insertMovie(t, "Heat", 1995, 170, []string{"Crime"})
+
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234",
+		activated: true, authenticated: true,
+		permCodes: []string{"movies:read", "movies:write"},
+	})
+	authHeader := map[string]string{"Authorization": "Bearer " + authToken}
+
+	// Make some changes which are recorded as revisions.
+	for _, tc := range []handlerTestcase{
+		{
+			name:                   "Update movie",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodPatch,
+			requestBody:            `{"title":"Die Harder", "year":1990}`,
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "Delete movie",
+			requestUrlPath:         "/v1/movies/2",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusOK,
+		},
+	} {
+		tc.requestHeader = authHeader
+		testHandler(t, ts, tc)
+	}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "List revisions",
+			requestUrlPath:         "/v1/movies/1/revisions",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst listMovieRevisionsResponse
+				readJsonResponse(t, res.Body, &dst)
+
+				require.Len(t, dst.Revisions, 2)
+				assert.Equal(t, newPaginationMetadata(1, 20, 2), dst.PaginationMetadata)
+
+				assert.Equal(t, 2, dst.Revisions[0].Version)
+				assert.Equal(t, "update", dst.Revisions[0].Operation)
+				assert.Equal(t, "Die Harder", dst.Revisions[0].Title)
+
+				assert.Equal(t, 1, dst.Revisions[1].Version)
+				assert.Equal(t, "insert", dst.Revisions[1].Operation)
+				assert.Equal(t, "Die Hard", dst.Revisions[1].Title)
+			},
+		},
+		{
+			name:                   "List revisions of a deleted movie",
+			requestUrlPath:         "/v1/movies/2/revisions?sort=version",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst listMovieRevisionsResponse
+				readJsonResponse(t, res.Body, &dst)
+
+				require.Len(t, dst.Revisions, 2)
+				assert.Equal(t, "delete", dst.Revisions[1].Operation)
+				assert.Equal(t, 2, dst.Revisions[1].Version)
+				assert.Equal(t, "Heat", dst.Revisions[1].Title)
+			},
+		},
+		{
+			name:                   "List revisions of a movie which does not exist",
+			requestUrlPath:         "/v1/movies/5/revisions",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+		{
+			name:                   "List revisions with an invalid sort",
+			requestUrlPath:         "/v1/movies/1/revisions?sort=title",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"sort": "invalid sort value",
+				},
+			},
+		},
+		{
+			name:                   "Show revision",
+			requestUrlPath:         "/v1/movies/1/revisions/1",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst movieRevisionResponse
+				readJsonResponse(t, res.Body, &dst)
+
+				assert.WithinDuration(t, time.Now(), dst.Revision.CreatedAt, 5*time.Second)
+				dst.Revision.CreatedAt = time.Time{}
+
+				assert.Equal(t, movieRevision{
+					MovieID: 1, Version: 1, Operation: "insert", Title: "Die Hard", Year: 1988,
+					Runtime: "207 mins", Genres: []string{"Action", "Thriller"},
+				}, dst.Revision)
+			},
+		},
+		{
+			name:                   "Show revision which does not exist",
+			requestUrlPath:         "/v1/movies/1/revisions/3",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+		{
+			name:                   "Show revision with an invalid version",
+			requestUrlPath:         "/v1/movies/1/revisions/abc",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+		{
+			name:                   "Restore revision",
+			requestUrlPath:         "/v1/movies/1/revisions/1/restore",
+			requestMethodType:      http.MethodPost,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: movieResponse{
+				Movie: movie{
+					ID: 1, Title: "Die Hard", Year: 1988, Runtime: "207 mins",
+					Genres: []string{"Action", "Thriller"}, Version: 3,
+				},
+			},
+		},
+		{
+			name:                   "Restore is recorded as a new revision",
+			requestUrlPath:         "/v1/movies/1/revisions/3",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst movieRevisionResponse
+				readJsonResponse(t, res.Body, &dst)
+
+				assert.Equal(t, "update", dst.Revision.Operation)
+				assert.Equal(t, "Die Hard", dst.Revision.Title)
+			},
+		},
+		{
+			name:                   "Restore revision of a deleted movie",
+			requestUrlPath:         "/v1/movies/2/revisions/1/restore",
+			requestMethodType:      http.MethodPost,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestHeader = authHeader
+		testHandler(t, ts, tc)
+	}
+
+	// Clients which can only read movies can't see the revisions of deleted movies, just
+	// like they can't see the trash.
+	readerToken := ts.insertUser(t, dummyUser{
+		name: "Bob", email: "bob@gmail.com", password: "pa55word1234",
+		activated: true, authenticated: true,
+		permCodes: []string{"movies:read"},
+	})
+
+	testcases = []handlerTestcase{
+		{
+			name:                   "Reader lists revisions",
+			requestUrlPath:         "/v1/movies/1/revisions",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "Reader shows revision",
+			requestUrlPath:         "/v1/movies/1/revisions/1",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "Reader lists revisions of a deleted movie",
+			requestUrlPath:         "/v1/movies/2/revisions",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+		{
+			name:                   "Reader shows revision of a deleted movie",
+			requestUrlPath:         "/v1/movies/2/revisions/1",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestHeader = map[string]string{"Authorization": "Bearer " + readerToken}
+		testHandler(t, ts, tc)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"expvar"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"net/http"
 )
 
@@ -10,6 +11,8 @@ import (
 func (app *application) routes() *chi.Mux {
 	r := chi.NewRouter()
 
+	r.Use(middleware.RequestID)
+
 	r.NotFound(app.notFoundResponse)
 	r.MethodNotAllowed(app.methodNotAllowedResponse)
 
@@ -24,17 +27,105 @@ func (app *application) routes() *chi.Mux {
 	r.Route("/v1/movies", func(r chi.Router) {
 		r.With(app.requirePermission("movies:read")).Get("/", app.listMoviesHandler)
 		r.With(app.requirePermission("movies:write")).Post("/", app.createMovieHandler)
+		r.With(app.requirePermission("movies:write")).Get("/trash", app.listDeletedMoviesHandler)
 		r.With(app.requirePermission("movies:read")).Get("/{id}", app.showMovieHandler)
 		r.With(app.requirePermission("movies:write")).Patch("/{id}", app.updateMovieHandler)
 		r.With(app.requirePermission("movies:write")).Delete("/{id}", app.deleteMovieHandler)
+		r.With(app.requirePermission("movies:write")).Post("/{id}/restore", app.restoreMovieHandler)
+		r.With(app.requirePermission("movies:read")).Get("/{id}/reviews", app.listReviewsHandler)
+		r.With(app.requirePermission("movies:read")).Post("/{id}/reviews", app.createReviewHandler)
+		r.With(app.requirePermission("movies:read")).Patch("/{id}/reviews", app.updateReviewHandler)
+		r.With(app.requirePermission("movies:read")).Delete("/{id}/reviews", app.deleteReviewHandler)
+		r.With(app.requirePermission("movies:read")).Get("/{id}/revisions", app.listMovieRevisionsHandler)
+		r.With(app.requirePermission("movies:read")).Get("/{id}/revisions/{version}", app.showMovieRevisionHandler)
+		r.With(app.requirePermission("movies:write")).Post("/{id}/revisions/{version}/restore", app.restoreMovieRevisionHandler)
+		r.With(app.requirePermission("movies:write")).Post("/{id}/credits", app.createCreditHandler)
+		r.With(app.requirePermission("movies:write")).Delete("/{id}/credits/{creditID}", app.deleteCreditHandler)
+	})
+
+	r.Route("/v1/people", func(r chi.Router) {
+		r.With(app.requirePermission("movies:read")).Get("/", app.listPeopleHandler)
+		r.With(app.requirePermission("movies:write")).Post("/", app.createPersonHandler)
+		r.With(app.requirePermission("movies:read")).Get("/{id}", app.showPersonHandler)
+		r.With(app.requirePermission("movies:write")).Patch("/{id}", app.updatePersonHandler)
+		r.With(app.requirePermission("movies:write")).Delete("/{id}", app.deletePersonHandler)
+	})
+
+	r.Route("/v1/lists", func(r chi.Router) {
+		r.Use(app.requirePermission("movies:read"))
+
+		r.Get("/", app.listListsHandler)
+		r.Post("/", app.createListHandler)
+		r.Get("/{id}", app.showListHandler)
+		r.Patch("/{id}", app.updateListHandler)
+		r.Delete("/{id}", app.deleteListHandler)
+		r.Post("/{id}/movies", app.addListMoviesHandler)
+		r.Put("/{id}/movies", app.reorderListMoviesHandler)
+		r.Delete("/{id}/movies/{movieID}", app.removeListMovieHandler)
 	})
 
 	r.Route("/v1/users", func(r chi.Router) {
 		r.Post("/", app.registerUserHandler)
 		r.Put("/activated", app.activateUserHandler)
+		r.Put("/password", app.updateUserPasswordHandler)
+		r.Put("/email", app.confirmEmailChangeHandler)
+		r.Put("/unlocked", app.unlockUserHandler)
+		r.Put("/restored", app.restoreUserHandler)
+
+		r.With(app.requireAuthenticatedUser).Get("/me", app.showCurrentUserHandler)
+		r.With(app.requireSessionAuthentication).Patch("/me", app.updateCurrentUserHandler)
+		r.With(app.requireSessionAuthentication).Delete("/me", app.deleteCurrentUserHandler)
+		r.With(app.requireSessionAuthentication).Get("/me/export", app.exportCurrentUserHandler)
+		r.With(app.requireSessionAuthentication, app.requireActivatedUser).Post("/me/email", app.createEmailChangeHandler)
+		r.With(app.requireSessionAuthentication).Get("/me/sessions", app.listSessionsHandler)
+		r.With(app.requireSessionAuthentication).Delete("/me/sessions/{id}", app.deleteSessionHandler)
+		r.With(app.requireSessionAuthentication).Get("/me/api-keys", app.listAPIKeysHandler)
+		r.With(app.requireSessionAuthentication, app.requireActivatedUser).Post("/me/api-keys", app.createAPIKeyHandler)
+		r.With(app.requireSessionAuthentication).Delete("/me/api-keys/{id}", app.deleteAPIKeyHandler)
+		r.With(app.requireSessionAuthentication, app.requireActivatedUser).Post("/me/2fa", app.enrolTwoFactorHandler)
+		r.With(app.requireSessionAuthentication).Put("/me/2fa", app.confirmTwoFactorHandler)
+		r.With(app.requireSessionAuthentication).Delete("/me/2fa", app.disableTwoFactorHandler)
+		r.With(app.requireSessionAuthentication).Post("/me/2fa/recovery-codes", app.regenerateRecoveryCodesHandler)
+		r.With(app.requirePermission("movies:read")).Get("/me/watchlist", app.listWatchlistHandler)
+		r.With(app.requirePermission("movies:read")).Put("/me/watchlist/{id}", app.addToWatchlistHandler)
+		r.With(app.requirePermission("movies:read")).Delete("/me/watchlist/{id}", app.removeFromWatchlistHandler)
+		r.With(app.requirePermission("movies:read")).Get("/me/watched", app.listWatchedHandler)
+		r.With(app.requirePermission("movies:read")).Put("/me/watched/{id}", app.setWatchedHandler)
+		r.With(app.requirePermission("movies:read")).Delete("/me/watched/{id}", app.removeWatchedHandler)
+	})
+
+	r.Route("/v1/tokens", func(r chi.Router) {
+		r.Post("/authentication", app.createAuthenticationTokenHandler)
+		r.With(app.requireSessionAuthentication).Delete("/authentication", app.deleteAuthenticationTokenHandler)
+		r.With(app.requireSessionAuthentication).Delete("/authentication/all", app.deleteAllAuthenticationTokensHandler)
+		r.Post("/2fa", app.createTwoFactorAuthenticationTokenHandler)
+		r.Post("/refresh", app.refreshAuthenticationTokenHandler)
+		r.Post("/password-reset", app.createPasswordResetTokenHandler)
+		r.Post("/activation", app.createActivationTokenHandler)
+	})
+
+	r.Route("/v1/auth/oidc", func(r chi.Router) {
+		r.Get("/login", app.oidcLoginHandler)
+		r.Get("/callback", app.oidcCallbackHandler)
+	})
+
+	r.Route("/v1/admin", func(r chi.Router) {
+		r.Use(app.requirePermission("users:admin"))
+
+		r.Get("/users", app.listUsersHandler)
+		r.Get("/users/{id}", app.showUserHandler)
+		r.Put("/users/{id}/activated", app.updateUserActivationHandler)
+		r.Post("/users/{id}/permissions", app.grantUserPermissionsHandler)
+		r.Delete("/users/{id}/permissions/{code}", app.revokeUserPermissionHandler)
+		r.Delete("/users/{id}/tokens", app.expireUserTokensHandler)
+		r.Delete("/users/{id}/lockout", app.unlockUserAccountHandler)
+		r.Delete("/users/{id}/2fa", app.disableUserTwoFactorHandler)
+		r.Get("/invitations", app.listInvitationsHandler)
+		r.Post("/invitations", app.createInvitationHandler)
+		r.Delete("/invitations/{id}", app.deleteInvitationHandler)
+		r.Get("/audit", app.listAuditEventsHandler)
 	})
 
-	r.Post("/v1/tokens/authentication", app.createAuthenticationTokenHandler)
 	r.Method(http.MethodGet, "/debug/vars", expvar.Handler())
 
 	return r
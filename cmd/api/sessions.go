@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"github.com/96malhar/greenlight/internal/data"
+	"github.com/96malhar/greenlight/internal/jwt"
+	"github.com/tomasen/realip"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// sessionInfo returns the details of the client making the request, which are stored
+// alongside the authentication tokens issued to it.
+func (app *application) sessionInfo(r *http.Request) data.SessionInfo {
+	return data.SessionInfo{
+		ClientIP:  realip.FromRequest(r),
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// newSessionTokens generates an authentication token and a refresh token for a user as
+// part of the given token family.
+func (app *application) newSessionTokens(r *http.Request, user *data.User, family string) (*data.Token, *data.Token, error) {
+	authToken, err := app.newAuthenticationToken(r, user, family)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refreshToken, err := app.modelStore.Tokens.NewSession(user.ID, app.config.auth.refreshTokenTTL, data.ScopeRefresh, family, app.sessionInfo(r))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return authToken, refreshToken, nil
+}
+
+// newAuthenticationToken generates an authentication token for a user as part of the
+// given token family. In jwt mode the token is a signed JWT carrying the activation state
+// and the permissions of the user, which is not stored in the database. Changes to either
+// of them therefore only take effect once the user gets a new token.
+func (app *application) newAuthenticationToken(r *http.Request, user *data.User, family string) (*data.Token, error) {
+	if app.config.auth.mode != authModeJWT {
+		return app.modelStore.Tokens.NewSession(user.ID, app.config.auth.accessTokenTTL, data.ScopeAuthentication, family, app.sessionInfo(r))
+	}
+
+	permissions, err := app.modelStore.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.NewClaims(app.config.auth.jwt.issuer, strconv.FormatInt(user.ID, 10), app.config.auth.accessTokenTTL)
+	claims.SessionID = family
+	claims.Activated = user.Activated
+	claims.Permissions = permissions
+
+	plaintext, err := app.jwtKeys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &data.Token{
+		Plaintext: plaintext,
+		UserID:    user.ID,
+		Expiry:    time.Unix(claims.Expiry, 0).UTC(),
+		Scope:     data.ScopeAuthentication,
+		Family:    family,
+	}
+
+	return token, nil
+}
+
+// verifyJWT verifies a JWT issued by newAuthenticationToken and returns the user that it
+// was issued to, as far as it is described by the claims of the token.
+func (app *application) verifyJWT(tokenPlaintext string) (*data.User, *jwt.Claims, error) {
+	claims, err := app.jwtKeys.Verify(tokenPlaintext, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if claims.Issuer != app.config.auth.jwt.issuer {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || id < 1 {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+
+	return &data.User{ID: id, Activated: claims.Activated}, claims, nil
+}
+
+// currentSessionFamily returns the token family of the session that the request was
+// authenticated with, or "" if the token doesn't belong to a session.
+func (app *application) currentSessionFamily(r *http.Request) (string, error) {
+	if family, ok := app.contextGetSessionFamily(r); ok {
+		return family, nil
+	}
+
+	family, err := app.modelStore.Tokens.GetFamilyByHash(app.contextGetTokenHash(r))
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		return "", err
+	}
+
+	return family, nil
+}
+
+// revokeAllSessions deletes all the authentication and refresh tokens of a user.
+func (app *application) revokeAllSessions(userID int64) error {
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		err := app.modelStore.Tokens.DeleteAllForUser(scope, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revokeAllCredentials revokes all the sessions of a user together with their API keys
+// and any two-factor tokens, so that none of their credentials can be used any more.
+func (app *application) revokeAllCredentials(userID int64) error {
+	err := app.revokeAllSessions(userID)
+	if err != nil {
+		return err
+	}
+
+	err = app.modelStore.Tokens.DeleteAllForUser(data.ScopeTwoFactor, userID)
+	if err != nil {
+		return err
+	}
+
+	return app.modelStore.APIKeys.DeleteAllForUser(userID)
+}
+
+// listSessionsHandler returns the active sessions of the authenticated user.
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.modelStore.Tokens.GetAllSessionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Flag the session that the request was made with.
+	currentFamily, err := app.currentSessionFamily(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, session := range sessions {
+		session.Current = currentFamily != "" && session.Family == currentFamily
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteSessionHandler revokes a specific session of the authenticated user.
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.modelStore.Tokens.DeleteSessionForUser(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	ClientIP   string     `json:"client_ip"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
+}
+
+type listSessionsResponse struct {
+	Sessions []session `json:"sessions"`
+}
+
+func (ts *testServer) listSessions(t *testing.T, authToken string) []session {
+	res, err := ts.executeRequest(http.MethodGet, "/v1/users/me/sessions", "", map[string]string{"Authorization": "Bearer " + authToken})
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	dst := &listSessionsResponse{}
+	readJsonResponse(t, res.Body, dst)
+	return dst.Sessions
+}
+
+func TestListSessionsHandler(t *testing.T) {
+	ts := newTestServer(t)
+	ts.insertUser(t, dummyUser{name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true})
+
+	laptopToken, _ := ts.login(t, "alice@gmail.com", "pa55word1234", map[string]string{
+		"User-Agent": "Laptop", "X-Forwarded-For": "8.8.8.8",
+	})
+	phoneToken, _ := ts.login(t, "alice@gmail.com", "pa55word1234", map[string]string{
+		"User-Agent": "Phone", "X-Forwarded-For": "1.1.1.1",
+	})
+
+	sessions := ts.listSessions(t, laptopToken)
+	require.Len(t, sessions, 2)
+
+	// Sessions are listed with the most recently created first.
+	assert.Equal(t, "Phone", sessions[0].UserAgent)
+	assert.Equal(t, "1.1.1.1", sessions[0].ClientIP)
+	assert.False(t, sessions[0].Current)
+	assert.Nil(t, sessions[0].LastUsedAt)
+
+	assert.Equal(t, "Laptop", sessions[1].UserAgent)
+	assert.Equal(t, "8.8.8.8", sessions[1].ClientIP)
+	assert.True(t, sessions[1].Current)
+	assert.WithinDuration(t, time.Now().UTC(), sessions[1].CreatedAt, 2*time.Second)
+	assert.WithinDuration(t, time.Now().UTC().Add(30*24*time.Hour), sessions[1].Expiry, 2*time.Second)
+
+	// wait for the last used time to be recorded in the background
+	time.Sleep(200 * time.Millisecond)
+
+	sessions = ts.listSessions(t, phoneToken)
+	require.Len(t, sessions, 2)
+	assert.True(t, sessions[0].Current)
+	require.NotNil(t, sessions[1].LastUsedAt)
+	assert.WithinDuration(t, time.Now().UTC(), *sessions[1].LastUsedAt, 2*time.Second)
+}
+
+func TestDeleteSessionHandler(t *testing.T) {
+	ts := newTestServer(t)
+	ts.insertUser(t, dummyUser{name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true})
+	ts.insertUser(t, dummyUser{name: "Bob", email: "bob@gmail.com", password: "pa55word1234", activated: true})
+
+	laptopToken, _ := ts.login(t, "alice@gmail.com", "pa55word1234", map[string]string{"User-Agent": "Laptop"})
+	phoneToken, phoneRefreshToken := ts.login(t, "alice@gmail.com", "pa55word1234", map[string]string{"User-Agent": "Phone"})
+	bobToken, _ := ts.login(t, "bob@gmail.com", "pa55word1234", nil)
+
+	phoneSession := ts.listSessions(t, laptopToken)[0]
+	require.Equal(t, "Phone", phoneSession.UserAgent)
+	bobSession := ts.listSessions(t, bobToken)[0]
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Session of another user",
+			requestUrlPath:         fmt.Sprintf("/v1/users/me/sessions/%d", bobSession.ID),
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          map[string]string{"Authorization": "Bearer " + laptopToken},
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+		{
+			name:                   "Invalid ID",
+			requestUrlPath:         "/v1/users/me/sessions/abc",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          map[string]string{"Authorization": "Bearer " + laptopToken},
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+		{
+			name:                   "Revoke session",
+			requestUrlPath:         fmt.Sprintf("/v1/users/me/sessions/%d", phoneSession.ID),
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          map[string]string{"Authorization": "Bearer " + laptopToken},
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "session successfully revoked",
+			},
+		},
+		{
+			name:                   "Revoked session is rejected",
+			requestUrlPath:         "/v1/users/me/sessions",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          map[string]string{"Authorization": "Bearer " + phoneToken},
+			wantResponseStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:                   "Refresh token of revoked session is rejected",
+			requestUrlPath:         "/v1/tokens/refresh",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"token":"` + phoneRefreshToken + `"}`,
+			wantResponseStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:                   "Unauthenticated request",
+			requestUrlPath:         "/v1/users/me/sessions",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse: errorResponse{
+				Error: "you must be authenticated to access this resource",
+			},
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+	assert.Len(t, ts.listSessions(t, laptopToken), 1)
+}
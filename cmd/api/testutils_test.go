@@ -45,14 +45,17 @@ type dummyUser struct {
 	authenticated bool
 	authTTL       time.Duration
 	permCodes     []string
+	roles         []string
 }
 
 func newTestServer(t *testing.T) *testServer {
 	testDb := newTestDB(t)
 	app := &application{
-		logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
-		config:     config{env: "development"},
-		modelStore: data.NewModelStore(testDb),
+		logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		config:         newTestConfig(),
+		modelStore:     data.NewModelStore(testDb),
+		passwordHasher: data.DefaultArgon2idHasher,
+		passwordPolicy: data.DefaultPasswordPolicy,
 	}
 
 	return &testServer{
@@ -120,9 +123,27 @@ func (ts *testServer) insertUser(t *testing.T, usr dummyUser) string {
 	err = ts.app.modelStore.Permissions.AddForUser(id, usr.permCodes...)
 	require.NoError(t, err, "Failed to add permissions for user")
 
+	err = ts.app.modelStore.Roles.AddForUser(id, usr.roles...)
+	require.NoError(t, err, "Failed to add roles for user")
+
 	return authToken.Plaintext
 }
 
+// login creates a session for a user through the API and returns the plaintext
+// authentication and refresh tokens.
+func (ts *testServer) login(t *testing.T, email, password string, requestHeader map[string]string) (string, string) {
+	body := fmt.Sprintf(`{"email":%q, "password":%q}`, email, password)
+	res, err := ts.executeRequest(http.MethodPost, "/v1/tokens/authentication", body, requestHeader)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusCreated, res.StatusCode, "Failed to create authentication token")
+
+	var dst authenticationTokenResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&dst))
+
+	return dst.AuthenticationToken.Token, dst.RefreshToken.Token
+}
+
 func newTestDB(t *testing.T) *pgxpool.Pool {
 	randomSuffix := strings.Split(uuid.New().String(), "-")[0]
 	testDbName := fmt.Sprintf("greenlight_test_%s", randomSuffix)
@@ -162,11 +183,27 @@ func getDbConn(t *testing.T, dsn string) *pgxpool.Pool {
 func newTestApplication(db *pgxpool.Pool) *application {
 	return &application{
 		logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
-		config:     config{env: "development", publishMetrics: false},
+		config:     newTestConfig(),
 		modelStore: data.NewModelStore(db),
 	}
 }
 
+// newTestConfig returns the configuration used by test applications, which mirrors the
+// defaults of the command-line flags where the tests depend on them.
+func newTestConfig() config {
+	cfg := config{env: "development", publishMetrics: false}
+	cfg.auth.mode = authModeToken
+	cfg.auth.accessTokenTTL = 15 * time.Minute
+	cfg.auth.refreshTokenTTL = 30 * 24 * time.Hour
+	cfg.auth.lockout.threshold = 10
+	cfg.auth.lockout.duration = 15 * time.Minute
+	cfg.registration.mode = registrationModeOpen
+	cfg.registration.defaultRole = "viewer"
+	cfg.accountDeletion.gracePeriod = 30 * 24 * time.Hour
+	cfg.movieTrash.retention = 30 * 24 * time.Hour
+	return cfg
+}
+
 func runMigrations(t *testing.T, pool *pgxpool.Pool, dbName string) {
 	t.Log("applying database migrations...")
 	db := stdlib.OpenDBFromPool(pool)
@@ -187,13 +224,21 @@ func runMigrations(t *testing.T, pool *pgxpool.Pool, dbName string) {
 // Mocks the mailer interface
 type mockMailer struct {
 	SendInvoked    bool
+	Recipient      string
+	TemplateFile   string
 	TokenPlainText string
 }
 
 func (m *mockMailer) Send(recipient, templateFile string, data any) error {
 	m.SendInvoked = true
+	m.Recipient = recipient
+	m.TemplateFile = templateFile
 	d := data.(map[string]any)
-	m.TokenPlainText = d["activationToken"].(string)
+	for _, key := range []string{"activationToken", "passwordResetToken", "emailChangeToken", "unlockToken", "invitationToken", "restoreToken"} {
+		if token, ok := d[key].(string); ok {
+			m.TokenPlainText = token
+		}
+	}
 	return nil
 }
 
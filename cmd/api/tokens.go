@@ -2,12 +2,22 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/96malhar/greenlight/internal/data"
 	"github.com/96malhar/greenlight/internal/validator"
+	"github.com/tomasen/realip"
 	"net/http"
 	"time"
 )
 
+// activationEmailInterval is the minimum time between two activation emails for the same
+// account.
+const activationEmailInterval = 5 * time.Minute
+
+// passwordResetEmailInterval is the minimum time between two password reset emails for the
+// same account.
+const passwordResetEmailInterval = 5 * time.Minute
+
 // createAuthenticationTokenHandler creates a new authentication token for a user.
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse the email and password from the request body.
@@ -26,21 +36,39 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	v := validator.New()
 
 	data.ValidateEmail(v, input.Email)
-	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidatePasswordPlaintext(v, input.Password, app.passwordHasher)
 
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	// Claim the attempt before checking the password, and refuse it without checking
+	// the password if there have been too many failed attempts for the email address
+	// recently. Claiming first means that concurrent guesses are counted before any of
+	// them is checked. This happens in the same way whether or not a user has the email
+	// address, so as not to reveal which is the case.
+	attempt, retryAfter, err := app.claimLoginAttempt(input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if retryAfter > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
 	// Lookup the user record based on the email address. If no matching user was
 	// found, then we call the app.invalidCredentialsResponse() helper to send a 401
-	// Unauthorized response to the client (we will create this helper in a moment).
+	// Unauthorized response to the client, after spending as much time as checking a
+	// password would take.
 	user, err := app.modelStore.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.invalidCredentialsResponse(w, r)
+			data.SimulatePasswordCheck(input.Password, app.passwordHasher)
+			app.failedLoginResponse(w, r, attempt, nil)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -57,21 +85,364 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	// If the passwords don't match, then we call the app.invalidCredentialsResponse()
 	// helper again and return.
 	if !match {
-		app.invalidCredentialsResponse(w, r)
+		app.failedLoginResponse(w, r, attempt, user)
+		return
+	}
+
+	// A disabled account can't log in. This is only revealed to clients who know the
+	// password, so that it doesn't tell anyone else that the account exists.
+	if user.IsDisabled() {
+		err = app.releaseLoginAttempt(input.Email)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.disabledAccountResponse(w, r)
+		return
+	}
+
+	// Now that we have the plaintext password, upgrade the hash of the user if it was
+	// generated with an outdated algorithm or parameters.
+	app.rehashPassword(user, input.Password)
+
+	// If the user has two-factor authentication enabled, the password alone isn't enough.
+	// Instead of a session, the client gets a short-lived token which it has to exchange
+	// together with a valid code using createTwoFactorAuthenticationTokenHandler.
+	tf, err := app.modelStore.TwoFactor.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if tf != nil && tf.Confirmed {
+		// The password was correct, so it doesn't count as a failed attempt. The
+		// attempt to complete the login with a code is claimed separately.
+		err = app.releaseLoginAttempt(input.Email)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.twoFactorPendingResponse(w, r, user)
 		return
 	}
 
-	// Otherwise, if the password is correct, we generate a new token with a 24-hour
-	// expiry time and the scope 'authentication'.
-	token, err := app.modelStore.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// Forget any earlier failed attempts now that the user has logged in.
+	err = app.modelStore.LoginAttempts.Delete(input.Email)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Encode the token to JSON and send it in the response along with a 201 Created
+	// Otherwise, if the password is correct, we start a new session for the user by
+	// generating a short-lived authentication token and a long-lived refresh token.
+	authToken, refreshToken, err := app.newSessionTokens(r, user, data.NewTokenFamily())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.auditLogin(r, user)
+
+	// Encode the tokens to JSON and send them in the response along with a 201 Created
 	// status code.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	env := envelope{"authentication_token": authToken, "refresh_token": refreshToken}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// rehashPassword replaces the password hash of a user if it doesn't use the current hashing
+// algorithm and parameters. Failing to do so doesn't stop the user from logging in, so
+// errors are only logged, and the hash is left for the next login.
+func (app *application) rehashPassword(user *data.User, plaintextPassword string) {
+	if !user.Password.NeedsRehash(app.passwordHasher) {
+		return
+	}
+
+	err := user.Password.Set(plaintextPassword, app.passwordHasher)
+	if err == nil {
+		err = app.modelStore.Users.Update(user)
+	}
+	if err != nil {
+		app.logger.Warn("failed to rehash password", "user_id", user.ID, "error", err.Error())
+		return
+	}
+
+	app.logger.Info("password rehashed", "user_id", user.ID)
+}
+
+// failedLoginResponse records that a claimed login attempt failed and sends a 401
+// Unauthorized response. The user is nil if no user has the email address.
+func (app *application) failedLoginResponse(w http.ResponseWriter, r *http.Request, attempt *data.LoginAttempt, user *data.User) {
+	err := app.recordFailedLogin(attempt, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user != nil {
+		app.audit(r, data.NewAuditEvent(data.AuditUserLoginFailed, data.AuditTargetUser, user.ID))
+	}
+
+	app.invalidCredentialsResponse(w, r)
+}
+
+// refreshAuthenticationTokenHandler exchanges a refresh token for a new authentication
+// token and a new refresh token. Presenting a refresh token which has already been
+// exchanged revokes the whole session, since the token has probably been stolen.
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	refreshToken, err := app.modelStore.Tokens.Rotate(input.TokenPlaintext, app.config.auth.refreshTokenTTL, app.sessionInfo(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			app.logger.Warn("refresh token reused, session revoked", "ip", realip.FromRequest(r))
+			app.invalidRefreshTokenResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Read the user record afresh, so that the new authentication token reflects the
+	// current state of the account.
+	user, err := app.modelStore.Users.Get(refreshToken.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.IsDisabled() {
+		app.disabledAccountResponse(w, r)
+		return
+	}
+
+	authToken, err := app.newAuthenticationToken(r, user, refreshToken.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authentication_token": authToken, "refresh_token": refreshToken}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createPasswordResetTokenHandler generates a password reset token and emails it to the user.
+// The response is the same whether or not an activated account has the email address, so
+// that it can't be used to find out which addresses have accounts. A new token is only
+// emailed once every passwordResetEmailInterval for each account.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+
+	// Only activated users are sent an email. Any other address gets the same response.
+	user, err := app.modelStore.Users.GetByEmail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user != nil && user.Activated {
+		// Replace the earlier password reset tokens, so that only the token in the latest
+		// email can be used. No email is sent if the last token was issued too recently,
+		// so that the endpoint can't be used to flood a mailbox.
+		token, retryAfter, err := app.modelStore.Tokens.Reissue(user.ID, 45*time.Minute, data.ScopePasswordReset, passwordResetEmailInterval)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if retryAfter == 0 {
+			app.background(func() {
+				tokenData := map[string]any{
+					"passwordResetToken": token.Plaintext,
+				}
+				err := app.mailer.Send(user.Email, "token_password_reset.tmpl", tokenData)
+				if err != nil {
+					msg := fmt.Sprintf("Failed to send password reset email for user (%s). Err = %s", user.Email, err.Error())
+					app.logger.Error(msg)
+				}
+			})
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createActivationTokenHandler generates a new activation token for a user who hasn't
+// activated their account yet, and emails it to them. This lets the user activate their
+// account if the welcome email never arrived or its token has expired. A new token can
+// only be requested once every activationEmailInterval for each account.
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.modelStore.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Activated {
+		v.AddError("email", "user has already been activated")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// An account which was disabled by an administrator can only be activated again by
+	// an administrator.
+	if user.IsDisabled() {
+		app.disabledAccountResponse(w, r)
+		return
+	}
+
+	// Replace the earlier activation tokens, so that only the token in the latest email
+	// can be used. Refuse to send another email if the last activation token was issued
+	// too recently, so that the endpoint can't be used to flood a mailbox.
+	token, retryAfter, err := app.modelStore.Tokens.Reissue(user.ID, 3*24*time.Hour, data.ScopeActivation, activationEmailInterval)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if retryAfter > 0 {
+		app.activationEmailThrottledResponse(w, r, retryAfter)
+		return
+	}
+
+	app.background(func() {
+		tokenData := map[string]any{
+			"activationToken": token.Plaintext,
+		}
+		err = app.mailer.Send(user.Email, "token_activation.tmpl", tokenData)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to send activation email for user (%s). Err = %s", user.Email, err.Error())
+			app.logger.Error(msg)
+		}
+	})
+
+	env := envelope{"message": "an email will be sent to you containing activation instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAuthenticationTokenHandler revokes the authentication token used to make the
+// request, together with the refresh token of the same session. In jwt mode only the
+// refresh token can be revoked, and the JWT remains valid until it expires.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if family, ok := app.contextGetSessionFamily(r); ok {
+		err = app.modelStore.Tokens.DeleteFamilyForUser(family, app.contextGetUser(r).ID)
+	} else {
+		err = app.modelStore.Tokens.DeleteByHash(app.contextGetTokenHash(r))
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user := app.contextGetUser(r)
+	app.audit(r, data.NewAuditEvent(data.AuditUserLogout, data.AuditTargetUser, user.ID))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAllAuthenticationTokensHandler revokes every authentication and refresh token of
+// the authenticated user, logging them out of all sessions.
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.revokeAllSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.NewAuditEvent(data.AuditUserLogoutAll, data.AuditTargetUser, user.ID))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out of all sessions"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -1,18 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/96malhar/greenlight/internal/data"
+	"github.com/96malhar/greenlight/internal/jwt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+type token struct {
+	Token  string `json:"token"`
+	Expiry string `json:"expiry"`
+}
+
 type authenticationTokenResponse struct {
-	AuthenticationToken struct {
-		Token  string `json:"token"`
-		Expiry string `json:"expiry"`
-	} `json:"authentication_token"`
+	AuthenticationToken token `json:"authentication_token"`
+	RefreshToken        token `json:"refresh_token"`
 }
 
 func TestCreateAuthenticationTokenHandler_ValidCredentials(t *testing.T) {
@@ -32,10 +43,40 @@ func TestCreateAuthenticationTokenHandler_ValidCredentials(t *testing.T) {
 	dst := &authenticationTokenResponse{}
 	readJsonResponse(t, res.Body, dst)
 	assert.True(t, dst.AuthenticationToken.Token != "")
+	assert.True(t, dst.RefreshToken.Token != "")
 
 	expiry, err := time.Parse(time.RFC3339, dst.AuthenticationToken.Expiry)
 	require.NoError(t, err)
-	assert.WithinDuration(t, time.Now().UTC().Add(24*time.Hour), expiry, 1*time.Second)
+	assert.WithinDuration(t, time.Now().UTC().Add(15*time.Minute), expiry, 1*time.Second)
+
+	expiry, err = time.Parse(time.RFC3339, dst.RefreshToken.Expiry)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().UTC().Add(30*24*time.Hour), expiry, 1*time.Second)
+}
+
+func TestCreateAuthenticationTokenHandler_RehashesPassword(t *testing.T) {
+	ts := newTestServer(t)
+
+	// insertUser hashes the password with bcrypt, which is no longer the default.
+	ts.insertUser(t, dummyUser{name: "Bob", email: "bob@gmail.com", password: "5ecret1234", activated: true})
+
+	passwordHash := func() string {
+		var hash []byte
+		err := ts.db.QueryRow(context.Background(), "SELECT password_hash FROM users WHERE email = $1", "bob@gmail.com").Scan(&hash)
+		require.NoError(t, err)
+		return string(hash)
+	}
+
+	assert.True(t, strings.HasPrefix(passwordHash(), "$2a$12$"))
+
+	ts.login(t, "bob@gmail.com", "5ecret1234", nil)
+
+	rehashed := passwordHash()
+	assert.True(t, strings.HasPrefix(rehashed, "$argon2id$v=19$m=65536,t=3,p=4$"), rehashed)
+
+	// The new hash works, and isn't replaced again since it is up to date.
+	ts.login(t, "bob@gmail.com", "5ecret1234", nil)
+	assert.Equal(t, rehashed, passwordHash())
 }
 
 func TestCreateAuthenticationTokenHandler_InvalidCredentials(t *testing.T) {
@@ -104,3 +145,627 @@ func TestCreateAuthenticationTokenHandler_InvalidCredentials(t *testing.T) {
 
 	testHandler(t, ts, testcases...)
 }
+
+func TestCreatePasswordResetTokenHandler_ValidRequest(t *testing.T) {
+	ts := newTestServer(t)
+	mailer := &mockMailer{}
+	ts.app.mailer = mailer
+
+	ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true,
+	})
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "Activated user",
+		requestUrlPath:         "/v1/tokens/password-reset",
+		requestMethodType:      http.MethodPost,
+		requestBody:            `{"email":"alice@gmail.com"}`,
+		wantResponseStatusCode: http.StatusAccepted,
+		wantResponse: map[string]string{
+			"message": "an email will be sent to you containing password reset instructions",
+		},
+	})
+
+	// wait for the user to get the password reset email
+	time.Sleep(200 * time.Millisecond)
+	assert.True(t, mailer.SendInvoked)
+	assert.Equal(t, "alice@gmail.com", mailer.Recipient)
+	assert.Equal(t, "token_password_reset.tmpl", mailer.TemplateFile)
+	assert.Len(t, mailer.TokenPlainText, 26)
+
+	// Another request right away gets the same response, but no email is sent and the
+	// token in the first email stays the only one.
+	mailer = &mockMailer{}
+	ts.app.mailer = mailer
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "Password reset email sent recently",
+		requestUrlPath:         "/v1/tokens/password-reset",
+		requestMethodType:      http.MethodPost,
+		requestBody:            `{"email":"alice@gmail.com"}`,
+		wantResponseStatusCode: http.StatusAccepted,
+		wantResponse: map[string]string{
+			"message": "an email will be sent to you containing password reset instructions",
+		},
+	})
+
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, mailer.SendInvoked)
+
+	var tokens int
+	err := ts.db.QueryRow(context.Background(), "SELECT count(*) FROM tokens WHERE scope = $1", data.ScopePasswordReset).Scan(&tokens)
+	require.NoError(t, err)
+	assert.Equal(t, 1, tokens)
+
+	// Once the interval is over, a new token replaces the old one.
+	_, err = ts.db.Exec(context.Background(), `UPDATE tokens SET created_at = NOW() - INTERVAL '1 hour'`)
+	require.NoError(t, err)
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "Password reset email sent a while ago",
+		requestUrlPath:         "/v1/tokens/password-reset",
+		requestMethodType:      http.MethodPost,
+		requestBody:            `{"email":"alice@gmail.com"}`,
+		wantResponseStatusCode: http.StatusAccepted,
+	})
+
+	time.Sleep(200 * time.Millisecond)
+	assert.True(t, mailer.SendInvoked)
+
+	err = ts.db.QueryRow(context.Background(), "SELECT count(*) FROM tokens WHERE scope = $1", data.ScopePasswordReset).Scan(&tokens)
+	require.NoError(t, err)
+	assert.Equal(t, 1, tokens)
+}
+
+func TestCreatePasswordResetTokenHandler_InvalidRequest(t *testing.T) {
+	ts := newTestServer(t)
+	mailer := &mockMailer{}
+	ts.app.mailer = mailer
+
+	ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: false,
+	})
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Bad request body",
+			requestBody:            `{"emailAddress":"alice@gmail.com"}`,
+			wantResponseStatusCode: http.StatusBadRequest,
+			wantResponse: errorResponse{
+				Error: "body contains unknown key \"emailAddress\"",
+			},
+		},
+		{
+			name:                   "Invalid email",
+			requestBody:            `{"email":"alice"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"email": "must be a valid email address",
+				},
+			},
+		},
+		{
+			// The response doesn't reveal whether an account has the email address.
+			name:                   "User does not exist",
+			requestBody:            `{"email":"bob@gmail.com"}`,
+			wantResponseStatusCode: http.StatusAccepted,
+			wantResponse: map[string]string{
+				"message": "an email will be sent to you containing password reset instructions",
+			},
+		},
+		{
+			name:                   "User not activated",
+			requestBody:            `{"email":"alice@gmail.com"}`,
+			wantResponseStatusCode: http.StatusAccepted,
+			wantResponse: map[string]string{
+				"message": "an email will be sent to you containing password reset instructions",
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodPost
+		tc.requestUrlPath = "/v1/tokens/password-reset"
+		testHandler(t, ts, tc)
+	}
+
+	// No email is sent, and no token is issued, unless an activated account has the address.
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, mailer.SendInvoked)
+
+	var tokens int
+	err := ts.db.QueryRow(context.Background(), "SELECT count(*) FROM tokens WHERE scope = $1", data.ScopePasswordReset).Scan(&tokens)
+	require.NoError(t, err)
+	assert.Equal(t, 0, tokens)
+}
+
+func TestCreateActivationTokenHandler(t *testing.T) {
+	ts := newTestServer(t)
+	mailer := &mockMailer{}
+	ts.app.mailer = mailer
+
+	ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: false,
+	})
+	ts.insertUser(t, dummyUser{
+		name: "Bob", email: "bob@gmail.com", password: "pa55word1234", activated: true,
+	})
+
+	// Alice received a welcome email long enough ago for a new one to be sent.
+	oldToken, err := ts.app.modelStore.Tokens.New(1, 3*24*time.Hour, data.ScopeActivation)
+	require.NoError(t, err)
+	_, err = ts.db.Exec(context.Background(), `UPDATE tokens SET created_at = NOW() - INTERVAL '1 hour'`)
+	require.NoError(t, err)
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Invalid email",
+			requestBody:            `{"email":"alice"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"email": "must be a valid email address",
+				},
+			},
+		},
+		{
+			name:                   "User does not exist",
+			requestBody:            `{"email":"carol@gmail.com"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"email": "no matching email address found",
+				},
+			},
+		},
+		{
+			name:                   "User already activated",
+			requestBody:            `{"email":"bob@gmail.com"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"email": "user has already been activated",
+				},
+			},
+		},
+		{
+			name:                   "User not activated",
+			requestBody:            `{"email":"alice@gmail.com"}`,
+			wantResponseStatusCode: http.StatusAccepted,
+			wantResponse: map[string]string{
+				"message": "an email will be sent to you containing activation instructions",
+			},
+		},
+		{
+			name:                   "Activation email sent recently",
+			requestBody:            `{"email":"alice@gmail.com"}`,
+			wantResponseStatusCode: http.StatusTooManyRequests,
+			wantResponse: errorResponse{
+				Error: "an activation email was sent recently, please try again later",
+			},
+			additionalChecks: wantRetryAfter(299, 301),
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodPost
+		tc.requestUrlPath = "/v1/tokens/activation"
+		testHandler(t, ts, tc)
+	}
+
+	// wait for the user to get the activation email
+	time.Sleep(200 * time.Millisecond)
+	assert.True(t, mailer.SendInvoked)
+	assert.Equal(t, "alice@gmail.com", mailer.Recipient)
+	assert.Equal(t, "token_activation.tmpl", mailer.TemplateFile)
+	require.Len(t, mailer.TokenPlainText, 26)
+
+	// Only the token from the latest email can be used.
+	testcases = []handlerTestcase{
+		{
+			name:                   "Old token",
+			requestBody:            fmt.Sprintf(`{"token":%q}`, oldToken.Plaintext),
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"token": "invalid or expired activation token",
+				},
+			},
+		},
+		{
+			name:                   "New token",
+			requestBody:            fmt.Sprintf(`{"token":%q}`, mailer.TokenPlainText),
+			wantResponseStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodPut
+		tc.requestUrlPath = "/v1/users/activated"
+		testHandler(t, ts, tc)
+	}
+}
+
+func TestCreateActivationTokenHandler_DisabledUser(t *testing.T) {
+	ts := newTestServer(t)
+	mailer := &mockMailer{}
+	ts.app.mailer = mailer
+
+	adminToken := ts.insertUser(t, dummyUser{
+		name: "Admin", email: "admin@greenlight.net", password: "pa55word1234", activated: true, authenticated: true,
+		roles: []string{"admin"},
+	})
+	ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true,
+	})
+
+	// A token which Alice was sent before her account was disabled.
+	token, err := ts.app.modelStore.Tokens.New(2, 3*24*time.Hour, data.ScopeActivation)
+	require.NoError(t, err)
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Deactivate",
+			requestUrlPath:         "/v1/admin/users/2/activated",
+			requestMethodType:      http.MethodPut,
+			requestBody:            `{"activated": false}`,
+			requestHeader:          map[string]string{"Authorization": "Bearer " + adminToken},
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "Resend activation email",
+			requestUrlPath:         "/v1/tokens/activation",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"email":"alice@gmail.com"}`,
+			wantResponseStatusCode: http.StatusForbidden,
+			wantResponse:           errorResponse{Error: "your user account has been disabled"},
+		},
+		{
+			name:                   "Activate",
+			requestUrlPath:         "/v1/users/activated",
+			requestMethodType:      http.MethodPut,
+			requestBody:            fmt.Sprintf(`{"token":%q}`, token.Plaintext),
+			wantResponseStatusCode: http.StatusForbidden,
+			wantResponse:           errorResponse{Error: "your user account has been disabled"},
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+
+	assert.False(t, mailer.SendInvoked)
+
+	u, err := ts.app.modelStore.Users.Get(2)
+	require.NoError(t, err)
+	assert.False(t, u.Activated)
+}
+
+func TestCreateActivationTokenHandler_ConcurrentRequests(t *testing.T) {
+	ts := newTestServer(t)
+	ts.app.mailer = &mockMailer{}
+
+	ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: false,
+	})
+
+	const requests = 10
+
+	var (
+		wg       sync.WaitGroup
+		accepted atomic.Int32
+	)
+
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := ts.executeRequest(http.MethodPost, "/v1/tokens/activation", `{"email":"alice@gmail.com"}`, nil)
+			if err == nil && res.StatusCode == http.StatusAccepted {
+				accepted.Add(1)
+			}
+		}()
+	}
+
+	wg.Wait()
+	ts.app.wg.Wait()
+
+	assert.Equal(t, int32(1), accepted.Load())
+}
+
+func TestDeleteAuthenticationTokenHandlers(t *testing.T) {
+	ts := newTestServer(t)
+	firstToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+	})
+
+	// Create a few more sessions for the same user.
+	var otherTokens []string
+	for range 2 {
+		token, err := ts.app.modelStore.Tokens.New(1, time.Hour, data.ScopeAuthentication)
+		require.NoError(t, err)
+		otherTokens = append(otherTokens, token.Plaintext)
+	}
+
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Unauthenticated logout",
+			requestUrlPath:         "/v1/tokens/authentication",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse: errorResponse{
+				Error: "you must be authenticated to access this resource",
+			},
+		},
+		{
+			name:                   "Logout",
+			requestUrlPath:         "/v1/tokens/authentication",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          bearer(firstToken),
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "you have been logged out",
+			},
+		},
+		{
+			name:                   "Revoked token is rejected",
+			requestUrlPath:         "/v1/users/me",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          bearer(firstToken),
+			wantResponseStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:                   "Other sessions are still valid",
+			requestUrlPath:         "/v1/users/me",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          bearer(otherTokens[0]),
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "Logout of all sessions",
+			requestUrlPath:         "/v1/tokens/authentication/all",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          bearer(otherTokens[0]),
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "you have been logged out of all sessions",
+			},
+		},
+		{
+			name:                   "Current session is revoked",
+			requestUrlPath:         "/v1/users/me",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          bearer(otherTokens[0]),
+			wantResponseStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:                   "Other sessions are revoked",
+			requestUrlPath:         "/v1/users/me",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          bearer(otherTokens[1]),
+			wantResponseStatusCode: http.StatusUnauthorized,
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+}
+
+func TestRefreshAuthenticationTokenHandler(t *testing.T) {
+	ts := newTestServer(t)
+	ts.insertUser(t, dummyUser{name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true})
+
+	authToken, refreshToken := ts.login(t, "alice@gmail.com", "pa55word1234", nil)
+
+	res, err := ts.executeRequest(http.MethodPost, "/v1/tokens/refresh", `{"token":"`+refreshToken+`"}`, nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	dst := &authenticationTokenResponse{}
+	readJsonResponse(t, res.Body, dst)
+	assert.NotEqual(t, authToken, dst.AuthenticationToken.Token)
+	assert.NotEqual(t, refreshToken, dst.RefreshToken.Token)
+
+	expiry, err := time.Parse(time.RFC3339, dst.AuthenticationToken.Expiry)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().UTC().Add(15*time.Minute), expiry, 1*time.Second)
+
+	newAuthToken, newRefreshToken := dst.AuthenticationToken.Token, dst.RefreshToken.Token
+
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "New authentication token is valid",
+			requestUrlPath:         "/v1/users/me",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          bearer(newAuthToken),
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "Previous authentication token is revoked",
+			requestUrlPath:         "/v1/users/me",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          bearer(authToken),
+			wantResponseStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:                   "Reused refresh token is rejected",
+			requestUrlPath:         "/v1/tokens/refresh",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"token":"` + refreshToken + `"}`,
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse: errorResponse{
+				Error: "invalid or expired refresh token",
+			},
+		},
+		{
+			name:                   "Reuse revokes the authentication token of the session",
+			requestUrlPath:         "/v1/users/me",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          bearer(newAuthToken),
+			wantResponseStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:                   "Reuse revokes the refresh token of the session",
+			requestUrlPath:         "/v1/tokens/refresh",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"token":"` + newRefreshToken + `"}`,
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse: errorResponse{
+				Error: "invalid or expired refresh token",
+			},
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+}
+
+func TestAuthenticationTokenHandlers_JWTMode(t *testing.T) {
+	ts := newTestServer(t)
+	ts.app.config.auth.mode = authModeJWT
+	ts.app.config.auth.jwt.issuer = "greenlight"
+
+	key, err := jwt.NewEdDSAKey("2024-06", bytes.Repeat([]byte("e"), 32))
+	require.NoError(t, err)
+	ts.app.jwtKeys, err = jwt.NewKeySet(key.ID, key)
+	require.NoError(t, err)
+
+	ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		permCodes: []string{"movies:read"},
+	})
+	ts.insertMovie(t, "Moana", 2016, 107, []string{"animation"})
+
+	authToken, refreshToken := ts.login(t, "alice@gmail.com", "pa55word1234", nil)
+	assert.Equal(t, 2, strings.Count(authToken, "."), "authentication token is not a JWT")
+
+	claims, err := ts.app.jwtKeys.Verify(authToken, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, "1", claims.Subject)
+	assert.True(t, claims.Activated)
+	assert.Equal(t, []string{"movies:read"}, claims.Permissions)
+
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "JWT grants access to permitted resources",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          bearer(authToken),
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "JWT doesn't grant missing permissions",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          bearer(authToken),
+			wantResponseStatusCode: http.StatusForbidden,
+		},
+		{
+			name:                   "Current user is read from the database",
+			requestUrlPath:         "/v1/users/me",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          bearer(authToken),
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst struct {
+					User struct {
+						Email string `json:"email"`
+					} `json:"user"`
+				}
+				readJsonResponse(t, res.Body, &dst)
+				assert.Equal(t, "alice@gmail.com", dst.User.Email)
+			},
+		},
+		{
+			name:                   "Refresh token can be exchanged",
+			requestUrlPath:         "/v1/tokens/refresh",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"token":"` + refreshToken + `"}`,
+			wantResponseStatusCode: http.StatusCreated,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				dst := &authenticationTokenResponse{}
+				readJsonResponse(t, res.Body, dst)
+				_, err := ts.app.jwtKeys.Verify(dst.AuthenticationToken.Token, time.Now())
+				assert.NoError(t, err)
+				refreshToken = dst.RefreshToken.Token
+			},
+		},
+		{
+			name:                   "Logout",
+			requestUrlPath:         "/v1/tokens/authentication",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          bearer(authToken),
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "you have been logged out",
+			},
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+
+	// Logging out revokes the refresh token of the session.
+	res, err := ts.executeRequest(http.MethodPost, "/v1/tokens/refresh", `{"token":"`+refreshToken+`"}`, nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+}
+
+func TestRefreshAuthenticationTokenHandler_InvalidRequest(t *testing.T) {
+	ts := newTestServer(t)
+	ts.insertUser(t, dummyUser{name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true})
+	authToken, _ := ts.login(t, "alice@gmail.com", "pa55word1234", nil)
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Bad request body",
+			requestBody:            `{"refresh":"H2NMasdasdasnfjadhskjlfjhs"}`,
+			wantResponseStatusCode: http.StatusBadRequest,
+			wantResponse: errorResponse{
+				Error: "body contains unknown key \"refresh\"",
+			},
+		},
+		{
+			name:                   "Token less than 26 bytes",
+			requestBody:            `{"token":"invalid-token"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"token": "must be 26 bytes long",
+				},
+			},
+		},
+		{
+			name:                   "Token does not exist",
+			requestBody:            `{"token":"H2NMasdasdasnfjadhskjlfjhs"}`,
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse: errorResponse{
+				Error: "invalid or expired refresh token",
+			},
+		},
+		{
+			name:                   "Authentication token cannot be used as a refresh token",
+			requestBody:            `{"token":"` + authToken + `"}`,
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse: errorResponse{
+				Error: "invalid or expired refresh token",
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodPost
+		tc.requestUrlPath = "/v1/tokens/refresh"
+		testHandler(t, ts, tc)
+	}
+}
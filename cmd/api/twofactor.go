@@ -0,0 +1,449 @@
+package main
+
+import (
+	"errors"
+	"github.com/96malhar/greenlight/internal/data"
+	"github.com/96malhar/greenlight/internal/totp"
+	"github.com/96malhar/greenlight/internal/validator"
+	"net/http"
+	"time"
+)
+
+const (
+	// totpIssuer is the name under which accounts appear in authenticator apps.
+	totpIssuer = "Greenlight"
+	// twoFactorTokenTTL is how long a user has to enter their code after they have
+	// logged in with their password.
+	twoFactorTokenTTL = 5 * time.Minute
+)
+
+// enrolTwoFactorHandler starts the TOTP enrolment of the authenticated user by generating
+// a new secret. Two-factor authentication isn't enabled until the enrolment is confirmed
+// with confirmTwoFactorHandler.
+func (app *application) enrolTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Password != "", "password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	secret := totp.GenerateSecret()
+
+	err = app.modelStore.TwoFactor.Enrol(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v.AddError("two_factor", "is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"two_factor": envelope{
+		"secret":           secret,
+		"provisioning_uri": totp.ProvisioningURI(secret, totpIssuer, user.Email),
+	}}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmTwoFactorHandler enables two-factor authentication for the authenticated user
+// once they have entered a valid code from their authenticator app, and returns a set of
+// recovery codes. The recovery codes are only ever shown once.
+func (app *application) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Code != "", "code", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	tf, err := app.modelStore.TwoFactor.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("two_factor", "must be enrolled first")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if tf.Confirmed {
+		v.AddError("two_factor", "is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	step, ok := totp.Validate(tf.Secret, input.Code, time.Now(), tf.LastUsedStep)
+	if !ok {
+		v.AddError("code", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes := data.NewRecoveryCodes()
+
+	err = app.modelStore.TwoFactor.Confirm(user.ID, step, codes)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// regenerateRecoveryCodesHandler replaces the recovery codes of the authenticated user,
+// invalidating the old ones. A valid code is required as confirmation.
+func (app *application) regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	tf, ok := app.checkTwoFactorInput(w, r, user.ID, input.Code)
+	if !ok {
+		return
+	}
+
+	app.writeRecoveryCodes(w, r, tf.UserID)
+}
+
+// disableTwoFactorHandler disables two-factor authentication for the authenticated user.
+// Both the password and a valid code are required as confirmation.
+func (app *application) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Password != "", "password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, ok := app.checkTwoFactorInput(w, r, user.ID, input.Code)
+	if !ok {
+		return
+	}
+
+	err = app.modelStore.TwoFactor.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.NewAuditEvent(data.AuditUserDisableTwoFactor, data.AuditTargetUser, user.ID))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication has been disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// twoFactorPendingResponse issues a 2fa-pending token to a user who has to enter a code to
+// complete their login, and sends it to the client instead of a session.
+func (app *application) twoFactorPendingResponse(w http.ResponseWriter, r *http.Request, user *data.User) {
+	token, err := app.modelStore.Tokens.New(user.ID, twoFactorTokenTTL, data.ScopeTwoFactor)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"two_factor_token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createTwoFactorAuthenticationTokenHandler completes the login of a user with two-factor
+// authentication enabled. It exchanges the 2fa-pending token issued by
+// createAuthenticationTokenHandler or oidcCallbackHandler, together with a valid code, for a new session.
+func (app *application) createTwoFactorAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Code           string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	v.Check(input.Code != "", "code", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.modelStore.Users.GetForToken(data.ScopeTwoFactor, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired two-factor token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.IsDisabled() {
+		app.disabledAccountResponse(w, r)
+		return
+	}
+
+	tf, err := app.modelStore.TwoFactor.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired two-factor token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Wrong codes count as failed logins, so guessing codes is throttled in the same way
+	// as guessing passwords. The attempt is claimed before the code is checked, so that
+	// concurrent guesses are counted before any of them is checked.
+	attempt, retryAfter, err := app.claimLoginAttempt(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if retryAfter > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	ok, err := app.checkTwoFactorCode(tf, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		app.failedLoginResponse(w, r, attempt, user)
+		return
+	}
+
+	err = app.modelStore.Tokens.DeleteAllForUser(data.ScopeTwoFactor, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.modelStore.LoginAttempts.Delete(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	authToken, refreshToken, err := app.newSessionTokens(r, user, data.NewTokenFamily())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.auditLogin(r, user)
+
+	env := envelope{"authentication_token": authToken, "refresh_token": refreshToken}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkTwoFactorCode reports whether a code is valid for a TOTP enrolment. The code can
+// either be a TOTP code from the authenticator app or one of the recovery codes of the
+// user. Either kind of code can only be used once.
+func (app *application) checkTwoFactorCode(tf *data.TwoFactor, code string) (bool, error) {
+	if len(code) != totp.Digits {
+		err := app.modelStore.TwoFactor.UseRecoveryCode(tf.UserID, code)
+		switch {
+		case err == nil:
+			return true, nil
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	step, ok := totp.Validate(tf.Secret, code, time.Now(), tf.LastUsedStep)
+	if !ok {
+		return false, nil
+	}
+
+	err := app.modelStore.TwoFactor.UseStep(tf.UserID, step)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, data.ErrCodeReused):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// checkTwoFactorInput checks a code entered by a user with two-factor authentication
+// enabled. If the code is missing or invalid, an error response is sent and the boolean
+// result is false.
+func (app *application) checkTwoFactorInput(w http.ResponseWriter, r *http.Request, userID int64, code string) (*data.TwoFactor, bool) {
+	v := validator.New()
+
+	if v.Check(code != "", "code", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	tf, err := app.modelStore.TwoFactor.Get(userID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if tf == nil || !tf.Confirmed {
+		v.AddError("two_factor", "is not enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	ok, err := app.checkTwoFactorCode(tf, code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if !ok {
+		v.AddError("code", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	return tf, true
+}
+
+// writeRecoveryCodes generates a new set of recovery codes for a specific user and sends
+// them in the response.
+func (app *application) writeRecoveryCodes(w http.ResponseWriter, r *http.Request, userID int64) {
+	codes := data.NewRecoveryCodes()
+
+	err := app.modelStore.TwoFactor.ReplaceRecoveryCodes(userID, codes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/96malhar/greenlight/internal/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type twoFactorEnrolmentResponse struct {
+	TwoFactor struct {
+		Secret          string `json:"secret"`
+		ProvisioningURI string `json:"provisioning_uri"`
+	} `json:"two_factor"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type twoFactorTokenResponse struct {
+	TwoFactorToken token `json:"two_factor_token"`
+}
+
+// enableTwoFactor enrols the user with the given authentication token in two-factor
+// authentication and returns their TOTP secret and recovery codes.
+func (ts *testServer) enableTwoFactor(t *testing.T, authToken, password string) (string, []string) {
+	header := map[string]string{"Authorization": "Bearer " + authToken}
+
+	res, err := ts.executeRequest(http.MethodPost, "/v1/users/me/2fa", fmt.Sprintf(`{"password":%q}`, password), header)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	var enrolment twoFactorEnrolmentResponse
+	readJsonResponse(t, res.Body, &enrolment)
+	secret := enrolment.TwoFactor.Secret
+
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	require.NoError(t, err)
+
+	res, err = ts.executeRequest(http.MethodPut, "/v1/users/me/2fa", fmt.Sprintf(`{"code":%q}`, code), header)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	var codes recoveryCodesResponse
+	readJsonResponse(t, res.Body, &codes)
+
+	return secret, codes.RecoveryCodes
+}
+
+// startTwoFactorLogin logs in with an email address and password, and returns the
+// 2fa-pending token which has to be exchanged for a session.
+func (ts *testServer) startTwoFactorLogin(t *testing.T, email, password string) string {
+	body := fmt.Sprintf(`{"email":%q, "password":%q}`, email, password)
+	res, err := ts.executeRequest(http.MethodPost, "/v1/tokens/authentication", body, nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusAccepted, res.StatusCode)
+
+	var dst twoFactorTokenResponse
+	readJsonResponse(t, res.Body, &dst)
+	return dst.TwoFactorToken.Token
+}
+
+func TestEnrolTwoFactorHandler(t *testing.T) {
+	ts := newTestServer(t)
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+	})
+	header := map[string]string{"Authorization": "Bearer " + authToken}
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "Wrong password",
+		requestUrlPath:         "/v1/users/me/2fa",
+		requestMethodType:      http.MethodPost,
+		requestHeader:          header,
+		requestBody:            `{"password":"wrongpa55word"}`,
+		wantResponseStatusCode: http.StatusUnprocessableEntity,
+		wantResponse: validationErrorResponse{
+			Error: map[string]string{
+				"password": "is incorrect",
+			},
+		},
+	}, handlerTestcase{
+		name:                   "Confirm before enrolling",
+		requestUrlPath:         "/v1/users/me/2fa",
+		requestMethodType:      http.MethodPut,
+		requestHeader:          header,
+		requestBody:            `{"code":"123456"}`,
+		wantResponseStatusCode: http.StatusUnprocessableEntity,
+		wantResponse: validationErrorResponse{
+			Error: map[string]string{
+				"two_factor": "must be enrolled first",
+			},
+		},
+	})
+
+	res, err := ts.executeRequest(http.MethodPost, "/v1/users/me/2fa", `{"password":"pa55word1234"}`, header)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	var enrolment twoFactorEnrolmentResponse
+	readJsonResponse(t, res.Body, &enrolment)
+	assert.Len(t, enrolment.TwoFactor.Secret, 32)
+	assert.True(t, strings.HasPrefix(enrolment.TwoFactor.ProvisioningURI, "otpauth://totp/Greenlight:alice@gmail.com?"))
+	assert.Contains(t, enrolment.TwoFactor.ProvisioningURI, "secret="+enrolment.TwoFactor.Secret)
+
+	// Until the enrolment is confirmed, logging in only requires the password.
+	ts.login(t, "alice@gmail.com", "pa55word1234", nil)
+
+	code, err := totp.Code(enrolment.TwoFactor.Secret, totp.Step(time.Now()))
+	require.NoError(t, err)
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Wrong code",
+			requestUrlPath:         "/v1/users/me/2fa",
+			requestMethodType:      http.MethodPut,
+			requestHeader:          header,
+			requestBody:            `{"code":"abcdef"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"code": "is incorrect",
+				},
+			},
+		},
+		{
+			name:                   "Valid code",
+			requestUrlPath:         "/v1/users/me/2fa",
+			requestMethodType:      http.MethodPut,
+			requestHeader:          header,
+			requestBody:            fmt.Sprintf(`{"code":%q}`, code),
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst recoveryCodesResponse
+				readJsonResponse(t, res.Body, &dst)
+				require.Len(t, dst.RecoveryCodes, 10)
+				assert.Len(t, dst.RecoveryCodes[0], 11)
+
+				// The recovery codes are stored together with the confirmation.
+				var stored int
+				err := ts.db.QueryRow(context.Background(), "SELECT count(*) FROM recovery_codes WHERE user_id = 1").Scan(&stored)
+				require.NoError(t, err)
+				assert.Equal(t, 10, stored)
+			},
+		},
+		{
+			name:                   "Enrol again",
+			requestUrlPath:         "/v1/users/me/2fa",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          header,
+			requestBody:            `{"password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"two_factor": "is already enabled",
+				},
+			},
+		},
+		{
+			name:                   "Log in with the password only",
+			requestUrlPath:         "/v1/tokens/authentication",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"email":"alice@gmail.com", "password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusAccepted,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst twoFactorTokenResponse
+				readJsonResponse(t, res.Body, &dst)
+				assert.Len(t, dst.TwoFactorToken.Token, 26)
+
+				expiry, err := time.Parse(time.RFC3339, dst.TwoFactorToken.Expiry)
+				require.NoError(t, err)
+				assert.WithinDuration(t, time.Now().Add(5*time.Minute), expiry, 2*time.Second)
+			},
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+}
+
+func TestCreateTwoFactorAuthenticationTokenHandler(t *testing.T) {
+	ts := newTestServer(t)
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+	})
+	secret, recoveryCodes := ts.enableTwoFactor(t, authToken, "pa55word1234")
+
+	// The code used to confirm the enrolment can't be used again, but the code of the
+	// next time step is accepted to allow for clock drift.
+	usedCode, err := totp.Code(secret, totp.Step(time.Now()))
+	require.NoError(t, err)
+	nextCode, err := totp.Code(secret, totp.Step(time.Now())+1)
+	require.NoError(t, err)
+
+	pendingToken := ts.startTwoFactorLogin(t, "alice@gmail.com", "pa55word1234")
+
+	invalidCredentialsResponse := errorResponse{Error: "invalid authentication credentials"}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Missing fields",
+			requestBody:            `{}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"token": "must be provided",
+					"code":  "must be provided",
+				},
+			},
+		},
+		{
+			name:                   "Invalid token",
+			requestBody:            fmt.Sprintf(`{"token":"ABCDEFGHIJKLMNOPQRSTUVWXYZ", "code":%q}`, nextCode),
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"token": "invalid or expired two-factor token",
+				},
+			},
+		},
+		{
+			name:                   "Authentication token instead of 2fa-pending token",
+			requestBody:            fmt.Sprintf(`{"token":%q, "code":%q}`, authToken, nextCode),
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:                   "Wrong code",
+			requestBody:            fmt.Sprintf(`{"token":%q, "code":"abcdef"}`, pendingToken),
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse:           invalidCredentialsResponse,
+		},
+		{
+			name:                   "Reused code",
+			requestBody:            fmt.Sprintf(`{"token":%q, "code":%q}`, pendingToken, usedCode),
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse:           invalidCredentialsResponse,
+		},
+		{
+			name:                   "Valid code",
+			requestBody:            fmt.Sprintf(`{"token":%q, "code":%q}`, pendingToken, nextCode),
+			wantResponseStatusCode: http.StatusCreated,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst authenticationTokenResponse
+				readJsonResponse(t, res.Body, &dst)
+				assert.NotEmpty(t, dst.AuthenticationToken.Token)
+				assert.NotEmpty(t, dst.RefreshToken.Token)
+			},
+		},
+		{
+			name:                   "2fa-pending token can only be used once",
+			requestBody:            fmt.Sprintf(`{"token":%q, "code":%q}`, pendingToken, recoveryCodes[0]),
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodPost
+		tc.requestUrlPath = "/v1/tokens/2fa"
+		testHandler(t, ts, tc)
+	}
+
+	// Recovery codes can be used instead of a TOTP code, but only once each.
+	recoveryCode := strings.ToLower(recoveryCodes[0])
+
+	testcases = []handlerTestcase{
+		{
+			name:                   "Recovery code",
+			requestBody:            fmt.Sprintf(`{"token":%q, "code":%q}`, ts.startTwoFactorLogin(t, "alice@gmail.com", "pa55word1234"), recoveryCode),
+			wantResponseStatusCode: http.StatusCreated,
+		},
+		{
+			name:                   "Used recovery code",
+			requestBody:            fmt.Sprintf(`{"token":%q, "code":%q}`, ts.startTwoFactorLogin(t, "alice@gmail.com", "pa55word1234"), recoveryCode),
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse:           invalidCredentialsResponse,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodPost
+		tc.requestUrlPath = "/v1/tokens/2fa"
+		testHandler(t, ts, tc)
+	}
+}
+
+func TestDisableTwoFactorHandlers(t *testing.T) {
+	ts := newTestServer(t)
+	adminToken := ts.insertUser(t, dummyUser{
+		name: "Admin", email: "admin@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		permCodes: []string{"users:admin"},
+	})
+	aliceToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+	})
+	bobToken := ts.insertUser(t, dummyUser{
+		name: "Bob", email: "bob@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+	})
+
+	_, aliceCodes := ts.enableTwoFactor(t, aliceToken, "pa55word1234")
+	_, bobCodes := ts.enableTwoFactor(t, bobToken, "pa55word1234")
+
+	aliceHeader := map[string]string{"Authorization": "Bearer " + aliceToken}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Regenerate recovery codes",
+			requestUrlPath:         "/v1/users/me/2fa/recovery-codes",
+			requestMethodType:      http.MethodPost,
+			requestHeader:          aliceHeader,
+			requestBody:            fmt.Sprintf(`{"code":%q}`, aliceCodes[0]),
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst recoveryCodesResponse
+				readJsonResponse(t, res.Body, &dst)
+				require.Len(t, dst.RecoveryCodes, 10)
+				assert.NotContains(t, dst.RecoveryCodes, aliceCodes[1])
+			},
+		},
+		{
+			name:                   "Old recovery codes are invalidated",
+			requestUrlPath:         "/v1/users/me/2fa",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          aliceHeader,
+			requestBody:            fmt.Sprintf(`{"password":"pa55word1234", "code":%q}`, aliceCodes[1]),
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"code": "is incorrect",
+				},
+			},
+		},
+		{
+			name:                   "Admin disables two-factor authentication",
+			requestUrlPath:         "/v1/admin/users/2/2fa",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          map[string]string{"Authorization": "Bearer " + adminToken},
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "two-factor authentication of the user has been disabled",
+			},
+		},
+		{
+			name:                   "Disable when not enabled",
+			requestUrlPath:         "/v1/users/me/2fa",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          aliceHeader,
+			requestBody:            `{"password":"pa55word1234", "code":"123456"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"two_factor": "is not enabled",
+				},
+			},
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+	ts.login(t, "alice@gmail.com", "pa55word1234", nil)
+
+	// Two-factor authentication is still enabled for other users.
+	ts.startTwoFactorLogin(t, "bob@gmail.com", "pa55word1234")
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "Disable with a recovery code",
+		requestUrlPath:         "/v1/users/me/2fa",
+		requestMethodType:      http.MethodDelete,
+		requestHeader:          map[string]string{"Authorization": "Bearer " + bobToken},
+		requestBody:            fmt.Sprintf(`{"password":"pa55word1234", "code":%q}`, bobCodes[0]),
+		wantResponseStatusCode: http.StatusOK,
+		wantResponse: map[string]string{
+			"message": "two-factor authentication has been disabled",
+		},
+	})
+	ts.login(t, "bob@gmail.com", "pa55word1234", nil)
+}
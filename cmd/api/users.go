@@ -6,15 +6,24 @@ import (
 	"github.com/96malhar/greenlight/internal/data"
 	"github.com/96malhar/greenlight/internal/validator"
 	"net/http"
+	"strings"
 	"time"
 )
 
-// registerUserHandler creates a new user account.
+// registerUserHandler creates a new user account. In invite mode an invitation token is
+// required, but one can be provided in open mode too. Since the invitation was emailed to
+// the invitee, an account registered with an invitation is activated right away.
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
+	if app.config.registration.mode == registrationModeClosed {
+		app.registrationClosedResponse(w, r)
+		return
+	}
+
 	var input struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Name            string `json:"name"`
+		Email           string `json:"email"`
+		Password        string `json:"password"`
+		InvitationToken string `json:"invitation_token"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -29,7 +38,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		Activated: false,
 	}
 
-	err = user.Password.Set(input.Password)
+	err = user.Password.Set(input.Password, app.passwordHasher)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -37,11 +46,71 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	v := validator.New()
 
-	if data.ValidateUser(v, user); !v.Valid() {
+	data.ValidateUser(v, user, app.passwordHasher, app.passwordPolicy)
+
+	if app.config.registration.mode == registrationModeInvite {
+		v.Check(input.InvitationToken != "", "invitation_token", "must be provided")
+	}
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	var invitation *data.Invitation
+
+	if input.InvitationToken != "" {
+		invitation, err = app.modelStore.Invitations.GetForToken(input.InvitationToken)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("invitation_token", "invalid or expired invitation token")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !strings.EqualFold(invitation.Email, user.Email) {
+			v.AddError("email", "must match the email address of the invitation")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		user.Activated = true
+	}
+
+	// The email address of a soft deleted account stays reserved until the account is
+	// purged, so that its owner can still restore it. Registering with it fails with the
+	// same error as for any other account, so that the deletion isn't revealed.
+	//
+	// A user with an invitation is granted its permissions, and the invitation is used up,
+	// together with the insert. There is no need for an activation email, since the
+	// account is already activated.
+	if invitation != nil {
+		err = app.modelStore.Invitations.Accept(invitation.ID, user, app.config.registration.defaultRole)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrDuplicateEmail):
+				v.AddError("email", "a user with this email address already exists")
+				app.failedValidationResponse(w, r, v.Errors)
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("invitation_token", "invalid or expired invitation token")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	err = app.modelStore.Users.Insert(user)
 	if err != nil {
 		switch {
@@ -54,11 +123,13 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Add the "movies:read" permission for the new user.
-	err = app.modelStore.Permissions.AddForUser(user.ID, "movies:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
+	// Grant the default role to the new user.
+	if app.config.registration.defaultRole != "" {
+		err = app.modelStore.Roles.AddForUser(user.ID, app.config.registration.defaultRole)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 	}
 
 	token, err := app.modelStore.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
@@ -119,6 +190,13 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// An account which was disabled by an administrator can only be activated again by
+	// an administrator, even with a token which was issued before it was disabled.
+	if user.IsDisabled() {
+		app.disabledAccountResponse(w, r)
+		return
+	}
+
 	// Update the user's activation status.
 	user.Activated = true
 
@@ -149,3 +227,521 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// updateUserPasswordHandler sets a new password for a user using a password reset token.
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlaintext(v, input.Password, app.passwordHasher)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.modelStore.Users.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if data.ValidatePasswordStrength(v, app.passwordPolicy, input.Password, user.Name, user.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = user.Password.Set(input.Password, app.passwordHasher)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.modelStore.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// If everything was successful, then delete all password reset tokens for the user.
+	err = app.modelStore.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Revoke all the existing sessions of the user, so that anyone who was logged in
+	// with the old password is signed out.
+	err = app.revokeAllSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Resetting the password proves control of the email address, so it also lifts
+	// any lockout of the account.
+	err = app.unlockUser(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.auditSelf(r, data.AuditUserResetPassword, user)
+
+	env := envelope{"message": "your password was successfully reset"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// currentUser returns the full user record of the authenticated user. In jwt mode the
+// user in the request context is built from the claims of the token, so the record is
+// read from the database instead.
+func (app *application) currentUser(r *http.Request) (*data.User, error) {
+	if app.config.auth.mode != authModeJWT {
+		return app.contextGetUser(r), nil
+	}
+
+	return app.modelStore.Users.Get(app.contextGetUser(r).ID)
+}
+
+// showCurrentUserHandler returns the account details of the authenticated user.
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCurrentUserHandler updates the name and/or password of the authenticated user.
+// Changing the password requires the current password to be provided as confirmation.
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The pointer fields are used to support partial updates.
+	var input struct {
+		Name            *string `json:"name"`
+		Password        *string `json:"password"`
+		CurrentPassword *string `json:"current_password"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	if input.Password != nil {
+		if input.CurrentPassword == nil || *input.CurrentPassword == "" {
+			v.AddError("current_password", "must be provided")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		match, err := user.Password.Matches(*input.CurrentPassword)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !match {
+			v.AddError("current_password", "is incorrect")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		err = user.Password.Set(*input.Password, app.passwordHasher)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if data.ValidateUser(v, user, app.passwordHasher, app.passwordPolicy); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The version of the user record was read by currentUser, so the
+	// update fails with an edit conflict if the record was changed in the meantime.
+	err = app.modelStore.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if input.Password != nil {
+		app.audit(r, data.NewAuditEvent(data.AuditUserChangePassword, data.AuditTargetUser, user.ID))
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCurrentUserHandler deletes the account of the authenticated user, who has to
+// confirm it with their current password. The account is only soft deleted at first: the
+// user is logged out everywhere and can't log in any more, but they can restore the
+// account with the token which is emailed to them until the grace period is over. After
+// that the account is purged by purgeDeletedUsers.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.CurrentPassword != "", "current_password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("current_password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.modelStore.Users.SoftDelete(user.ID, app.config.accountDeletion.gracePeriod)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.NewAuditEvent(data.AuditUserDelete, data.AuditTargetUser, user.ID))
+
+	purgeAt := token.Expiry
+
+	app.background(func() {
+		tokenData := map[string]any{
+			"restoreToken": token.Plaintext,
+			"purgeAt":      purgeAt.Format(time.RFC1123),
+		}
+		err := app.mailer.Send(user.Email, "user_deletion.tmpl", tokenData)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to send account deletion email to (%s). Err = %s", user.Email, err.Error())
+			app.logger.Error(msg)
+		}
+	})
+
+	env := envelope{"message": "your account is scheduled for deletion", "purge_at": purgeAt}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// restoreUserHandler undoes the deletion of an account using the token which was emailed
+// to the user when they deleted it. The user has to log in again afterwards.
+func (app *application) restoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.modelStore.Users.GetForToken(data.ScopeRestore, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired restore token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.modelStore.Users.Restore(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.modelStore.Tokens.DeleteAllForUser(data.ScopeRestore, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.auditSelf(r, data.AuditUserRestore, user)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your account has been restored"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// purgeDeletedUsers permanently removes the accounts whose deletion grace period is over,
+// once every purge interval. It never returns, so it should be run in its own goroutine.
+func (app *application) purgeDeletedUsers() {
+	ticker := time.NewTicker(app.config.accountDeletion.purgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.modelStore.Users.PurgeDeleted(time.Now().UTC().Add(-app.config.accountDeletion.gracePeriod))
+		if err != nil {
+			app.logger.Error("failed to purge deleted users", "error", err.Error())
+			continue
+		}
+
+		if n > 0 {
+			app.logger.Info("purged deleted users", "count", n)
+		}
+	}
+}
+
+// createEmailChangeHandler stores a new, unconfirmed email address for the authenticated
+// user and sends a confirmation token to that address. The email address of the account
+// is only changed once the token is confirmed with confirmEmailChangeHandler.
+func (app *application) createEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	v.Check(input.Email != user.Email, "email", "must be different from the current email address")
+	v.Check(input.Password != "", "password", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Check up front that the address isn't in use so that the client gets immediate
+	// feedback. The unique constraint is checked again when the change is confirmed.
+	_, err = app.modelStore.Users.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.modelStore.Users.SetPendingEmail(user.ID, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Delete any confirmation tokens for a previously requested address, so that only
+	// the latest pending email address can be confirmed.
+	err = app.modelStore.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.modelStore.Tokens.New(user.ID, 24*time.Hour, data.ScopeEmailChange)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		tokenData := map[string]any{
+			"emailChangeToken": token.Plaintext,
+		}
+		err = app.mailer.Send(input.Email, "token_email_change.tmpl", tokenData)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to send email change confirmation for user (%s). Err = %s", input.Email, err.Error())
+			app.logger.Error(msg)
+		}
+	})
+
+	env := envelope{"message": "an email will be sent to the new address containing confirmation instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmEmailChangeHandler replaces the email address of a user with their pending
+// email address, using the token that was sent to the new address.
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.modelStore.Users.GetForToken(data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.modelStore.Users.ConfirmPendingEmail(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.modelStore.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,19 +1,25 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"github.com/96malhar/greenlight/internal/data"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
 type user struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Activated bool      `json:"activated"`
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Name       string     `json:"name"`
+	Email      string     `json:"email"`
+	Activated  bool       `json:"activated"`
+	DisabledAt *time.Time `json:"disabled_at"`
 }
 
 type userResponse struct {
@@ -45,6 +51,59 @@ func TestRegisterUserHandler_ValidRequest(t *testing.T) {
 	assert.True(t, mailer.TokenPlainText != "")
 }
 
+func TestRegisterUserHandler_DefaultRole(t *testing.T) {
+	testcases := []struct {
+		name            string
+		defaultRole     string
+		wantPermissions data.Permissions
+	}{
+		{name: "Viewer", defaultRole: "viewer", wantPermissions: data.Permissions{"movies:read"}},
+		{name: "Editor", defaultRole: "editor", wantPermissions: data.Permissions{"movies:read", "movies:write"}},
+		{name: "No default role", defaultRole: "", wantPermissions: data.Permissions{}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.app.mailer = &mockMailer{}
+			ts.app.config.registration.defaultRole = tc.defaultRole
+
+			res, err := ts.executeRequest(http.MethodPost, "/v1/users", `{"name":"Bob", "email":"bob@gmail.com", "password":"5ecret1234"}`, nil)
+			require.NoError(t, err)
+			res.Body.Close()
+			require.Equal(t, http.StatusAccepted, res.StatusCode)
+
+			permissions, err := ts.app.modelStore.Permissions.GetAllForUser(1)
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantPermissions, permissions)
+		})
+	}
+}
+
+func TestPermissions_UnionOfDirectAndRolePermissions(t *testing.T) {
+	ts := newTestServer(t)
+	ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		permCodes: []string{"movies:read", "movies:write"}, roles: []string{"viewer"},
+	})
+	ts.insertUser(t, dummyUser{
+		name: "Bob", email: "bob@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+		roles: []string{"viewer", "editor"},
+	})
+
+	permissions, err := ts.app.modelStore.Permissions.GetAllForUser(1)
+	require.NoError(t, err)
+	assert.Equal(t, data.Permissions{"movies:read", "movies:write"}, permissions)
+
+	permissions, err = ts.app.modelStore.Permissions.GetAllForUser(2)
+	require.NoError(t, err)
+	assert.Equal(t, data.Permissions{"movies:read", "movies:write"}, permissions)
+
+	roles, err := ts.app.modelStore.Roles.GetAllForUser(2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"editor", "viewer"}, roles)
+}
+
 func TestRegisterUserHandler_InvalidRequest(t *testing.T) {
 	ts := newTestServer(t)
 
@@ -98,6 +157,87 @@ func TestRegisterUserHandler_InvalidRequest(t *testing.T) {
 	testHandler(t, ts, testcases...)
 }
 
+func TestRegisterUserHandler_WeakPassword(t *testing.T) {
+	ts := newTestServer(t)
+	ts.app.mailer = &mockMailer{}
+
+	// The list holds the SHA-1 hash of "correcthorsebatterystaple" in the format of the
+	// Pwned Passwords files.
+	breachedList := filepath.Join(t.TempDir(), "breached.txt")
+	err := os.WriteFile(breachedList, []byte("# test list\nBFD3617727EAB0E800E62A776C76381DEFBC4145:42\n"), 0o600)
+	require.NoError(t, err)
+
+	breached, err := data.LoadBreachedPasswords(breachedList)
+	require.NoError(t, err)
+	assert.Equal(t, 1, breached.Len())
+
+	ts.app.passwordPolicy.Breached = breached
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Breached password",
+			requestBody:            `{"name":"Alice Smith", "email":"alice@gmail.com", "password":"correcthorsebatterystaple"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"password": "must not be a password which has appeared in a data breach",
+				},
+			},
+		},
+		{
+			name:                   "Password contains name",
+			requestBody:            `{"name":"Alice Smith", "email":"alice@gmail.com", "password":"8smithsonian4"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"password": "must not contain your name or email address",
+				},
+			},
+		},
+		{
+			name:                   "Password contains email address",
+			requestBody:            `{"name":"Bob", "email":"wonderland@gmail.com", "password":"Wonderland-2024"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"password": "must not contain your name or email address",
+				},
+			},
+		},
+		{
+			name:                   "Repeated characters",
+			requestBody:            `{"name":"Alice Smith", "email":"alice@gmail.com", "password":"zzzzzzzzzzzz"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"password": "is too easy to guess, use a longer password with a mix of letters, digits and symbols",
+				},
+			},
+		},
+		{
+			name:                   "Sequences",
+			requestBody:            `{"name":"Alice Smith", "email":"alice@gmail.com", "password":"abcdefgh12345678"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"password": "is too easy to guess, use a longer password with a mix of letters, digits and symbols",
+				},
+			},
+		},
+		{
+			name:                   "Strong password",
+			requestBody:            `{"name":"Alice Smith", "email":"alice@gmail.com", "password":"Tr0ub4dor&3"}`,
+			wantResponseStatusCode: http.StatusAccepted,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodPost
+		tc.requestUrlPath = "/v1/users"
+		testHandler(t, ts, tc)
+	}
+}
+
 func TestActivateUserHandler_ValidRequest(t *testing.T) {
 	mailer := &mockMailer{}
 	ts := newTestServer(t)
@@ -167,3 +307,574 @@ func TestActivateUserHandler_InvalidRequest(t *testing.T) {
 
 	testHandler(t, newTestServer(t), testcases...)
 }
+
+func TestUpdateUserPasswordHandler_ValidRequest(t *testing.T) {
+	ts := newTestServer(t)
+	mailer := &mockMailer{}
+	ts.app.mailer = mailer
+
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+	})
+
+	// Request a password reset token
+	res, err := ts.executeRequest(http.MethodPost, "/v1/tokens/password-reset", `{"email":"alice@gmail.com"}`, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, res.StatusCode)
+
+	// wait for the user to get the password reset email
+	time.Sleep(200 * time.Millisecond)
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "Reset password",
+		requestUrlPath:         "/v1/users/password",
+		requestMethodType:      http.MethodPut,
+		requestBody:            `{"password":"n3wpa55word", "token":"` + mailer.TokenPlainText + `"}`,
+		wantResponseStatusCode: http.StatusOK,
+		wantResponse: map[string]string{
+			"message": "your password was successfully reset",
+		},
+	})
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Token cannot be reused",
+			requestUrlPath:         "/v1/users/password",
+			requestMethodType:      http.MethodPut,
+			requestBody:            `{"password":"an0therpa55word", "token":"` + mailer.TokenPlainText + `"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"token": "invalid or expired password reset token",
+				},
+			},
+		},
+		{
+			name:                   "Existing authentication token is revoked",
+			requestUrlPath:         "/v1/healthcheck",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          map[string]string{"Authorization": "Bearer " + authToken},
+			wantResponseStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:                   "Old password no longer works",
+			requestUrlPath:         "/v1/tokens/authentication",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"email":"alice@gmail.com", "password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:                   "New password works",
+			requestUrlPath:         "/v1/tokens/authentication",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"email":"alice@gmail.com", "password":"n3wpa55word"}`,
+			wantResponseStatusCode: http.StatusCreated,
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+}
+
+func TestUpdateUserPasswordHandler_InvalidRequest(t *testing.T) {
+	testcases := []handlerTestcase{
+		{
+			name:                   "Bad request body",
+			requestBody:            `{"newPassword":"pa55word1234", "token":"H2NMasdasdasnfjadhskjlfjhs"}`,
+			wantResponseStatusCode: http.StatusBadRequest,
+			wantResponse: errorResponse{
+				Error: "body contains unknown key \"newPassword\"",
+			},
+		},
+		{
+			name:                   "Invalid password and token",
+			requestBody:            `{"password":"pass", "token":"invalid-token"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"password": "must be at least 8 bytes long",
+					"token":    "must be 26 bytes long",
+				},
+			},
+		},
+		{
+			name:                   "Token does not exist",
+			requestBody:            `{"password":"pa55word1234", "token":"H2NMasdasdasnfjadhskjlfjhs"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"token": "invalid or expired password reset token",
+				},
+			},
+		},
+	}
+
+	ts := newTestServer(t)
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodPut
+		tc.requestUrlPath = "/v1/users/password"
+		testHandler(t, ts, tc)
+	}
+}
+
+func TestShowCurrentUserHandler(t *testing.T) {
+	ts := newTestServer(t)
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+	})
+
+	res, err := ts.executeRequest(http.MethodGet, "/v1/users/me", "", map[string]string{"Authorization": "Bearer " + authToken})
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	dst := &userResponse{}
+	readJsonResponse(t, res.Body, dst)
+	assert.Equal(t, int64(1), dst.User.ID)
+	assert.Equal(t, "Alice", dst.User.Name)
+	assert.Equal(t, "alice@gmail.com", dst.User.Email)
+	assert.True(t, dst.User.Activated)
+}
+
+func TestUpdateCurrentUserHandler(t *testing.T) {
+	ts := newTestServer(t)
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+	})
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Update name",
+			requestBody:            `{"name":"Alice Smith"}`,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				dst := &userResponse{}
+				readJsonResponse(t, res.Body, dst)
+				assert.Equal(t, "Alice Smith", dst.User.Name)
+				assert.Equal(t, "alice@gmail.com", dst.User.Email)
+			},
+		},
+		{
+			name:                   "Password without current password",
+			requestBody:            `{"password":"n3wpa55word"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"current_password": "must be provided",
+				},
+			},
+		},
+		{
+			name:                   "Password with wrong current password",
+			requestBody:            `{"password":"n3wpa55word", "current_password":"wrongpa55word"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"current_password": "is incorrect",
+				},
+			},
+		},
+		{
+			name:                   "Invalid new password",
+			requestBody:            `{"password":"pass", "current_password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"password": "must be at least 8 bytes long",
+				},
+			},
+		},
+		{
+			name:                   "Empty name",
+			requestBody:            `{"name":""}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"name": "must be provided",
+				},
+			},
+		},
+		{
+			name:                   "Unknown field",
+			requestBody:            `{"email":"alice@example.com"}`,
+			wantResponseStatusCode: http.StatusBadRequest,
+			wantResponse: errorResponse{
+				Error: "body contains unknown key \"email\"",
+			},
+		},
+		{
+			name:                   "Update password",
+			requestBody:            `{"password":"n3wpa55word", "current_password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodPatch
+		tc.requestUrlPath = "/v1/users/me"
+		tc.requestHeader = map[string]string{"Authorization": "Bearer " + authToken}
+		testHandler(t, ts, tc)
+	}
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "New password works",
+		requestUrlPath:         "/v1/tokens/authentication",
+		requestMethodType:      http.MethodPost,
+		requestBody:            `{"email":"alice@gmail.com", "password":"n3wpa55word"}`,
+		wantResponseStatusCode: http.StatusCreated,
+	})
+}
+
+func TestDeleteCurrentUserHandler(t *testing.T) {
+	ts := newTestServer(t)
+	mailer := &mockMailer{}
+	ts.app.mailer = mailer
+
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+	})
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Missing current password",
+			requestUrlPath:         "/v1/users/me",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          map[string]string{"Authorization": "Bearer " + authToken},
+			requestBody:            `{}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"current_password": "must be provided",
+				},
+			},
+		},
+		{
+			name:                   "Incorrect current password",
+			requestUrlPath:         "/v1/users/me",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          map[string]string{"Authorization": "Bearer " + authToken},
+			requestBody:            `{"current_password":"wrongpa55word"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"current_password": "is incorrect",
+				},
+			},
+		},
+		{
+			name:                   "Delete account",
+			requestUrlPath:         "/v1/users/me",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          map[string]string{"Authorization": "Bearer " + authToken},
+			requestBody:            `{"current_password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusAccepted,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst struct {
+					Message string    `json:"message"`
+					PurgeAt time.Time `json:"purge_at"`
+				}
+				readJsonResponse(t, res.Body, &dst)
+				assert.Equal(t, "your account is scheduled for deletion", dst.Message)
+				assert.WithinDuration(t, time.Now().Add(30*24*time.Hour), dst.PurgeAt, 2*time.Second)
+
+				// The restore token is the only token left, and expires when the account is purged.
+				var scope string
+				var expiry time.Time
+				err := ts.db.QueryRow(context.Background(), "SELECT scope, expiry FROM tokens WHERE user_id = 1").Scan(&scope, &expiry)
+				require.NoError(t, err)
+				assert.Equal(t, "restore", scope)
+				assert.WithinDuration(t, dst.PurgeAt, expiry, time.Second)
+			},
+		},
+		{
+			name:                   "Authentication token no longer works",
+			requestUrlPath:         "/v1/users/me",
+			requestMethodType:      http.MethodGet,
+			requestHeader:          map[string]string{"Authorization": "Bearer " + authToken},
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse: errorResponse{
+				Error: "invalid or missing authentication token",
+			},
+		},
+		{
+			name:                   "Deleted user can't log in",
+			requestUrlPath:         "/v1/tokens/authentication",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"email":"alice@gmail.com", "password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusUnauthorized,
+			wantResponse: errorResponse{
+				Error: "invalid authentication credentials",
+			},
+		},
+		{
+			// The email address stays reserved until the account is purged, so that it can
+			// still be restored. Registering with it fails in the same way as for an account
+			// which isn't deleted, so the response doesn't reveal the deletion.
+			name:                   "Email address of a deleted user can't be registered",
+			requestUrlPath:         "/v1/users",
+			requestMethodType:      http.MethodPost,
+			requestBody:            `{"name":"Mallory", "email":"alice@gmail.com", "password":"5ecret1234"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"email": "a user with this email address already exists",
+				},
+			},
+		},
+	}
+
+	testHandler(t, ts, testcases...)
+
+	// wait for the user to get the account deletion email
+	time.Sleep(200 * time.Millisecond)
+	assert.True(t, mailer.SendInvoked)
+	assert.Equal(t, "alice@gmail.com", mailer.Recipient)
+	assert.Equal(t, "user_deletion.tmpl", mailer.TemplateFile)
+	restoreToken := mailer.TokenPlainText
+
+	testcases = []handlerTestcase{
+		{
+			name:                   "Invalid restore token",
+			requestBody:            `{"token":"H2NMASDASDASNFJADHSKJLFJHS"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"token": "invalid or expired restore token",
+				},
+			},
+		},
+		{
+			name:                   "Restore account",
+			requestBody:            fmt.Sprintf(`{"token":%q}`, restoreToken),
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "your account has been restored",
+			},
+		},
+		{
+			name:                   "Restore token can only be used once",
+			requestBody:            fmt.Sprintf(`{"token":%q}`, restoreToken),
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"token": "invalid or expired restore token",
+				},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodPut
+		tc.requestUrlPath = "/v1/users/restored"
+		testHandler(t, ts, tc)
+	}
+
+	ts.login(t, "alice@gmail.com", "pa55word1234", nil)
+}
+
+func TestPurgeDeletedUsers(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.insertUser(t, dummyUser{name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, permCodes: []string{"movies:write"}})
+	ts.insertUser(t, dummyUser{name: "Bob", email: "bob@gmail.com", password: "pa55word1234", activated: true})
+	ts.failLogin(t, "alice@gmail.com", 1)
+
+	_, err := ts.app.modelStore.Users.SoftDelete(1, 30*24*time.Hour)
+	require.NoError(t, err)
+
+	// Alice is still within the grace period.
+	n, err := ts.app.modelStore.Users.PurgeDeleted(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+
+	n, err = ts.app.modelStore.Users.PurgeDeleted(time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	var users, attempts int
+	err = ts.db.QueryRow(context.Background(), "SELECT count(*) FROM users").Scan(&users)
+	require.NoError(t, err)
+	assert.Equal(t, 1, users)
+
+	err = ts.db.QueryRow(context.Background(), "SELECT count(*) FROM login_attempts").Scan(&attempts)
+	require.NoError(t, err)
+	assert.Equal(t, 0, attempts)
+
+	_, err = ts.app.modelStore.Users.GetByEmail("bob@gmail.com")
+	assert.NoError(t, err)
+
+	// Once the account is purged, its email address can be registered again.
+	ts.app.mailer = &mockMailer{}
+	res, err := ts.executeRequest(http.MethodPost, "/v1/users", `{"name":"Alice", "email":"alice@gmail.com", "password":"5ecret1234"}`, nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	ts.app.wg.Wait()
+}
+
+func TestCurrentUserEndpoints_ShouldRequireAuthentication(t *testing.T) {
+	ts := newTestServer(t)
+
+	testcases := []handlerTestcase{
+		{name: "Show current user", requestMethodType: http.MethodGet},
+		{name: "Update current user", requestMethodType: http.MethodPatch},
+		{name: "Delete current user", requestMethodType: http.MethodDelete},
+	}
+
+	for _, tc := range testcases {
+		tc.requestUrlPath = "/v1/users/me"
+		tc.wantResponseStatusCode = http.StatusUnauthorized
+		tc.wantResponse = errorResponse{
+			Error: "you must be authenticated to access this resource",
+		}
+		testHandler(t, ts, tc)
+	}
+}
+
+func TestEmailChange_ValidRequest(t *testing.T) {
+	ts := newTestServer(t)
+	mailer := &mockMailer{}
+	ts.app.mailer = mailer
+
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+	})
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "Request email change",
+		requestUrlPath:         "/v1/users/me/email",
+		requestMethodType:      http.MethodPost,
+		requestBody:            `{"email":"alice@example.com", "password":"pa55word1234"}`,
+		requestHeader:          map[string]string{"Authorization": "Bearer " + authToken},
+		wantResponseStatusCode: http.StatusAccepted,
+		wantResponse: map[string]string{
+			"message": "an email will be sent to the new address containing confirmation instructions",
+		},
+	})
+
+	// wait for the user to get the confirmation email
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, "alice@example.com", mailer.Recipient)
+	assert.Equal(t, "token_email_change.tmpl", mailer.TemplateFile)
+
+	// The email address must not change until the new address has been confirmed.
+	u, err := ts.app.modelStore.Users.Get(1)
+	require.NoError(t, err)
+	assert.Equal(t, "alice@gmail.com", u.Email)
+
+	res, err := ts.executeRequest(http.MethodPut, "/v1/users/email", `{"token":"`+mailer.TokenPlainText+`"}`, nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	dst := &userResponse{}
+	readJsonResponse(t, res.Body, dst)
+	assert.Equal(t, "alice@example.com", dst.User.Email)
+	assert.True(t, dst.User.Activated)
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "Token cannot be reused",
+		requestUrlPath:         "/v1/users/email",
+		requestMethodType:      http.MethodPut,
+		requestBody:            `{"token":"` + mailer.TokenPlainText + `"}`,
+		wantResponseStatusCode: http.StatusUnprocessableEntity,
+		wantResponse: validationErrorResponse{
+			Error: map[string]string{
+				"token": "invalid or expired email change token",
+			},
+		},
+	})
+}
+
+func TestEmailChange_DuplicateEmailOnConfirm(t *testing.T) {
+	ts := newTestServer(t)
+	mailer := &mockMailer{}
+	ts.app.mailer = mailer
+
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+	})
+
+	res, err := ts.executeRequest(http.MethodPost, "/v1/users/me/email", `{"email":"bob@gmail.com", "password":"pa55word1234"}`,
+		map[string]string{"Authorization": "Bearer " + authToken})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, res.StatusCode)
+
+	// wait for the user to get the confirmation email
+	time.Sleep(200 * time.Millisecond)
+
+	// Another user registers with the pending address before it is confirmed.
+	ts.insertUser(t, dummyUser{name: "Bob", email: "bob@gmail.com", password: "pa55word1234"})
+
+	testHandler(t, ts, handlerTestcase{
+		name:                   "Duplicate email",
+		requestUrlPath:         "/v1/users/email",
+		requestMethodType:      http.MethodPut,
+		requestBody:            `{"token":"` + mailer.TokenPlainText + `"}`,
+		wantResponseStatusCode: http.StatusUnprocessableEntity,
+		wantResponse: validationErrorResponse{
+			Error: map[string]string{
+				"email": "a user with this email address already exists",
+			},
+		},
+	})
+}
+
+func TestEmailChange_InvalidRequest(t *testing.T) {
+	ts := newTestServer(t)
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234", activated: true, authenticated: true,
+	})
+	ts.insertUser(t, dummyUser{name: "Bob", email: "bob@gmail.com", password: "pa55word1234"})
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Invalid email",
+			requestBody:            `{"email":"alice", "password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"email": "must be a valid email address",
+				},
+			},
+		},
+		{
+			name:                   "Same email",
+			requestBody:            `{"email":"alice@gmail.com", "password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"email": "must be different from the current email address",
+				},
+			},
+		},
+		{
+			name:                   "Wrong password",
+			requestBody:            `{"email":"alice@example.com", "password":"wrongpa55word"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"password": "is incorrect",
+				},
+			},
+		},
+		{
+			name:                   "Email already taken",
+			requestBody:            `{"email":"bob@gmail.com", "password":"pa55word1234"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"email": "a user with this email address already exists",
+				},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestMethodType = http.MethodPost
+		tc.requestUrlPath = "/v1/users/me/email"
+		tc.requestHeader = map[string]string{"Authorization": "Bearer " + authToken}
+		testHandler(t, ts, tc)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type watchlistEntry struct {
+	Movie   movie     `json:"movie"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+type watchedEntry struct {
+	Movie     movie  `json:"movie"`
+	WatchedOn string `json:"watched_on"`
+}
+
+type listWatchlistResponse struct {
+	Watchlist          []watchlistEntry   `json:"watchlist"`
+	PaginationMetadata paginationMetadata `json:"metadata"`
+}
+
+type listWatchedResponse struct {
+	Watched            []watchedEntry     `json:"watched"`
+	PaginationMetadata paginationMetadata `json:"metadata"`
+}
+
+func TestWatchlistHandlers(t *testing.T) {
+	ts := newTestServer(t)
+	ts.insertMovie(t, "Die Hard", 1988, 207, []string{"Action", "Thriller"})
+	ts.insertMovie(t, "Heat", 1995, 170, []string{"Crime", "Thriller"})
+	ts.insertMovie(t, "Titanic", 1997, 196, []string{"Romance"})
+
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234",
+		activated: true, authenticated: true, permCodes: []string{"movies:read", "movies:write"},
+	})
+	authHeader := map[string]string{"Authorization": "Bearer " + authToken}
+
+	listWatchlist := func(t *testing.T, query string) listWatchlistResponse {
+		res, err := ts.executeRequest(http.MethodGet, "/v1/users/me/watchlist"+query, "", authHeader)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		var dst listWatchlistResponse
+		readJsonResponse(t, res.Body, &dst)
+		return dst
+	}
+
+	for _, id := range []string{"1", "2", "3", "2"} {
+		testHandler(t, ts, handlerTestcase{
+			name:                   "Add movie " + id,
+			requestUrlPath:         "/v1/users/me/watchlist/" + id,
+			requestMethodType:      http.MethodPut,
+			requestHeader:          authHeader,
+			wantResponseStatusCode: http.StatusOK,
+		})
+	}
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Add movie which does not exist",
+			requestUrlPath:         "/v1/users/me/watchlist/7",
+			requestMethodType:      http.MethodPut,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+		{
+			name:                   "Remove movie",
+			requestUrlPath:         "/v1/users/me/watchlist/3",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "movie removed from watchlist",
+			},
+		},
+		{
+			name:                   "Remove movie which is not on the watchlist",
+			requestUrlPath:         "/v1/users/me/watchlist/3",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+		{
+			name:                   "Invalid sort",
+			requestUrlPath:         "/v1/users/me/watchlist?sort=id",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"sort": "invalid sort value",
+				},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestHeader = authHeader
+		testHandler(t, ts, tc)
+	}
+
+	t.Run("List watchlist", func(t *testing.T) {
+		dst := listWatchlist(t, "?sort=title")
+		require.Len(t, dst.Watchlist, 2)
+		assert.Equal(t, newPaginationMetadata(1, 20, 2), dst.PaginationMetadata)
+		assert.Equal(t, "Die Hard", dst.Watchlist[0].Movie.Title)
+		assert.Equal(t, "Heat", dst.Watchlist[1].Movie.Title)
+		assert.WithinDuration(t, time.Now(), dst.Watchlist[0].AddedAt, 5*time.Second)
+	})
+
+	t.Run("Filter watchlist by genre", func(t *testing.T) {
+		dst := listWatchlist(t, "?genres=Crime")
+		require.Len(t, dst.Watchlist, 1)
+		assert.Equal(t, "Heat", dst.Watchlist[0].Movie.Title)
+	})
+
+	t.Run("Deleted movies are left out", func(t *testing.T) {
+		testHandler(t, ts, handlerTestcase{
+			name:                   "Delete movie",
+			requestUrlPath:         "/v1/movies/1",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          authHeader,
+			wantResponseStatusCode: http.StatusOK,
+		})
+
+		dst := listWatchlist(t, "")
+		require.Len(t, dst.Watchlist, 1)
+		assert.Equal(t, "Heat", dst.Watchlist[0].Movie.Title)
+
+		_, err := ts.app.modelStore.Movies.PurgeDeleted(time.Now().Add(time.Minute))
+		require.NoError(t, err)
+
+		testHandler(t, ts, handlerTestcase{
+			name:                   "Remove purged movie",
+			requestUrlPath:         "/v1/users/me/watchlist/1",
+			requestMethodType:      http.MethodDelete,
+			requestHeader:          authHeader,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		})
+	})
+}
+
+func TestWatchedHandlers(t *testing.T) {
+	ts := newTestServer(t)
+	ts.insertMovie(t, "Die Hard", 1988, 207, []string{"Action", "Thriller"})
+	ts.insertMovie(t, "Heat", 1995, 170, []string{"Crime", "Thriller"})
+
+	authToken := ts.insertUser(t, dummyUser{
+		name: "Alice", email: "alice@gmail.com", password: "pa55word1234",
+		activated: true, authenticated: true, permCodes: []string{"movies:read"},
+	})
+
+	today := time.Now().UTC().Format(time.DateOnly)
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format(time.DateOnly)
+
+	testcases := []handlerTestcase{
+		{
+			name:                   "Watched today",
+			requestUrlPath:         "/v1/users/me/watched/1",
+			requestMethodType:      http.MethodPut,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst struct {
+					WatchedEntry watchedEntry `json:"watched_entry"`
+				}
+				readJsonResponse(t, res.Body, &dst)
+
+				assert.Equal(t, "Die Hard", dst.WatchedEntry.Movie.Title)
+				assert.Equal(t, today, dst.WatchedEntry.WatchedOn)
+			},
+		},
+		{
+			name:                   "Watched on a given date",
+			requestUrlPath:         "/v1/users/me/watched/2",
+			requestMethodType:      http.MethodPut,
+			requestBody:            `{"watched_on": "2020-05-17"}`,
+			wantResponseStatusCode: http.StatusOK,
+		},
+		{
+			name:                   "Watched in the future",
+			requestUrlPath:         "/v1/users/me/watched/2",
+			requestMethodType:      http.MethodPut,
+			requestBody:            `{"watched_on": "` + tomorrow + `"}`,
+			wantResponseStatusCode: http.StatusUnprocessableEntity,
+			wantResponse: validationErrorResponse{
+				Error: map[string]string{
+					"watched_on": "must not be in the future",
+				},
+			},
+		},
+		{
+			name:                   "Invalid date",
+			requestUrlPath:         "/v1/users/me/watched/2",
+			requestMethodType:      http.MethodPut,
+			requestBody:            `{"watched_on": "17/05/2020"}`,
+			wantResponseStatusCode: http.StatusBadRequest,
+			wantResponse: errorResponse{
+				Error: "invalid date format, example valid value 2006-01-02",
+			},
+		},
+		{
+			name:                   "List watched",
+			requestUrlPath:         "/v1/users/me/watched",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst listWatchedResponse
+				readJsonResponse(t, res.Body, &dst)
+
+				require.Len(t, dst.Watched, 2)
+				assert.Equal(t, "Die Hard", dst.Watched[0].Movie.Title)
+				assert.Equal(t, "Heat", dst.Watched[1].Movie.Title)
+				assert.Equal(t, "2020-05-17", dst.Watched[1].WatchedOn)
+			},
+		},
+		{
+			name:                   "Filter watched by genre",
+			requestUrlPath:         "/v1/users/me/watched?genres=Action",
+			requestMethodType:      http.MethodGet,
+			wantResponseStatusCode: http.StatusOK,
+			additionalChecks: func(t *testing.T, res *http.Response) {
+				var dst listWatchedResponse
+				readJsonResponse(t, res.Body, &dst)
+
+				require.Len(t, dst.Watched, 1)
+				assert.Equal(t, "Die Hard", dst.Watched[0].Movie.Title)
+			},
+		},
+		{
+			name:                   "Remove watched",
+			requestUrlPath:         "/v1/users/me/watched/1",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusOK,
+			wantResponse: map[string]string{
+				"message": "movie removed from watched history",
+			},
+		},
+		{
+			name:                   "Remove watched which does not exist",
+			requestUrlPath:         "/v1/users/me/watched/1",
+			requestMethodType:      http.MethodDelete,
+			wantResponseStatusCode: http.StatusNotFound,
+			wantResponse:           notFoundResponse,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc.requestHeader = map[string]string{"Authorization": "Bearer " + authToken}
+		testHandler(t, ts, tc)
+	}
+}
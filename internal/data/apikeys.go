@@ -0,0 +1,241 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"github.com/96malhar/greenlight/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefixLength is the length of the public part of an API key, which identifies the
+// key without revealing its secret.
+const apiKeyPrefixLength = 8
+
+// APIKey represents a long-lived credential which belongs to a user and carries a subset
+// of their permissions. The plaintext key has the form "gl_<prefix>_<secret>" and is
+// only available when the key is created.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Prefix      string      `json:"prefix"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Expiry      *time.Time  `json:"expiry"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+}
+
+// IsExpired reports whether the key has an expiry time which has passed.
+func (k *APIKey) IsExpired() bool {
+	return k.Expiry != nil && !k.Expiry.After(time.Now())
+}
+
+// NewAPIKey generates a new API key for a specific user. The key is not stored.
+func NewAPIKey(userID int64, name string, permissions Permissions, expiry *time.Time) *APIKey {
+	prefix := strings.ToLower(rand.Text()[:apiKeyPrefixLength])
+	plaintext := "gl_" + prefix + "_" + rand.Text()
+
+	return &APIKey{
+		UserID:      userID,
+		Name:        name,
+		Prefix:      prefix,
+		Plaintext:   plaintext,
+		Hash:        HashTokenPlaintext(plaintext),
+		Permissions: permissions,
+		Expiry:      expiry,
+	}
+}
+
+// parseAPIKeyPlaintext returns the prefix of a plaintext API key, and false if the
+// plaintext isn't in the format generated by NewAPIKey.
+func parseAPIKeyPlaintext(plaintext string) (string, bool) {
+	rest, ok := strings.CutPrefix(plaintext, "gl_")
+	if !ok {
+		return "", false
+	}
+
+	prefix, secret, ok := strings.Cut(rest, "_")
+	if !ok || len(prefix) != apiKeyPrefixLength || len(secret) != 26 {
+		return "", false
+	}
+
+	return prefix, true
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+type APIKeyStore struct {
+	db *pgxpool.Pool
+}
+
+// Insert adds a new API key to the api_keys table.
+func (s APIKeyStore) Insert(key *APIKey) error {
+	query := `
+        INSERT INTO api_keys (user_id, name, prefix, hash, permissions, expiry)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id, created_at`
+
+	args := []any{key.UserID, key.Name, key.Prefix, key.Hash, []string(key.Permissions), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return s.db.QueryRow(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// GetAllForUser returns the API keys of a specific user, most recently created first.
+func (s APIKeyStore) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+        SELECT id, user_id, name, prefix, permissions, created_at, expiry, last_used_at
+        FROM api_keys
+        WHERE user_id = $1
+        ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]*APIKey, 0)
+
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			&key.Permissions,
+			&key.CreatedAt,
+			&key.Expiry,
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// DeleteForUser deletes a specific API key belonging to a specific user.
+// It returns a ErrRecordNotFound if the user has no such key.
+func (s APIKeyStore) DeleteForUser(id, userID int64) error {
+	query := `
+        DELETE FROM api_keys
+        WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := s.db.Exec(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteAllForUser deletes all the API keys of a specific user.
+func (s APIKeyStore) DeleteAllForUser(userID int64) error {
+	query := `
+        DELETE FROM api_keys
+        WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := s.db.Exec(ctx, query, userID)
+	return err
+}
+
+// GetForPlaintext fetches an unexpired API key and the user it belongs to for a specific
+// plaintext key. It returns a ErrRecordNotFound if no matching key is found.
+func (s APIKeyStore) GetForPlaintext(plaintext string) (*APIKey, *User, error) {
+	prefix, ok := parseAPIKeyPlaintext(plaintext)
+	if !ok {
+		return nil, nil, ErrRecordNotFound
+	}
+
+	query := `
+        SELECT api_keys.id, api_keys.user_id, api_keys.name, api_keys.prefix, api_keys.hash, api_keys.permissions,
+            api_keys.created_at, api_keys.expiry, api_keys.last_used_at,
+            users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.disabled_at, users.version
+        FROM api_keys
+        INNER JOIN users ON users.id = api_keys.user_id
+        WHERE api_keys.prefix = $1 AND users.deleted_at IS NULL`
+
+	var (
+		key  APIKey
+		user User
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, prefix).Scan(
+		&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.Hash, &key.Permissions,
+		&key.CreatedAt, &key.Expiry, &key.LastUsedAt,
+		&user.ID, &user.CreatedAt, &user.Name, &user.Email, &user.Password.hash, &user.Activated, &user.DisabledAt, &user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	// The prefix is only an identifier, so the whole key is compared in constant time.
+	if subtle.ConstantTimeCompare(key.Hash, HashTokenPlaintext(plaintext)) != 1 || key.IsExpired() {
+		return nil, nil, ErrRecordNotFound
+	}
+
+	return &key, &user, nil
+}
+
+// UpdateLastUsed records the time at which a specific API key was last used.
+func (s APIKeyStore) UpdateLastUsed(id int64, lastUsedAt time.Time) error {
+	query := `
+        UPDATE api_keys
+        SET last_used_at = $1
+        WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := s.db.Exec(ctx, query, lastUsedAt, id)
+	return err
+}
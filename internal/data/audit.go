@@ -0,0 +1,213 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"reflect"
+	"time"
+)
+
+// The actions recorded in the audit log.
+const (
+	AuditMovieCreate          = "movie.create"
+	AuditMovieUpdate          = "movie.update"
+	AuditMovieDelete          = "movie.delete"
+	AuditMovieRestore         = "movie.restore"
+	AuditMovieUndelete        = "movie.undelete"
+	AuditUserLogin            = "user.login"
+	AuditUserLoginFailed      = "user.login_failed"
+	AuditUserLogout           = "user.logout"
+	AuditUserLogoutAll        = "user.logout_all"
+	AuditUserActivate         = "user.activate"
+	AuditUserDeactivate       = "user.deactivate"
+	AuditUserExpireTokens     = "user.expire_tokens"
+	AuditUserUnlock           = "user.unlock"
+	AuditUserDisableTwoFactor = "user.2fa.disable"
+	AuditUserChangePassword   = "user.password.change"
+	AuditUserResetPassword    = "user.password.reset"
+	AuditUserDelete           = "user.delete"
+	AuditUserRestore          = "user.restore"
+	AuditPermissionsGrant     = "user.permissions.grant"
+	AuditPermissionsRevoke    = "user.permissions.revoke"
+	AuditAPIKeyCreate         = "api_key.create"
+	AuditAPIKeyDelete         = "api_key.delete"
+)
+
+// The types of records which audit events are about.
+const (
+	AuditTargetMovie  = "movie"
+	AuditTargetUser   = "user"
+	AuditTargetAPIKey = "api_key"
+)
+
+// AuditEvent records who did what to which record, and from where. The actor is nil for
+// events caused by anonymous clients, such as failed logins, and for users who have since
+// been purged.
+type AuditEvent struct {
+	ID         int64                  `json:"id"`
+	CreatedAt  time.Time              `json:"created_at"`
+	ActorID    *int64                 `json:"actor_id"`
+	Action     string                 `json:"action"`
+	TargetType string                 `json:"target_type"`
+	TargetID   *int64                 `json:"target_id"`
+	ClientIP   string                 `json:"client_ip"`
+	RequestID  string                 `json:"request_id"`
+	Changes    map[string]AuditChange `json:"changes,omitempty"`
+}
+
+// AuditChange holds the value of a field before and after a change. The before value of
+// a field of a created record is nil, as is the after value of a field of a deleted one.
+type AuditChange struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+// NewAuditEvent returns an event for an action on a specific record.
+func NewAuditEvent(action, targetType string, targetID int64) *AuditEvent {
+	return &AuditEvent{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   &targetID,
+	}
+}
+
+// AuditChanges returns the fields which differ between two versions of a record, keyed by
+// the names of the fields in their JSON representation. Either version can be nil, for
+// records which were created or deleted.
+func AuditChanges(before, after any) (map[string]AuditChange, error) {
+	beforeFields, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+
+	afterFields, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]AuditChange)
+
+	for name, value := range beforeFields {
+		if !reflect.DeepEqual(value, afterFields[name]) {
+			changes[name] = AuditChange{Before: value, After: afterFields[name]}
+		}
+	}
+
+	for name, value := range afterFields {
+		if _, ok := beforeFields[name]; !ok {
+			changes[name] = AuditChange{After: value}
+		}
+	}
+
+	return changes, nil
+}
+
+// auditFields returns the fields of the JSON representation of a record.
+func auditFields(record any) (map[string]any, error) {
+	if record == nil {
+		return nil, nil
+	}
+
+	js, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]any
+
+	err = json.Unmarshal(js, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("audit record is not a JSON object: %w", err)
+	}
+
+	return fields, nil
+}
+
+// AuditFilter selects audit events. The zero value of a field matches every event.
+type AuditFilter struct {
+	ActorID    int64
+	Action     string
+	TargetType string
+	TargetID   int64
+}
+
+type AuditStore struct {
+	db *pgxpool.Pool
+}
+
+// Insert adds a new event to the audit_events table.
+func (s AuditStore) Insert(event *AuditEvent) error {
+	query := `
+        INSERT INTO audit_events (actor_id, action, target_type, target_id, client_ip, request_id, changes)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING id, created_at`
+
+	var changes any
+	if len(event.Changes) > 0 {
+		changes = event.Changes
+	}
+
+	args := []any{event.ActorID, event.Action, event.TargetType, event.TargetID, event.ClientIP, event.RequestID, changes}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return s.db.QueryRow(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// GetAll returns the audit events which match the filter.
+func (s AuditStore) GetAll(filter AuditFilter, filters Filters) ([]*AuditEvent, PaginationMetadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, created_at, actor_id, action, target_type, target_id, client_ip, request_id, changes
+        FROM audit_events
+        WHERE (actor_id = $1 OR $1 = 0)
+        AND (action = $2 OR $2 = '')
+        AND (target_type = $3 OR $3 = '')
+        AND (target_id = $4 OR $4 = 0)
+        ORDER BY %s %s, id DESC
+        LIMIT $5 OFFSET $6`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{filter.ActorID, filter.Action, filter.TargetType, filter.TargetID, filters.limit(), filters.offset()}
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := make([]*AuditEvent, 0)
+
+	for rows.Next() {
+		var event AuditEvent
+
+		err := rows.Scan(
+			&totalRecords,
+			&event.ID,
+			&event.CreatedAt,
+			&event.ActorID,
+			&event.Action,
+			&event.TargetType,
+			&event.TargetID,
+			&event.ClientIP,
+			&event.RequestID,
+			&event.Changes,
+		)
+		if err != nil {
+			return nil, PaginationMetadata{}, err
+		}
+		events = append(events, &event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+
+	metadata := calculatePaginationMetadata(totalRecords, filters.Page, filters.PageSize)
+	return events, metadata, nil
+}
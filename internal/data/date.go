@@ -0,0 +1,55 @@
+package data
+
+import (
+	"errors"
+	"github.com/jackc/pgx/v5/pgtype"
+	"strconv"
+	"time"
+)
+
+// Date is a calendar date, without a time of day. It's written in JSON as YYYY-MM-DD.
+type Date struct {
+	time.Time
+}
+
+var ErrInvalidDateFormat = errors.New("invalid date format, example valid value 2006-01-02")
+
+// Today returns the current date in UTC.
+func Today() Date {
+	year, month, day := time.Now().UTC().Date()
+	return Date{time.Date(year, month, day, 0, 0, 0, 0, time.UTC)}
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.Format(time.DateOnly))), nil
+}
+
+func (d *Date) UnmarshalJSON(jsonValue []byte) error {
+	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
+	if err != nil {
+		return ErrInvalidDateFormat
+	}
+
+	t, err := time.Parse(time.DateOnly, unquotedJSONValue)
+	if err != nil {
+		return ErrInvalidDateFormat
+	}
+
+	d.Time = t
+	return nil
+}
+
+// ScanDate lets pgx read a date column into a Date.
+func (d *Date) ScanDate(v pgtype.Date) error {
+	if !v.Valid {
+		return errors.New("cannot scan NULL into *data.Date")
+	}
+
+	d.Time = v.Time
+	return nil
+}
+
+// DateValue lets pgx write a Date to a date column.
+func (d Date) DateValue() (pgtype.Date, error) {
+	return pgtype.Date{Time: d.Time, Valid: true}, nil
+}
@@ -0,0 +1,249 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/96malhar/greenlight/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// Invitation lets a specific email address register a user account, which is activated
+// right away and granted the permissions of the invitation. The plaintext token is only
+// available when the invitation is created, and is sent to the invitee by email.
+type Invitation struct {
+	ID          int64       `json:"id"`
+	Email       string      `json:"email"`
+	Permissions Permissions `json:"permissions"`
+	InvitedBy   *int64      `json:"invited_by"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Expiry      time.Time   `json:"expiry"`
+	Plaintext   string      `json:"-"`
+	Hash        []byte      `json:"-"`
+}
+
+// NewInvitation generates a new invitation for an email address. The invitation is not stored.
+func NewInvitation(email string, permissions Permissions, invitedBy int64, expiry time.Time) *Invitation {
+	plaintext := rand.Text()
+
+	return &Invitation{
+		Email:       email,
+		Permissions: permissions,
+		InvitedBy:   &invitedBy,
+		Expiry:      expiry,
+		Plaintext:   plaintext,
+		Hash:        HashTokenPlaintext(plaintext),
+	}
+}
+
+func ValidateInvitation(v *validator.Validator, invitation *Invitation) {
+	ValidateEmail(v, invitation.Email)
+
+	v.Check(validator.Unique(invitation.Permissions), "permissions", "must not contain duplicate values")
+
+	v.Check(invitation.Expiry.After(time.Now()), "expiry", "must be in the future")
+	v.Check(invitation.Expiry.Before(time.Now().Add(90*24*time.Hour)), "expiry", "must not be more than 90 days in the future")
+}
+
+type InvitationStore struct {
+	db *pgxpool.Pool
+}
+
+// Insert adds a new invitation to the invitations table.
+func (s InvitationStore) Insert(invitation *Invitation) error {
+	query := `
+        INSERT INTO invitations (email, hash, permissions, invited_by, expiry)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, created_at`
+
+	args := []any{invitation.Email, invitation.Hash, []string(invitation.Permissions), invitation.InvitedBy, invitation.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return s.db.QueryRow(ctx, query, args...).Scan(&invitation.ID, &invitation.CreatedAt)
+}
+
+// GetForToken fetches the unexpired invitation for a specific plaintext token.
+// It returns a ErrRecordNotFound if no matching invitation is found.
+func (s InvitationStore) GetForToken(tokenPlaintext string) (*Invitation, error) {
+	query := `
+        SELECT id, email, permissions, invited_by, created_at, expiry
+        FROM invitations
+        WHERE hash = $1 AND expiry > $2`
+
+	var invitation Invitation
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, HashTokenPlaintext(tokenPlaintext), time.Now().UTC()).Scan(
+		&invitation.ID,
+		&invitation.Email,
+		&invitation.Permissions,
+		&invitation.InvitedBy,
+		&invitation.CreatedAt,
+		&invitation.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &invitation, nil
+}
+
+// Accept registers a new user with a specific invitation. The user is inserted, granted
+// the default role and the permissions of the invitation, and the invitation is deleted,
+// all in one transaction, so that either all of it happens or none of it does. The
+// invitation is locked first, so that it can only be accepted once even if it is used
+// concurrently. The default role is left out if it is empty.
+//
+// It returns a ErrRecordNotFound if the invitation doesn't exist or has expired, and a
+// ErrDuplicateEmail if a user already has the email address.
+func (s InvitationStore) Accept(id int64, user *User, defaultRole string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+        SELECT permissions
+        FROM invitations
+        WHERE id = $1 AND expiry > $2
+        FOR UPDATE`
+
+	var permissions Permissions
+
+	err = tx.QueryRow(ctx, query, id, time.Now().UTC()).Scan(&permissions)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	query = `
+        INSERT INTO users (name, email, created_at, password_hash, activated)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, created_at, version`
+
+	args := []any{user.Name, user.Email, time.Now().UTC(), user.Password.hash, user.Activated}
+
+	err = tx.QueryRow(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err, "users_email_key"):
+			return ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+
+	if defaultRole != "" {
+		query = `
+            INSERT INTO users_roles
+            SELECT $1, roles.id FROM roles WHERE roles.name = $2
+            ON CONFLICT DO NOTHING`
+
+		_, err = tx.Exec(ctx, query, user.ID, defaultRole)
+		if err != nil {
+			return err
+		}
+	}
+
+	query = `
+        INSERT INTO users_permissions
+        SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+        ON CONFLICT DO NOTHING`
+
+	_, err = tx.Exec(ctx, query, user.ID, []string(permissions))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM invitations WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetAllPending returns the invitations which haven't been used or expired yet, most
+// recently created first.
+func (s InvitationStore) GetAllPending() ([]*Invitation, error) {
+	query := `
+        SELECT id, email, permissions, invited_by, created_at, expiry
+        FROM invitations
+        WHERE expiry > $1
+        ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := s.db.Query(ctx, query, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := make([]*Invitation, 0)
+
+	for rows.Next() {
+		var invitation Invitation
+
+		err := rows.Scan(
+			&invitation.ID,
+			&invitation.Email,
+			&invitation.Permissions,
+			&invitation.InvitedBy,
+			&invitation.CreatedAt,
+			&invitation.Expiry,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		invitations = append(invitations, &invitation)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+// Delete deletes a specific invitation, so that it can't be used any more.
+// It returns a ErrRecordNotFound if the invitation doesn't exist.
+func (s InvitationStore) Delete(id int64) error {
+	query := `
+        DELETE FROM invitations
+        WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := s.db.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,471 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/96malhar/greenlight/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+var (
+	ErrUnknownMovie     = errors.New("unknown movie")
+	ErrInvalidListOrder = errors.New("invalid list order")
+)
+
+// List is an ordered collection of movies made by a user. Private lists can only be seen
+// by their owners. Movies in the trash are left out of lists until they're restored.
+type List struct {
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	UserID      int64     `json:"user_id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitzero"`
+	Public      bool      `json:"public"`
+	MovieCount  int32     `json:"movie_count"`
+	MovieIDs    []int64   `json:"movie_ids,omitempty"`
+	Version     int32     `json:"version"`
+}
+
+// ListItem is a movie on a list, at a position counting from 1.
+type ListItem struct {
+	Position int32     `json:"position"`
+	AddedAt  time.Time `json:"added_at"`
+	Movie    *Movie    `json:"movie"`
+}
+
+// ValidateList validates the provided list.
+func ValidateList(v *validator.Validator, list *List) {
+	v.Check(list.Title != "", "title", "must be provided")
+	v.Check(len(list.Title) <= 500, "title", "must not be more than 500 bytes long")
+
+	v.Check(len(list.Description) <= 10_000, "description", "must not be more than 10000 bytes long")
+}
+
+// ValidateListMovieIDs validates the ids of movies to add to a list, or to order a list by.
+func ValidateListMovieIDs(v *validator.Validator, movieIDs []int64) {
+	v.Check(len(movieIDs) >= 1, "movie_ids", "must contain at least 1 movie")
+	v.Check(len(movieIDs) <= 1000, "movie_ids", "must not contain more than 1000 movies")
+	v.Check(validator.Unique(movieIDs), "movie_ids", "must not contain duplicate values")
+}
+
+// listMovieCount counts the movies on a list which aren't in the trash.
+const listMovieCount = `
+        (SELECT count(*)
+         FROM list_items
+         INNER JOIN movies ON movies.id = list_items.movie_id
+         WHERE list_items.list_id = lists.id AND movies.deleted_at IS NULL)::integer`
+
+type ListStore struct {
+	db *pgxpool.Pool
+}
+
+// Insert adds a new record in the lists table.
+func (s ListStore) Insert(list *List) error {
+	query := `
+        INSERT INTO lists (user_id, title, description, public)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at, updated_at, version`
+
+	args := []any{list.UserID, list.Title, list.Description, list.Public}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return s.db.QueryRow(ctx, query, args...).Scan(&list.ID, &list.CreatedAt, &list.UpdatedAt, &list.Version)
+}
+
+// Get fetches a specific record from the lists table. Lists of users whose accounts are
+// scheduled for deletion aren't found.
+func (s ListStore) Get(id int64) (*List, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+        SELECT id, created_at, updated_at, user_id, title, description, public, ` + listMovieCount + `, version
+        FROM lists
+        WHERE id = $1
+        AND user_id IN (SELECT id FROM users WHERE deleted_at IS NULL)`
+
+	var list List
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, id).Scan(
+		&list.ID, &list.CreatedAt,
+		&list.UpdatedAt, &list.UserID,
+		&list.Title, &list.Description,
+		&list.Public, &list.MovieCount, &list.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &list, nil
+}
+
+// Update a specific record in the lists table.
+func (s ListStore) Update(list *List) error {
+	query := `
+        UPDATE lists
+        SET title = $1, description = $2, public = $3, updated_at = NOW(), version = version + 1
+        WHERE id = $4 AND version = $5
+        RETURNING updated_at, version`
+
+	args := []any{list.Title, list.Description, list.Public, list.ID, list.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, args...).Scan(&list.UpdatedAt, &list.Version)
+
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return ErrEditConflict
+	default:
+		return err
+	}
+}
+
+// Delete a specific record from the lists table, along with its movies.
+func (s ListStore) Delete(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := s.db.Exec(ctx, `DELETE FROM lists WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetAll returns the lists which a user can see: the public lists, and their own. The
+// ownerID and title parameters act as filters, if they're provided.
+func (s ListStore) GetAll(viewerID, ownerID int64, title string, filters Filters) ([]*List, PaginationMetadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, created_at, updated_at, user_id, title, description, public, %s, version
+        FROM lists
+        WHERE (public OR user_id = $1)
+        AND (user_id = $2 OR $2 = 0)
+        AND (to_tsvector('simple', title) @@ plainto_tsquery('simple', $3) OR $3 = '')
+        AND user_id IN (SELECT id FROM users WHERE deleted_at IS NULL)
+        ORDER BY %s %s, id ASC
+        LIMIT $4 OFFSET $5`, listMovieCount, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{viewerID, ownerID, title, filters.limit(), filters.offset()}
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	lists := make([]*List, 0)
+
+	for rows.Next() {
+		var list List
+
+		err := rows.Scan(
+			&totalRecords,
+			&list.ID,
+			&list.CreatedAt,
+			&list.UpdatedAt,
+			&list.UserID,
+			&list.Title,
+			&list.Description,
+			&list.Public,
+			&list.MovieCount,
+			&list.Version,
+		)
+		if err != nil {
+			return nil, PaginationMetadata{}, err
+		}
+		lists = append(lists, &list)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+
+	metadata := calculatePaginationMetadata(totalRecords, filters.Page, filters.PageSize)
+	return lists, metadata, nil
+}
+
+// GetAllForUser returns all the lists made by a specific user, along with the ids of their
+// movies in order.
+func (s ListStore) GetAllForUser(userID int64) ([]*List, error) {
+	query := `
+        SELECT id, created_at, updated_at, user_id, title, description, public, version,
+               ARRAY(SELECT movie_id FROM list_items WHERE list_id = lists.id ORDER BY position)
+        FROM lists
+        WHERE user_id = $1
+        ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lists := make([]*List, 0)
+
+	for rows.Next() {
+		var list List
+
+		err := rows.Scan(
+			&list.ID,
+			&list.CreatedAt,
+			&list.UpdatedAt,
+			&list.UserID,
+			&list.Title,
+			&list.Description,
+			&list.Public,
+			&list.Version,
+			&list.MovieIDs,
+		)
+		if err != nil {
+			return nil, err
+		}
+		list.MovieCount = int32(len(list.MovieIDs))
+		lists = append(lists, &list)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return lists, nil
+}
+
+// GetItems returns the movies on a specific list. Their positions are numbered from 1
+// without gaps, even where movies were removed or are in the trash.
+func (s ListStore) GetItems(listID int64, filters Filters) ([]*ListItem, PaginationMetadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), (row_number() OVER (ORDER BY position))::integer AS position, added_at, id, created_at, title, year, runtime, genres, average_rating, rating_count, version
+        FROM list_items
+        INNER JOIN movies ON movies.id = list_items.movie_id %s
+        WHERE list_id = $1 AND deleted_at IS NULL
+        ORDER BY %s %s, position ASC
+        LIMIT $2 OFFSET $3`, movieRatings, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := s.db.Query(ctx, query, listID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	items := make([]*ListItem, 0)
+
+	for rows.Next() {
+		var movie Movie
+		item := ListItem{Movie: &movie}
+
+		err := rows.Scan(
+			&totalRecords,
+			&item.Position,
+			&item.AddedAt,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.Genres,
+			&movie.AverageRating,
+			&movie.RatingCount,
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, PaginationMetadata{}, err
+		}
+		items = append(items, &item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+
+	metadata := calculatePaginationMetadata(totalRecords, filters.Page, filters.PageSize)
+	return items, metadata, nil
+}
+
+// AddMovies appends movies to the end of a specific list, in the given order. Movies which
+// are on the list already stay where they are. It returns ErrUnknownMovie if any of the
+// movies doesn't exist.
+func (s ListStore) AddMovies(listID int64, movieIDs []int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the list, so that movies added at the same time don't share positions.
+	var position int32
+
+	query := `
+        SELECT COALESCE((SELECT max(position) FROM list_items WHERE list_id = lists.id), 0)
+        FROM lists
+        WHERE id = $1
+        FOR UPDATE`
+
+	err = tx.QueryRow(ctx, query, listID).Scan(&position)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	var found int
+
+	err = tx.QueryRow(ctx, `SELECT count(*) FROM movies WHERE id = ANY($1) AND deleted_at IS NULL`, movieIDs).Scan(&found)
+	if err != nil {
+		return err
+	}
+
+	if found != len(movieIDs) {
+		return ErrUnknownMovie
+	}
+
+	query = `
+        INSERT INTO list_items (list_id, movie_id, position)
+        SELECT $1, movie_id, $3 + ordinality
+        FROM unnest($2::bigint[]) WITH ORDINALITY AS ids (movie_id, ordinality)
+        ON CONFLICT (list_id, movie_id) DO NOTHING`
+
+	_, err = tx.Exec(ctx, query, listID, movieIDs, position)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE lists SET updated_at = NOW() WHERE id = $1`, listID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// RemoveMovie takes a movie off a specific list. It returns ErrRecordNotFound if the
+// movie isn't on the list.
+func (s ListStore) RemoveMovie(listID, movieID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx, `DELETE FROM list_items WHERE list_id = $1 AND movie_id = $2`, listID, movieID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE lists SET updated_at = NOW() WHERE id = $1`, listID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Reorder moves the movies on a specific list into the given order. The movieIDs must
+// contain every movie on the list which isn't in the trash, or it returns
+// ErrInvalidListOrder. Movies in the trash are moved to the end of the list.
+func (s ListStore) Reorder(listID int64, movieIDs []int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `SELECT id FROM lists WHERE id = $1 FOR UPDATE`, listID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        SELECT count(*), count(*) FILTER (WHERE movie_id = ANY($2))
+        FROM list_items
+        INNER JOIN movies ON movies.id = list_items.movie_id
+        WHERE list_id = $1 AND deleted_at IS NULL`
+
+	var total, matched int
+
+	err = tx.QueryRow(ctx, query, listID, movieIDs).Scan(&total, &matched)
+	if err != nil {
+		return err
+	}
+
+	if total != len(movieIDs) || matched != len(movieIDs) {
+		return ErrInvalidListOrder
+	}
+
+	// Number the movies in the trash after the others, keeping their relative order.
+	query = `
+        UPDATE list_items
+        SET position = $3 + position
+        WHERE list_id = $1 AND NOT (movie_id = ANY($2))`
+
+	_, err = tx.Exec(ctx, query, listID, movieIDs, len(movieIDs))
+	if err != nil {
+		return err
+	}
+
+	query = `
+        UPDATE list_items
+        SET position = ids.ordinality
+        FROM unnest($2::bigint[]) WITH ORDINALITY AS ids (movie_id, ordinality)
+        WHERE list_items.list_id = $1 AND list_items.movie_id = ids.movie_id`
+
+	_, err = tx.Exec(ctx, query, listID, movieIDs)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE lists SET updated_at = NOW() WHERE id = $1`, listID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
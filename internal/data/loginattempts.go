@@ -0,0 +1,200 @@
+package data
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// LoginAttempt records the recent failed login attempts for an email address. Attempts
+// are tracked by email address rather than by user, so that addresses which don't belong
+// to any user are treated in exactly the same way.
+type LoginAttempt struct {
+	Email        string
+	FailedCount  int
+	LastFailedAt time.Time
+	LockedUntil  *time.Time
+}
+
+// LoginThrottle limits how quickly logins with an email address can be attempted after
+// they have failed.
+type LoginThrottle struct {
+	// FreeAttempts is the number of consecutive failed attempts which are allowed before
+	// further attempts are delayed.
+	FreeAttempts int
+	// BackoffBase is the delay imposed after the first failed attempt beyond FreeAttempts.
+	// The delay doubles with every further failure.
+	BackoffBase time.Duration
+	// Threshold is the number of consecutive failed attempts which lock the address.
+	Threshold int
+	// LockoutDuration is how long a locked address stays locked. Failures which are older
+	// than that are forgotten.
+	LockoutDuration time.Duration
+}
+
+// RetryAfter returns how long a client has to wait before it may attempt to log in again,
+// or zero if it may try right away.
+func (t LoginThrottle) RetryAfter(attempt *LoginAttempt, now time.Time) time.Duration {
+	if attempt.LockedUntil != nil && now.Before(*attempt.LockedUntil) {
+		return attempt.LockedUntil.Sub(now)
+	}
+
+	if attempt.LastFailedAt.Before(now.Add(-t.LockoutDuration)) {
+		return 0
+	}
+
+	// The attempt which reached the threshold is still being checked, and locks the
+	// address if it fails.
+	if attempt.FailedCount >= t.Threshold {
+		return t.LockoutDuration
+	}
+
+	if attempt.FailedCount <= t.FreeAttempts {
+		return 0
+	}
+
+	// Cap the exponent so that the shift can't overflow; the delay is capped by the
+	// lockout duration long before that anyway.
+	exponent := min(attempt.FailedCount-t.FreeAttempts-1, 30)
+	backoff := min(t.BackoffBase<<exponent, t.LockoutDuration)
+
+	return max(attempt.LastFailedAt.Add(backoff).Sub(now), 0)
+}
+
+type LoginAttemptStore struct {
+	db *pgxpool.Pool
+}
+
+// Claim records an attempt to log in with a specific email address before the credentials
+// are checked, so that concurrent attempts can't all get past the throttle before any of
+// them has failed. The attempt counts as a failure until it is either released with Release
+// or forgotten with Delete. The record for the address is locked while the attempt is
+// claimed, and the updated record is returned.
+//
+// If the throttle doesn't allow an attempt yet, nothing is recorded, and Claim returns
+// the current record together with how long the client has to wait.
+func (s LoginAttemptStore) Claim(email string, now time.Time, throttle LoginThrottle) (*LoginAttempt, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+        INSERT INTO login_attempts (email, failed_count, last_failed_at)
+        VALUES ($1, 0, $2)
+        ON CONFLICT (email) DO NOTHING`
+
+	_, err = tx.Exec(ctx, query, email, now)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query = `
+        SELECT email, failed_count, last_failed_at, locked_until
+        FROM login_attempts
+        WHERE email = $1
+        FOR UPDATE`
+
+	var attempt LoginAttempt
+
+	err = tx.QueryRow(ctx, query, email).Scan(&attempt.Email, &attempt.FailedCount, &attempt.LastFailedAt, &attempt.LockedUntil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if retryAfter := throttle.RetryAfter(&attempt, now); retryAfter > 0 {
+		return &attempt, retryAfter, nil
+	}
+
+	// Failures which happened more than a lockout ago are forgotten, so that the count
+	// starts again from one.
+	if attempt.LastFailedAt.Before(now.Add(-throttle.LockoutDuration)) {
+		attempt.FailedCount = 0
+	}
+
+	query = `
+        UPDATE login_attempts
+        SET failed_count = $2, last_failed_at = $3
+        WHERE email = $1
+        RETURNING failed_count, last_failed_at, locked_until`
+
+	err = tx.QueryRow(ctx, query, email, attempt.FailedCount+1, now).Scan(&attempt.FailedCount, &attempt.LastFailedAt, &attempt.LockedUntil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &attempt, 0, nil
+}
+
+// Release undoes a claimed attempt for a specific email address which didn't fail, without
+// forgetting the failures before it.
+func (s LoginAttemptStore) Release(email string) error {
+	query := `
+        UPDATE login_attempts
+        SET failed_count = GREATEST(failed_count - 1, 0)
+        WHERE email = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := s.db.Exec(ctx, query, email)
+	return err
+}
+
+// Lock prevents logins with a specific email address until the given time. The failed
+// attempt count is reset, so that the address starts afresh once the lock expires.
+func (s LoginAttemptStore) Lock(email string, until time.Time) error {
+	query := `
+        UPDATE login_attempts
+        SET failed_count = 0, locked_until = $2
+        WHERE email = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := s.db.Exec(ctx, query, email, until)
+	return err
+}
+
+// Delete forgets the failed login attempts for a specific email address, unlocking it.
+func (s LoginAttemptStore) Delete(email string) error {
+	query := `
+        DELETE FROM login_attempts
+        WHERE email = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := s.db.Exec(ctx, query, email)
+	return err
+}
+
+// PurgeStale removes the records of the email addresses which haven't failed to log in
+// for longer than the lockout duration and which aren't locked, and returns how many were
+// removed. Those records would be ignored by Claim anyway, so removing them forgets
+// nothing, and addresses which belong to no user don't pile up.
+func (s LoginAttemptStore) PurgeStale(now time.Time, lockoutDuration time.Duration) (int64, error) {
+	query := `
+        DELETE FROM login_attempts
+        WHERE last_failed_at < $1
+        AND (locked_until IS NULL OR locked_until <= $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := s.db.Exec(ctx, query, now.Add(-lockoutDuration), now)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected(), nil
+}
@@ -11,13 +11,17 @@ import (
 )
 
 type Movie struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitzero"`
-	Runtime   Runtime   `json:"runtime,omitzero"`
-	Genres    []string  `json:"genres,omitzero"`
-	Version   int32     `json:"version"`
+	ID            int64      `json:"id"`
+	CreatedAt     time.Time  `json:"-"`
+	Title         string     `json:"title"`
+	Year          int32      `json:"year,omitzero"`
+	Runtime       Runtime    `json:"runtime,omitzero"`
+	Genres        []string   `json:"genres,omitzero"`
+	AverageRating float64    `json:"average_rating"`
+	RatingCount   int32      `json:"rating_count"`
+	Version       int32      `json:"version"`
+	DeletedAt     *time.Time `json:"deleted_at,omitzero"`
+	Credits       []*Credit  `json:"credits,omitempty"`
 }
 
 // ValidateMovie validates the provided movie.
@@ -38,12 +42,23 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
 }
 
+// movieRatings is a join which adds the average rating of each movie, and how many ratings
+// it has, to a query of the movies table. Ratings by users whose accounts are scheduled
+// for deletion are left out.
+const movieRatings = `
+        LEFT JOIN LATERAL (
+            SELECT COALESCE(round(avg(rating), 1), 0)::float8 AS average_rating, count(*)::integer AS rating_count
+            FROM reviews
+            WHERE reviews.movie_id = movies.id
+            AND reviews.user_id IN (SELECT id FROM users WHERE deleted_at IS NULL)
+        ) ratings ON true`
+
 // MovieStore wraps a sql.DB connection pool.
 type MovieStore struct {
 	db *pgxpool.Pool
 }
 
-// Insert adds a new record in the movies table.
+// Insert adds a new record in the movies table, along with its first revision.
 func (m MovieStore) Insert(movie *Movie) error {
 	query := `
         INSERT INTO movies (title, year, runtime, genres) 
@@ -55,7 +70,23 @@ func (m MovieStore) Insert(movie *Movie) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	return m.db.QueryRow(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	tx, err := m.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	if err != nil {
+		return err
+	}
+
+	err = insertRevision(ctx, tx, movie, movie.Version, RevisionInsert)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
 
 // Get fetches a record for a movie based on the id
@@ -65,9 +96,9 @@ func (m MovieStore) Get(id int64) (*Movie, error) {
 	}
 
 	query := `
-        SELECT id, created_at, title, year, runtime, genres, version
-        FROM movies
-        WHERE id = $1`
+        SELECT id, created_at, title, year, runtime, genres, average_rating, rating_count, version
+        FROM movies` + movieRatings + `
+        WHERE id = $1 AND deleted_at IS NULL`
 
 	var movie Movie
 
@@ -77,7 +108,8 @@ func (m MovieStore) Get(id int64) (*Movie, error) {
 	err := m.db.QueryRow(ctx, query, id).Scan(
 		&movie.ID, &movie.CreatedAt,
 		&movie.Title, &movie.Year,
-		&movie.Runtime, &movie.Genres, &movie.Version,
+		&movie.Runtime, &movie.Genres,
+		&movie.AverageRating, &movie.RatingCount, &movie.Version,
 	)
 
 	if err != nil {
@@ -92,12 +124,12 @@ func (m MovieStore) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-// Update a specific record in the movies table.
+// Update a specific record in the movies table, and records its new revision.
 func (m MovieStore) Update(movie *Movie) error {
 	query := `
         UPDATE movies 
         SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-        WHERE id = $5 AND version = $6
+        WHERE id = $5 AND version = $6 AND deleted_at IS NULL
         RETURNING version`
 
 	args := []any{movie.Title, movie.Year, movie.Runtime, movie.Genres, movie.ID, movie.Version}
@@ -105,59 +137,216 @@ func (m MovieStore) Update(movie *Movie) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.db.QueryRow(ctx, query, args...).Scan(&movie.Version)
+	tx, err := m.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, query, args...).Scan(&movie.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
 
-	switch {
-	case errors.Is(err, pgx.ErrNoRows):
-		return ErrEditConflict
-	default:
+	err = insertRevision(ctx, tx, movie, movie.Version, RevisionUpdate)
+	if err != nil {
 		return err
 	}
+
+	return tx.Commit(ctx)
 }
 
-// Delete a specific record from the movies table.
+// Delete moves a specific movie to the trash. The movie is kept, along with a revision of
+// it as it was when deleted, until it's restored or purged.
 func (m MovieStore) Delete(id int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `
-        DELETE FROM movies
-        WHERE id = $1`
+        UPDATE movies
+        SET deleted_at = NOW(), version = version + 1
+        WHERE id = $1 AND deleted_at IS NULL
+        RETURNING id, title, year, runtime, genres, version`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	result, err := m.db.Exec(ctx, query, id)
+	tx, err := m.db.Begin(ctx)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback(ctx)
 
-	rowsAffected := result.RowsAffected()
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	var movie Movie
+
+	err = tx.QueryRow(ctx, query, id).Scan(
+		&movie.ID, &movie.Title,
+		&movie.Year, &movie.Runtime,
+		&movie.Genres, &movie.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	err = insertRevision(ctx, tx, &movie, movie.Version, RevisionDelete)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Restore takes a specific movie out of the trash, and records its new revision. It
+// returns a ErrRecordNotFound if there is no such deleted movie.
+func (m MovieStore) Restore(id int64) (*Movie, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+        UPDATE movies
+        SET deleted_at = NULL, version = version + 1
+        WHERE id = $1 AND deleted_at IS NOT NULL
+        RETURNING id, created_at, title, year, runtime, genres, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var movie Movie
+
+	err = tx.QueryRow(ctx, query, id).Scan(
+		&movie.ID, &movie.CreatedAt,
+		&movie.Title, &movie.Year,
+		&movie.Runtime, &movie.Genres, &movie.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = insertRevision(ctx, tx, &movie, movie.Version, RevisionRestore)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+        SELECT average_rating, rating_count
+        FROM movies` + movieRatings + `
+        WHERE id = $1`
+
+	err = tx.QueryRow(ctx, query, id).Scan(&movie.AverageRating, &movie.RatingCount)
+	if err != nil {
+		return nil, err
+	}
+
+	return &movie, tx.Commit(ctx)
+}
+
+// GetAllDeleted returns the movies in the trash.
+func (m MovieStore) GetAllDeleted(filters Filters) ([]*Movie, PaginationMetadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, average_rating, rating_count, version, deleted_at
+        FROM movies %s
+        WHERE deleted_at IS NOT NULL
+        ORDER BY %s %s, id ASC
+        LIMIT $1 OFFSET $2`, movieRatings, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.db.Query(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	movies := make([]*Movie, 0)
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.Genres,
+			&movie.AverageRating,
+			&movie.RatingCount,
+			&movie.Version,
+			&movie.DeletedAt,
+		)
+		if err != nil {
+			return nil, PaginationMetadata{}, err
+		}
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+
+	metadata := calculatePaginationMetadata(totalRecords, filters.Page, filters.PageSize)
+	return movies, metadata, nil
+}
+
+// PurgeDeleted permanently removes the movies which were moved to the trash before the
+// given time, and returns how many were removed. Their revisions are kept.
+func (m MovieStore) PurgeDeleted(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.db.Exec(ctx, `DELETE FROM movies WHERE deleted_at <= $1`, before)
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
+	return result.RowsAffected(), nil
 }
 
-// GetAll returns all movies from the movies table. The title and genres parameters act as filters.
-// If these string parameters are provided then the results will only include movies that match them.
-func (m MovieStore) GetAll(title string, genres []string, filters Filters) ([]*Movie, PaginationMetadata, error) {
+// GetAll returns all movies from the movies table. The title, genres and personID parameters act as filters.
+// If these parameters are provided then the results will only include movies that match them.
+func (m MovieStore) GetAll(title string, genres []string, personID int64, filters Filters) ([]*Movie, PaginationMetadata, error) {
 	// Update the SQL query to include the window function which counts the total
 	// (filtered) records.
 	query := fmt.Sprintf(`
-        SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
-        FROM movies
+        SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, average_rating, rating_count, version
+        FROM movies %s
         WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
         AND (genres @> $2 OR $2 = '{}')     
+        AND (id IN (SELECT movie_id FROM movie_credits WHERE person_id = $3) OR $3 = 0)
+        AND deleted_at IS NULL
         ORDER BY %s %s, id ASC
-        LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+        LIMIT $4 OFFSET $5`, movieRatings, filters.sortColumn(), filters.sortDirection())
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []any{title, genres, filters.limit(), filters.offset()}
+	args := []any{title, genres, personID, filters.limit(), filters.offset()}
 
 	rows, err := m.db.Query(ctx, query, args...)
 	if err != nil {
@@ -180,6 +369,8 @@ func (m MovieStore) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Year,
 			&movie.Runtime,
 			&movie.Genres,
+			&movie.AverageRating,
+			&movie.RatingCount,
 			&movie.Version,
 		)
 		if err != nil {
@@ -0,0 +1,159 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// OIDCLogin holds the secrets of an OpenID Connect login which is in progress, from the
+// moment the user is sent to the provider until they are redirected back with an
+// authorization code. It is identified by the random state parameter of the login.
+type OIDCLogin struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	Expiry       time.Time
+}
+
+// Identity is an identity at an OpenID Connect provider which is linked to a user.
+type Identity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OIDCStore struct {
+	db *pgxpool.Pool
+}
+
+// InsertLogin stores a new login which is in progress. Only the hash of the state is
+// stored. Logins which have expired without being completed are deleted at the same time.
+func (s OIDCStore) InsertLogin(login *OIDCLogin) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := s.db.Exec(ctx, `DELETE FROM oidc_logins WHERE expiry < $1`, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	query := `
+        INSERT INTO oidc_logins (state_hash, nonce, code_verifier, expiry)
+        VALUES ($1, $2, $3, $4)`
+
+	_, err = s.db.Exec(ctx, query, HashTokenPlaintext(login.State), login.Nonce, login.CodeVerifier, login.Expiry)
+	return err
+}
+
+// ConsumeLogin deletes the unexpired login with a specific state and returns it, so that
+// each login can only be completed once.
+// It returns a ErrRecordNotFound if no matching login is found.
+func (s OIDCStore) ConsumeLogin(state string) (*OIDCLogin, error) {
+	query := `
+        DELETE FROM oidc_logins
+        WHERE state_hash = $1 AND expiry > $2
+        RETURNING nonce, code_verifier, expiry`
+
+	login := OIDCLogin{State: state}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, HashTokenPlaintext(state), time.Now().UTC()).Scan(&login.Nonce, &login.CodeVerifier, &login.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &login, nil
+}
+
+// GetUserForIdentity returns the user who is linked to a specific identity at a provider.
+// It returns a ErrRecordNotFound if no user is linked to the identity.
+func (s OIDCStore) GetUserForIdentity(issuer, subject string) (*User, error) {
+	query := `
+        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.disabled_at, users.version
+        FROM users
+        INNER JOIN user_identities ON user_identities.user_id = users.id
+        WHERE user_identities.issuer = $1 AND user_identities.subject = $2 AND users.deleted_at IS NULL`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, issuer, subject).Scan(
+		&user.ID, &user.CreatedAt, &user.Name,
+		&user.Email, &user.Password.hash, &user.Activated,
+		&user.DisabledAt, &user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// LinkIdentity links an identity at a provider to a specific user, so that the user is
+// found by the identity on later logins even if their email address changes.
+func (s OIDCStore) LinkIdentity(userID int64, issuer, subject string) error {
+	query := `
+        INSERT INTO user_identities (issuer, subject, user_id)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (issuer, subject) DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := s.db.Exec(ctx, query, issuer, subject, userID)
+	return err
+}
+
+// GetIdentitiesForUser returns the identities which are linked to a specific user, in the
+// order they were linked.
+func (s OIDCStore) GetIdentitiesForUser(userID int64) ([]*Identity, error) {
+	query := `
+        SELECT issuer, subject, created_at
+        FROM user_identities
+        WHERE user_id = $1
+        ORDER BY created_at, issuer, subject`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := make([]*Identity, 0)
+
+	for rows.Next() {
+		var identity Identity
+
+		err := rows.Scan(&identity.Issuer, &identity.Subject, &identity.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, &identity)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
@@ -0,0 +1,122 @@
+package data
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/96malhar/greenlight/internal/validator"
+	"os"
+	"strings"
+)
+
+// BreachedPasswords is a list of passwords known to have been compromised, such as the
+// Pwned Passwords corpus. Only the SHA-1 hashes of the passwords are kept, indexed by the
+// first five hex digits of the hash in the same way as the k-anonymity range API.
+type BreachedPasswords struct {
+	ranges map[string]map[string]struct{}
+	count  int
+}
+
+// LoadBreachedPasswords reads a list of breached passwords from a file. Each line holds
+// the hex encoded SHA-1 hash of a password, optionally followed by a colon and the number
+// of times it was seen (which is ignored), as in the downloadable Pwned Passwords files.
+// Blank lines and lines starting with # are skipped.
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list := &BreachedPasswords{ranges: make(map[string]map[string]struct{})}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		hash, _, _ := strings.Cut(line, ":")
+		hash = strings.ToUpper(hash)
+
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha1.Size {
+			return nil, fmt.Errorf("%s:%d: invalid SHA-1 hash %q", path, n, hash)
+		}
+
+		prefix, suffix := hash[:5], hash[5:]
+		if list.ranges[prefix] == nil {
+			list.ranges[prefix] = make(map[string]struct{})
+		}
+		if _, exists := list.ranges[prefix][suffix]; !exists {
+			list.ranges[prefix][suffix] = struct{}{}
+			list.count++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// Contains returns true if the plaintext password is in the list.
+func (b *BreachedPasswords) Contains(plaintextPassword string) bool {
+	sum := sha1.Sum([]byte(plaintextPassword))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	_, found := b.ranges[hash[:5]][hash[5:]]
+	return found
+}
+
+// Len returns the number of passwords in the list.
+func (b *BreachedPasswords) Len() int {
+	return b.count
+}
+
+// PasswordPolicy holds the rules which new passwords have to follow, on top of the length
+// limits checked by ValidatePasswordPlaintext.
+type PasswordPolicy struct {
+	// MinEntropy is the minimum entropy of a password in bits, as estimated by
+	// validator.Entropy.
+	MinEntropy float64
+	// Breached is the list of compromised passwords which can't be used, or nil.
+	Breached *BreachedPasswords
+}
+
+// DefaultPasswordPolicy only requires a minimum entropy, since there is no breached
+// password list to check against until one is loaded.
+var DefaultPasswordPolicy = PasswordPolicy{MinEntropy: 40}
+
+// ValidatePasswordStrength checks a new password against a PasswordPolicy. It rejects
+// passwords which are in the breached password list, which contain the name or email
+// address of the user, or which are too easy to guess. It isn't used when logging in, so
+// that users can still log in with passwords set before the policy was introduced.
+func ValidatePasswordStrength(v *validator.Validator, policy PasswordPolicy, password, name, email string) {
+	if policy.Breached != nil {
+		v.Check(!policy.Breached.Contains(password), "password", "must not be a password which has appeared in a data breach")
+	}
+
+	v.Check(!containsPersonalInfo(password, name, email), "password", "must not contain your name or email address")
+
+	v.Check(validator.Entropy(password) >= policy.MinEntropy, "password", "is too easy to guess, use a longer password with a mix of letters, digits and symbols")
+}
+
+// containsPersonalInfo returns true if the password contains any part of the name of the
+// user, or the part of their email address before the @, ignoring case. Parts shorter than
+// three characters are ignored, since they are too likely to appear by chance.
+func containsPersonalInfo(password, name, email string) bool {
+	password = strings.ToLower(password)
+
+	localPart, _, _ := strings.Cut(email, "@")
+	parts := append(strings.Fields(name), localPart)
+
+	for _, part := range parts {
+		if len([]rune(part)) >= 3 && strings.Contains(password, strings.ToLower(part)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,316 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/96malhar/greenlight/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+var (
+	ErrDuplicateCredit = errors.New("duplicate credit")
+	ErrUnknownPerson   = errors.New("unknown person")
+)
+
+// The roles which people can be credited with on a movie.
+const (
+	CreditDirector = "director"
+	CreditWriter   = "writer"
+	CreditActor    = "actor"
+)
+
+// Person is someone who is credited with working on movies.
+type Person struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	Name      string    `json:"name"`
+	Bio       string    `json:"bio,omitzero"`
+	Version   int32     `json:"version"`
+}
+
+// ValidatePerson validates the provided person.
+func ValidatePerson(v *validator.Validator, person *Person) {
+	v.Check(person.Name != "", "name", "must be provided")
+	v.Check(len(person.Name) <= 500, "name", "must not be more than 500 bytes long")
+
+	v.Check(len(person.Bio) <= 10_000, "bio", "must not be more than 10000 bytes long")
+}
+
+// Credit records the role of a person on a movie. Actors can be credited with the
+// character they play, and are listed in billing order.
+type Credit struct {
+	ID           int64  `json:"id"`
+	MovieID      int64  `json:"movie_id"`
+	PersonID     int64  `json:"person_id"`
+	Name         string `json:"name"`
+	Role         string `json:"role"`
+	Character    string `json:"character,omitzero"`
+	BillingOrder int32  `json:"billing_order"`
+}
+
+// ValidateCredit validates the provided credit.
+func ValidateCredit(v *validator.Validator, credit *Credit) {
+	v.Check(credit.PersonID != 0, "person_id", "must be provided")
+	v.Check(credit.PersonID >= 0, "person_id", "must be a positive integer")
+
+	v.Check(credit.Role != "", "role", "must be provided")
+	v.Check(validator.PermittedValue(credit.Role, CreditDirector, CreditWriter, CreditActor), "role", "must be one of director, writer or actor")
+
+	v.Check(credit.Character == "" || credit.Role == CreditActor, "character", "must only be provided for actors")
+	v.Check(len(credit.Character) <= 500, "character", "must not be more than 500 bytes long")
+
+	v.Check(credit.BillingOrder >= 0, "billing_order", "must not be negative")
+}
+
+type PersonStore struct {
+	db *pgxpool.Pool
+}
+
+// Insert adds a new record in the people table.
+func (s PersonStore) Insert(person *Person) error {
+	query := `
+        INSERT INTO people (name, bio)
+        VALUES ($1, $2)
+        RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return s.db.QueryRow(ctx, query, person.Name, person.Bio).Scan(&person.ID, &person.CreatedAt, &person.Version)
+}
+
+// Get fetches a specific record from the people table.
+func (s PersonStore) Get(id int64) (*Person, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+        SELECT id, created_at, name, bio, version
+        FROM people
+        WHERE id = $1`
+
+	var person Person
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, id).Scan(&person.ID, &person.CreatedAt, &person.Name, &person.Bio, &person.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &person, nil
+}
+
+// Update a specific record in the people table.
+func (s PersonStore) Update(person *Person) error {
+	query := `
+        UPDATE people
+        SET name = $1, bio = $2, version = version + 1
+        WHERE id = $3 AND version = $4
+        RETURNING version`
+
+	args := []any{person.Name, person.Bio, person.ID, person.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, args...).Scan(&person.Version)
+
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return ErrEditConflict
+	default:
+		return err
+	}
+}
+
+// Delete a specific record from the people table, along with their credits.
+func (s PersonStore) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := s.db.Exec(ctx, `DELETE FROM people WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetAll returns the people whose names match the name parameter, or everyone if it's empty.
+func (s PersonStore) GetAll(name string, filters Filters) ([]*Person, PaginationMetadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, created_at, name, bio, version
+        FROM people
+        WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')
+        ORDER BY %s %s, id ASC
+        LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := s.db.Query(ctx, query, name, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	people := make([]*Person, 0)
+
+	for rows.Next() {
+		var person Person
+
+		err := rows.Scan(
+			&totalRecords,
+			&person.ID,
+			&person.CreatedAt,
+			&person.Name,
+			&person.Bio,
+			&person.Version,
+		)
+		if err != nil {
+			return nil, PaginationMetadata{}, err
+		}
+		people = append(people, &person)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+
+	metadata := calculatePaginationMetadata(totalRecords, filters.Page, filters.PageSize)
+	return people, metadata, nil
+}
+
+type CreditStore struct {
+	db *pgxpool.Pool
+}
+
+// Insert adds a new record in the movie_credits table. It returns ErrDuplicateCredit if
+// the person already has the same credit on the movie, and ErrUnknownPerson if the person
+// doesn't exist.
+func (s CreditStore) Insert(credit *Credit) error {
+	query := `
+        INSERT INTO movie_credits (movie_id, person_id, role, character_name, billing_order)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, (SELECT name FROM people WHERE id = $2)`
+
+	args := []any{credit.MovieID, credit.PersonID, credit.Role, credit.Character, credit.BillingOrder}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, args...).Scan(&credit.ID, &credit.Name)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err, "movie_credits_movie_id_person_id_role_character_name_key"):
+			return ErrDuplicateCredit
+		case isForeignKeyViolation(err, "movie_credits_person_id_fkey"):
+			return ErrUnknownPerson
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete a specific credit of a movie.
+func (s CreditStore) Delete(movieID, id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := s.db.Exec(ctx, `DELETE FROM movie_credits WHERE movie_id = $1 AND id = $2`, movieID, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetAllForMovie returns the credits of a specific movie, with directors first, then
+// writers, then actors in billing order.
+func (s CreditStore) GetAllForMovie(movieID int64) ([]*Credit, error) {
+	query := `
+        SELECT movie_credits.id, movie_id, person_id, name, role, character_name, billing_order
+        FROM movie_credits
+        INNER JOIN people ON people.id = movie_credits.person_id
+        WHERE movie_id = $1
+        ORDER BY array_position(ARRAY['director', 'writer', 'actor'], role), billing_order, movie_credits.id`
+
+	return s.getAll(query, movieID)
+}
+
+// GetAllForPerson returns the credits of a specific person, on movies which aren't in the
+// trash.
+func (s CreditStore) GetAllForPerson(personID int64) ([]*Credit, error) {
+	query := `
+        SELECT movie_credits.id, movie_id, person_id, name, role, character_name, billing_order
+        FROM movie_credits
+        INNER JOIN people ON people.id = movie_credits.person_id
+        INNER JOIN movies ON movies.id = movie_credits.movie_id
+        WHERE person_id = $1 AND deleted_at IS NULL
+        ORDER BY year DESC, movie_credits.id`
+
+	return s.getAll(query, personID)
+}
+
+func (s CreditStore) getAll(query string, id int64) ([]*Credit, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := s.db.Query(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credits := make([]*Credit, 0)
+
+	for rows.Next() {
+		var credit Credit
+
+		err := rows.Scan(
+			&credit.ID,
+			&credit.MovieID,
+			&credit.PersonID,
+			&credit.Name,
+			&credit.Role,
+			&credit.Character,
+			&credit.BillingOrder,
+		)
+		if err != nil {
+			return nil, err
+		}
+		credits = append(credits, &credit)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return credits, nil
+}
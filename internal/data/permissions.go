@@ -25,13 +25,21 @@ type PermissionStore struct {
 }
 
 // GetAllForUser returns all permission codes for a specific user in a Permissions slice.
+// These are the codes granted to the user directly together with the codes bundled by
+// the roles of the user.
 func (s PermissionStore) GetAllForUser(userID int64) (Permissions, error) {
 	query := `
         SELECT permissions.code
         FROM permissions
         INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-        INNER JOIN users ON users_permissions.user_id = users.id
-        WHERE users.id = $1`
+        WHERE users_permissions.user_id = $1
+        UNION
+        SELECT permissions.code
+        FROM permissions
+        INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+        INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+        WHERE users_roles.user_id = $1
+        ORDER BY code`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -42,7 +50,42 @@ func (s PermissionStore) GetAllForUser(userID int64) (Permissions, error) {
 	}
 	defer rows.Close()
 
-	var permissions Permissions
+	permissions := make(Permissions, 0)
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// GetAll returns all permission codes.
+func (s PermissionStore) GetAll() (Permissions, error) {
+	query := `
+        SELECT code
+        FROM permissions
+        ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := s.db.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := make(Permissions, 0)
 
 	for rows.Next() {
 		var permission string
@@ -61,11 +104,28 @@ func (s PermissionStore) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
-// AddForUser adds one or more permission codes for a specific user.
+// AddForUser adds one or more permission codes for a specific user. Codes which the user
+// already has are ignored.
 func (s PermissionStore) AddForUser(userID int64, codes ...string) error {
 	query := `
         INSERT INTO users_permissions
-        SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+        SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+        ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := s.db.Exec(ctx, query, userID, codes)
+	return err
+}
+
+// RemoveForUser removes one or more permission codes which were granted to a specific
+// user directly. Permissions bundled by the roles of the user are not affected.
+func (s PermissionStore) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+        DELETE FROM users_permissions
+        WHERE user_id = $1
+        AND permission_id IN (SELECT id FROM permissions WHERE code = ANY($2))`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -0,0 +1,233 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/96malhar/greenlight/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+var (
+	ErrDuplicateReview = errors.New("duplicate review")
+)
+
+// Review is a rating of a movie by a user, out of 10, with an optional written review.
+// A user can review each movie only once.
+type Review struct {
+	ID        int64     `json:"id"`
+	MovieID   int64     `json:"movie_id"`
+	UserID    int64     `json:"user_id"`
+	Rating    int32     `json:"rating"`
+	Body      string    `json:"body,omitzero"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Version   int32     `json:"version"`
+}
+
+// ValidateReview validates the provided review.
+func ValidateReview(v *validator.Validator, review *Review) {
+	v.Check(review.Rating != 0, "rating", "must be provided")
+	v.Check(review.Rating >= 1 && review.Rating <= 10, "rating", "must be between 1 and 10")
+
+	v.Check(len(review.Body) <= 10_000, "body", "must not be more than 10000 bytes long")
+}
+
+type ReviewStore struct {
+	db *pgxpool.Pool
+}
+
+// Insert adds a new record in the reviews table. It returns ErrDuplicateReview if the user
+// has already reviewed the movie.
+func (s ReviewStore) Insert(review *Review) error {
+	query := `
+        INSERT INTO reviews (movie_id, user_id, rating, body)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at, updated_at, version`
+
+	args := []any{review.MovieID, review.UserID, review.Rating, review.Body}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, args...).Scan(&review.ID, &review.CreatedAt, &review.UpdatedAt, &review.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err, "reviews_movie_id_user_id_key"):
+			return ErrDuplicateReview
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetForUser returns the review of a specific movie by a specific user.
+func (s ReviewStore) GetForUser(movieID, userID int64) (*Review, error) {
+	query := `
+        SELECT id, movie_id, user_id, rating, body, created_at, updated_at, version
+        FROM reviews
+        WHERE movie_id = $1 AND user_id = $2`
+
+	var review Review
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, movieID, userID).Scan(
+		&review.ID, &review.MovieID,
+		&review.UserID, &review.Rating,
+		&review.Body, &review.CreatedAt,
+		&review.UpdatedAt, &review.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &review, nil
+}
+
+// Update a specific record in the reviews table.
+func (s ReviewStore) Update(review *Review) error {
+	query := `
+        UPDATE reviews
+        SET rating = $1, body = $2, updated_at = NOW(), version = version + 1
+        WHERE id = $3 AND version = $4
+        RETURNING updated_at, version`
+
+	args := []any{review.Rating, review.Body, review.ID, review.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, args...).Scan(&review.UpdatedAt, &review.Version)
+
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return ErrEditConflict
+	default:
+		return err
+	}
+}
+
+// Delete a specific record from the reviews table.
+func (s ReviewStore) Delete(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := s.db.Exec(ctx, `DELETE FROM reviews WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetAllForMovie returns the reviews of a specific movie. Reviews by users whose accounts
+// are scheduled for deletion are left out.
+func (s ReviewStore) GetAllForMovie(movieID int64, filters Filters) ([]*Review, PaginationMetadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, movie_id, user_id, rating, body, created_at, updated_at, version
+        FROM reviews
+        WHERE movie_id = $1
+        AND user_id IN (SELECT id FROM users WHERE deleted_at IS NULL)
+        ORDER BY %s %s, id ASC
+        LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := s.db.Query(ctx, query, movieID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	reviews := make([]*Review, 0)
+
+	for rows.Next() {
+		var review Review
+
+		err := rows.Scan(
+			&totalRecords,
+			&review.ID,
+			&review.MovieID,
+			&review.UserID,
+			&review.Rating,
+			&review.Body,
+			&review.CreatedAt,
+			&review.UpdatedAt,
+			&review.Version,
+		)
+		if err != nil {
+			return nil, PaginationMetadata{}, err
+		}
+		reviews = append(reviews, &review)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+
+	metadata := calculatePaginationMetadata(totalRecords, filters.Page, filters.PageSize)
+	return reviews, metadata, nil
+}
+
+// GetAllForUser returns all the reviews written by a specific user, including those of
+// movies in the trash.
+func (s ReviewStore) GetAllForUser(userID int64) ([]*Review, error) {
+	query := `
+        SELECT id, movie_id, user_id, rating, body, created_at, updated_at, version
+        FROM reviews
+        WHERE user_id = $1
+        ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reviews := make([]*Review, 0)
+
+	for rows.Next() {
+		var review Review
+
+		err := rows.Scan(
+			&review.ID,
+			&review.MovieID,
+			&review.UserID,
+			&review.Rating,
+			&review.Body,
+			&review.CreatedAt,
+			&review.UpdatedAt,
+			&review.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, &review)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reviews, nil
+}
@@ -0,0 +1,124 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+// The operations which create movie revisions.
+const (
+	RevisionInsert  = "insert"
+	RevisionUpdate  = "update"
+	RevisionDelete  = "delete"
+	RevisionRestore = "restore"
+)
+
+// MovieRevision is a snapshot of a movie as it was at a specific version. A revision is
+// written every time a movie is inserted, updated, deleted or restored, so the history of
+// a movie is kept even after it's purged.
+type MovieRevision struct {
+	MovieID   int64     `json:"movie_id"`
+	Version   int32     `json:"version"`
+	Operation string    `json:"operation"`
+	CreatedAt time.Time `json:"created_at"`
+	Title     string    `json:"title"`
+	Year      int32     `json:"year,omitzero"`
+	Runtime   Runtime   `json:"runtime,omitzero"`
+	Genres    []string  `json:"genres,omitzero"`
+}
+
+// insertRevision writes a snapshot of a movie to the movie_revisions table, in the same
+// transaction as the change to the movie.
+func insertRevision(ctx context.Context, tx pgx.Tx, movie *Movie, version int32, operation string) error {
+	query := `
+        INSERT INTO movie_revisions (movie_id, version, operation, title, year, runtime, genres)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	args := []any{movie.ID, version, operation, movie.Title, movie.Year, movie.Runtime, movie.Genres}
+
+	_, err := tx.Exec(ctx, query, args...)
+	return err
+}
+
+// GetRevisions returns the revisions of a specific movie, including movies which have
+// been deleted.
+func (m MovieStore) GetRevisions(movieID int64, filters Filters) ([]*MovieRevision, PaginationMetadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), movie_id, version, operation, created_at, title, year, runtime, genres
+        FROM movie_revisions
+        WHERE movie_id = $1
+        ORDER BY %s %s
+        LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.db.Query(ctx, query, movieID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	revisions := make([]*MovieRevision, 0)
+
+	for rows.Next() {
+		var revision MovieRevision
+
+		err := rows.Scan(
+			&totalRecords,
+			&revision.MovieID,
+			&revision.Version,
+			&revision.Operation,
+			&revision.CreatedAt,
+			&revision.Title,
+			&revision.Year,
+			&revision.Runtime,
+			&revision.Genres,
+		)
+		if err != nil {
+			return nil, PaginationMetadata{}, err
+		}
+		revisions = append(revisions, &revision)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+
+	metadata := calculatePaginationMetadata(totalRecords, filters.Page, filters.PageSize)
+	return revisions, metadata, nil
+}
+
+// GetRevision returns a specific version of a movie.
+func (m MovieStore) GetRevision(movieID int64, version int32) (*MovieRevision, error) {
+	query := `
+        SELECT movie_id, version, operation, created_at, title, year, runtime, genres
+        FROM movie_revisions
+        WHERE movie_id = $1 AND version = $2`
+
+	var revision MovieRevision
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.db.QueryRow(ctx, query, movieID, version).Scan(
+		&revision.MovieID, &revision.Version,
+		&revision.Operation, &revision.CreatedAt,
+		&revision.Title, &revision.Year,
+		&revision.Runtime, &revision.Genres,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &revision, nil
+}
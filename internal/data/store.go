@@ -2,6 +2,8 @@ package data
 
 import (
 	"errors"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"time"
 )
@@ -11,6 +13,18 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// isUniqueViolation reports whether err was caused by a violation of the named unique constraint.
+func isUniqueViolation(err error, constraintName string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation && pgErr.ConstraintName == constraintName
+}
+
+// isForeignKeyViolation reports whether err was caused by a violation of the named foreign key constraint.
+func isForeignKeyViolation(err error, constraintName string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation && pgErr.ConstraintName == constraintName
+}
+
 type MovieStoreInterface interface {
 	// Insert a new record into the movies table.
 	Insert(movie *Movie) error
@@ -18,30 +32,74 @@ type MovieStoreInterface interface {
 	Get(id int64) (*Movie, error)
 	// Update a specific record in the movies table.
 	Update(movie *Movie) error
-	// Delete a specific record from the movies table.
+	// Delete moves a specific movie to the trash.
 	Delete(id int64) error
+	// Restore takes a specific movie out of the trash.
+	Restore(id int64) (*Movie, error)
+	// GetAllDeleted returns the movies in the trash.
+	GetAllDeleted(filters Filters) ([]*Movie, PaginationMetadata, error)
+	// PurgeDeleted permanently removes the movies which were moved to the trash before a given time.
+	PurgeDeleted(before time.Time) (int64, error)
 	// GetAll returns all movies from the movies table.
-	GetAll(title string, genres []string, filters Filters) ([]*Movie, PaginationMetadata, error)
+	GetAll(title string, genres []string, personID int64, filters Filters) ([]*Movie, PaginationMetadata, error)
+	// GetRevisions returns the revisions of a specific movie.
+	GetRevisions(movieID int64, filters Filters) ([]*MovieRevision, PaginationMetadata, error)
+	// GetRevision returns a specific revision of a movie.
+	GetRevision(movieID int64, version int32) (*MovieRevision, error)
 }
 
 type UserStoreInterface interface {
 	// Insert a new record into the users table.
 	Insert(user *User) error
+	// Get returns a specific record from the users table.
+	Get(id int64) (*User, error)
+	// GetAll returns the users matching a search term and activation state.
+	GetAll(search string, activated *bool, filters Filters) ([]*User, PaginationMetadata, error)
 	// GetByEmail returns a specific record from the users table.
 	GetByEmail(email string) (*User, error)
 	// Update a specific record in the users table.
 	Update(user *User) error
+	// Delete a specific record from the users table.
+	Delete(id int64) error
+	// SetPendingEmail stores an email address that is awaiting confirmation for a specific user.
+	SetPendingEmail(userID int64, email string) error
+	// ConfirmPendingEmail replaces the email address of a user with their pending email address.
+	ConfirmPendingEmail(user *User) error
 	// GetForToken retrieves a user record based on the token scope and plaintext token value.
 	GetForToken(tokenScope, tokenPlaintext string) (*User, error)
+	// SoftDelete marks a specific user as deleted, revokes all of their tokens and issues a restore token.
+	SoftDelete(id int64, gracePeriod time.Duration) (*Token, error)
+	// Restore undoes the soft deletion of a specific user.
+	Restore(id int64) error
+	// PurgeDeleted permanently removes the users who were soft deleted before a specific time.
+	PurgeDeleted(before time.Time) (int64, error)
 }
 
 type TokenStoreInterface interface {
 	// New generates and stores a new token for a specific user and scope.
 	New(userID int64, ttl time.Duration, scope string) (*Token, error)
+	// NewSession generates and stores a new token for a specific user and scope as part of a token family.
+	NewSession(userID int64, ttl time.Duration, scope, family string, info SessionInfo) (*Token, error)
 	// Insert adds the data for a specific token to the tokens table.
 	Insert(token *Token) error
 	// DeleteAllForUser deletes all tokens for a specific user having a specific scope.
 	DeleteAllForUser(scope string, userID int64) error
+	// DeleteByHash deletes the token with a specific hash and the rest of its token family.
+	DeleteByHash(hash []byte) error
+	// GetAllSessionsForUser returns the active sessions of a specific user.
+	GetAllSessionsForUser(userID int64) ([]*Session, error)
+	// DeleteSessionForUser deletes all the tokens of a specific session of a specific user.
+	DeleteSessionForUser(id, userID int64) error
+	// DeleteFamilyForUser deletes all the tokens of a specific token family of a specific user.
+	DeleteFamilyForUser(family string, userID int64) error
+	// UpdateLastUsed records the time at which a token and its session were last used.
+	UpdateLastUsed(hash []byte, lastUsedAt time.Time) error
+	// GetFamilyByHash returns the token family of the token with a specific hash.
+	GetFamilyByHash(hash []byte) (string, error)
+	// Reissue replaces the tokens for a specific user and scope with a new one, unless the last of them was issued too recently.
+	Reissue(userID int64, ttl time.Duration, scope string, minInterval time.Duration) (*Token, time.Duration, error)
+	// Rotate exchanges a refresh token for a new refresh token in the same token family.
+	Rotate(tokenPlaintext string, ttl time.Duration, info SessionInfo) (*Token, error)
 }
 
 type PermissionStoreInterface interface {
@@ -49,20 +107,221 @@ type PermissionStoreInterface interface {
 	GetAllForUser(userID int64) (Permissions, error)
 	// AddForUser adds new permissions for a specific user.
 	AddForUser(userID int64, codes ...string) error
+	// GetAll returns all permission codes.
+	GetAll() (Permissions, error)
+	// RemoveForUser removes permissions which were granted to a specific user directly.
+	RemoveForUser(userID int64, codes ...string) error
+}
+
+type RoleStoreInterface interface {
+	// GetAll returns all roles together with the permission codes that they bundle.
+	GetAll() ([]*Role, error)
+	// GetAllForUser returns the names of the roles of a specific user.
+	GetAllForUser(userID int64) ([]string, error)
+	// AddForUser grants one or more roles to a specific user.
+	AddForUser(userID int64, names ...string) error
+}
+
+type APIKeyStoreInterface interface {
+	// Insert adds a new API key to the api_keys table.
+	Insert(key *APIKey) error
+	// GetAllForUser returns the API keys of a specific user.
+	GetAllForUser(userID int64) ([]*APIKey, error)
+	// DeleteForUser deletes a specific API key belonging to a specific user.
+	DeleteForUser(id, userID int64) error
+	// DeleteAllForUser deletes all the API keys of a specific user.
+	DeleteAllForUser(userID int64) error
+	// GetForPlaintext fetches an unexpired API key and the user it belongs to for a specific plaintext key.
+	GetForPlaintext(plaintext string) (*APIKey, *User, error)
+	// UpdateLastUsed records the time at which a specific API key was last used.
+	UpdateLastUsed(id int64, lastUsedAt time.Time) error
+}
+
+type LoginAttemptStoreInterface interface {
+	// Claim records an attempt to log in with a specific email address, if the throttle allows one.
+	Claim(email string, now time.Time, throttle LoginThrottle) (*LoginAttempt, time.Duration, error)
+	// Release undoes a claimed attempt to log in with a specific email address which didn't fail.
+	Release(email string) error
+	// Lock prevents logins with a specific email address until the given time.
+	Lock(email string, until time.Time) error
+	// Delete forgets the failed login attempts for a specific email address.
+	Delete(email string) error
+	// PurgeStale removes the records of email addresses whose failed attempts are forgotten and which aren't locked.
+	PurgeStale(now time.Time, lockoutDuration time.Duration) (int64, error)
+}
+
+type TwoFactorStoreInterface interface {
+	// Get returns the TOTP enrolment of a specific user.
+	Get(userID int64) (*TwoFactor, error)
+	// Enrol stores a new, unconfirmed TOTP secret for a specific user.
+	Enrol(userID int64, secret string) error
+	// Confirm enables two-factor authentication for a specific user and stores their recovery codes.
+	Confirm(userID, step int64, recoveryCodes []string) error
+	// UseStep records that a code from a specific time step has been used by a specific user.
+	UseStep(userID, step int64) error
+	// Delete disables two-factor authentication for a specific user.
+	Delete(userID int64) error
+	// ReplaceRecoveryCodes replaces the recovery codes of a specific user.
+	ReplaceRecoveryCodes(userID int64, codes []string) error
+	// UseRecoveryCode deletes a recovery code of a specific user.
+	UseRecoveryCode(userID int64, code string) error
+}
+
+type OIDCStoreInterface interface {
+	// InsertLogin stores a new OpenID Connect login which is in progress.
+	InsertLogin(login *OIDCLogin) error
+	// ConsumeLogin deletes the unexpired login with a specific state and returns it.
+	ConsumeLogin(state string) (*OIDCLogin, error)
+	// GetUserForIdentity returns the user who is linked to a specific identity at a provider.
+	GetUserForIdentity(issuer, subject string) (*User, error)
+	// LinkIdentity links an identity at a provider to a specific user.
+	LinkIdentity(userID int64, issuer, subject string) error
+	// GetIdentitiesForUser returns the identities at providers which are linked to a specific user.
+	GetIdentitiesForUser(userID int64) ([]*Identity, error)
+}
+
+type InvitationStoreInterface interface {
+	// Insert adds a new invitation to the invitations table.
+	Insert(invitation *Invitation) error
+	// GetForToken fetches the unexpired invitation for a specific plaintext token.
+	GetForToken(tokenPlaintext string) (*Invitation, error)
+	// Accept registers a new user with a specific invitation and deletes the invitation, in one transaction.
+	Accept(id int64, user *User, defaultRole string) error
+	// GetAllPending returns the invitations which haven't been used or expired yet.
+	GetAllPending() ([]*Invitation, error)
+	// Delete deletes a specific invitation.
+	Delete(id int64) error
+}
+
+type AuditStoreInterface interface {
+	// Insert adds a new event to the audit_events table.
+	Insert(event *AuditEvent) error
+	// GetAll returns the audit events which match a filter.
+	GetAll(filter AuditFilter, filters Filters) ([]*AuditEvent, PaginationMetadata, error)
+}
+
+type ReviewStoreInterface interface {
+	// Insert adds a new record to the reviews table.
+	Insert(review *Review) error
+	// GetForUser returns the review of a specific movie by a specific user.
+	GetForUser(movieID, userID int64) (*Review, error)
+	// Update a specific record in the reviews table.
+	Update(review *Review) error
+	// Delete a specific record from the reviews table.
+	Delete(id int64) error
+	// GetAllForMovie returns the reviews of a specific movie.
+	GetAllForMovie(movieID int64, filters Filters) ([]*Review, PaginationMetadata, error)
+	// GetAllForUser returns all the reviews written by a specific user.
+	GetAllForUser(userID int64) ([]*Review, error)
+}
+
+type WatchlistStoreInterface interface {
+	// Add puts a movie on the watchlist of a user.
+	Add(userID int64, movie *Movie) (*WatchlistEntry, error)
+	// Remove takes a movie off the watchlist of a user.
+	Remove(userID, movieID int64) error
+	// GetAll returns the watchlist of a user.
+	GetAll(userID int64, title string, genres []string, filters Filters) ([]*WatchlistEntry, PaginationMetadata, error)
+	// GetAllForUser returns the whole watchlist of a user, including movies in the trash.
+	GetAllForUser(userID int64) ([]*WatchlistEntry, error)
+}
+
+type WatchedStoreInterface interface {
+	// Set records the date on which a user watched a movie.
+	Set(userID int64, movie *Movie, watchedOn Date) (*WatchedEntry, error)
+	// Remove deletes the record of a user having watched a movie.
+	Remove(userID, movieID int64) error
+	// GetAll returns the movies which a user has watched.
+	GetAll(userID int64, title string, genres []string, filters Filters) ([]*WatchedEntry, PaginationMetadata, error)
+	// GetAllForUser returns all the movies which a user has watched, including movies in the trash.
+	GetAllForUser(userID int64) ([]*WatchedEntry, error)
+}
+
+type PersonStoreInterface interface {
+	// Insert adds a new record to the people table.
+	Insert(person *Person) error
+	// Get returns a specific record from the people table.
+	Get(id int64) (*Person, error)
+	// Update a specific record in the people table.
+	Update(person *Person) error
+	// Delete a specific record from the people table.
+	Delete(id int64) error
+	// GetAll returns the people whose names match a search term.
+	GetAll(name string, filters Filters) ([]*Person, PaginationMetadata, error)
+}
+
+type CreditStoreInterface interface {
+	// Insert adds a new record to the movie_credits table.
+	Insert(credit *Credit) error
+	// Delete a specific credit of a movie.
+	Delete(movieID, id int64) error
+	// GetAllForMovie returns the credits of a specific movie.
+	GetAllForMovie(movieID int64) ([]*Credit, error)
+	// GetAllForPerson returns the credits of a specific person.
+	GetAllForPerson(personID int64) ([]*Credit, error)
+}
+
+type ListStoreInterface interface {
+	// Insert adds a new record to the lists table.
+	Insert(list *List) error
+	// Get returns a specific record from the lists table.
+	Get(id int64) (*List, error)
+	// Update a specific record in the lists table.
+	Update(list *List) error
+	// Delete a specific record from the lists table.
+	Delete(id int64) error
+	// GetAll returns the lists which a user can see.
+	GetAll(viewerID, ownerID int64, title string, filters Filters) ([]*List, PaginationMetadata, error)
+	// GetAllForUser returns all the lists made by a specific user.
+	GetAllForUser(userID int64) ([]*List, error)
+	// GetItems returns the movies on a specific list.
+	GetItems(listID int64, filters Filters) ([]*ListItem, PaginationMetadata, error)
+	// AddMovies appends movies to the end of a specific list.
+	AddMovies(listID int64, movieIDs []int64) error
+	// RemoveMovie takes a movie off a specific list.
+	RemoveMovie(listID, movieID int64) error
+	// Reorder moves the movies on a specific list into a given order.
+	Reorder(listID int64, movieIDs []int64) error
 }
 
 type ModelStore struct {
-	Movies      MovieStoreInterface
-	Users       UserStoreInterface
-	Tokens      TokenStoreInterface
-	Permissions PermissionStoreInterface
+	Movies        MovieStoreInterface
+	Users         UserStoreInterface
+	Tokens        TokenStoreInterface
+	Permissions   PermissionStoreInterface
+	Roles         RoleStoreInterface
+	APIKeys       APIKeyStoreInterface
+	LoginAttempts LoginAttemptStoreInterface
+	TwoFactor     TwoFactorStoreInterface
+	OIDC          OIDCStoreInterface
+	Invitations   InvitationStoreInterface
+	Audit         AuditStoreInterface
+	Reviews       ReviewStoreInterface
+	Watchlist     WatchlistStoreInterface
+	Watched       WatchedStoreInterface
+	People        PersonStoreInterface
+	Credits       CreditStoreInterface
+	Lists         ListStoreInterface
 }
 
 func NewModelStore(db *pgxpool.Pool) ModelStore {
 	return ModelStore{
-		Movies:      MovieStore{db: db},
-		Users:       UserStore{db: db},
-		Tokens:      TokenStore{db: db},
-		Permissions: PermissionStore{db: db},
+		Movies:        MovieStore{db: db},
+		Users:         UserStore{db: db},
+		Tokens:        TokenStore{db: db},
+		Permissions:   PermissionStore{db: db},
+		Roles:         RoleStore{db: db},
+		APIKeys:       APIKeyStore{db: db},
+		LoginAttempts: LoginAttemptStore{db: db},
+		TwoFactor:     TwoFactorStore{db: db},
+		OIDC:          OIDCStore{db: db},
+		Invitations:   InvitationStore{db: db},
+		Audit:         AuditStore{db: db},
+		Reviews:       ReviewStore{db: db},
+		Watchlist:     WatchlistStore{db: db},
+		Watched:       WatchedStore{db: db},
+		People:        PersonStore{db: db},
+		Credits:       CreditStore{db: db},
+		Lists:         ListStore{db: db},
 	}
 }
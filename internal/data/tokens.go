@@ -4,7 +4,9 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"github.com/96malhar/greenlight/internal/validator"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"time"
 )
@@ -12,6 +14,18 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeEmailChange    = "email-change"
+	ScopeRefresh        = "refresh"
+	ScopeUnlock         = "unlock"
+	ScopeTwoFactor      = "2fa-pending"
+	ScopeRestore        = "restore"
+)
+
+var (
+	// ErrTokenReused is returned when a refresh token that has already been rotated is
+	// presented again, which indicates that it may have been stolen.
+	ErrTokenReused = errors.New("token reused")
 )
 
 // Token represents an authentication token that users use to verify their email.
@@ -22,6 +36,29 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	ClientIP  string    `json:"-"`
+	UserAgent string    `json:"-"`
+	Family    string    `json:"-"`
+}
+
+// SessionInfo describes the client that an authentication or refresh token is issued to.
+type SessionInfo struct {
+	ClientIP  string
+	UserAgent string
+}
+
+// Session represents a login session as seen by its owner: when and where it was
+// started and when it was last used. A session is a family of authentication and
+// refresh tokens, and is represented by the refresh token that is currently valid.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	ClientIP   string     `json:"client_ip"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
+	Family     string     `json:"-"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -31,16 +68,25 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 		Expiry:    time.Now().UTC().Add(ttl),
 		Scope:     scope,
 	}
-	// Generate SHA-256 hash of the plaintext token string. This will be the value
-	// that we store in the `hash` field of our database table. Note that the
-	// sha256.Sum256() function returns an *array* of length 32, so to make it easier to
-	// work with we convert it to a slice using the [:] operator before storing it.
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	token.Hash = hash[:]
+	token.Hash = HashTokenPlaintext(token.Plaintext)
 
 	return token, nil
 }
 
+// NewTokenFamily returns a random identifier for a new family of session tokens.
+func NewTokenFamily() string {
+	return rand.Text()
+}
+
+// HashTokenPlaintext returns the SHA-256 hash of a plaintext token string. This is the
+// value that we store in the `hash` field of our database table. Note that the
+// sha256.Sum256() function returns an *array* of length 32, so to make it easier to
+// work with we convert it to a slice using the [:] operator.
+func HashTokenPlaintext(tokenPlaintext string) []byte {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return hash[:]
+}
+
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
@@ -62,13 +108,29 @@ func (m TokenStore) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// NewSession generates and stores a new token for a specific user and scope as part of
+// a token family, recording the details of the client that the token is issued to.
+func (m TokenStore) NewSession(userID int64, ttl time.Duration, scope, family string, info SessionInfo) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Family = family
+	token.ClientIP = info.ClientIP
+	token.UserAgent = info.UserAgent
+
+	err = m.Insert(token)
+	return token, err
+}
+
 // Insert adds the data for a specific token to the tokens table.
 func (m TokenStore) Insert(token *Token) error {
 	query := `
-        INSERT INTO tokens (hash, user_id, expiry, scope) 
-        VALUES ($1, $2, $3, $4)`
+        INSERT INTO tokens (hash, user_id, expiry, scope, client_ip, user_agent, family) 
+        VALUES ($1, $2, $3, $4, $5, $6, $7)`
 
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.ClientIP, token.UserAgent, token.Family}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -89,3 +151,323 @@ func (m TokenStore) DeleteAllForUser(scope string, userID int64) error {
 	_, err := m.db.Exec(ctx, query, scope, userID)
 	return err
 }
+
+// DeleteByHash deletes the token with a specific hash, along with every other token
+// that belongs to the same token family.
+// It returns a ErrRecordNotFound if no matching token is found.
+func (m TokenStore) DeleteByHash(hash []byte) error {
+	query := `
+        DELETE FROM tokens
+        WHERE hash = $1 
+        OR family IN (SELECT family FROM tokens WHERE hash = $1 AND family <> '')`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.db.Exec(ctx, query, hash)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetAllSessionsForUser returns the active sessions of a specific user, most recently
+// started first.
+func (m TokenStore) GetAllSessionsForUser(userID int64) ([]*Session, error) {
+	query := `
+        SELECT id, created_at, last_used_at, expiry, client_ip, user_agent, family
+        FROM tokens
+        WHERE user_id = $1 AND scope = $2 AND expiry > $3 AND rotated_at IS NULL
+        ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.db.Query(ctx, query, userID, ScopeRefresh, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]*Session, 0)
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.ClientIP,
+			&session.UserAgent,
+			&session.Family,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// DeleteSessionForUser deletes all the tokens of a specific session belonging to a
+// specific user. It returns a ErrRecordNotFound if the user has no such session.
+func (m TokenStore) DeleteSessionForUser(id, userID int64) error {
+	query := `
+        DELETE FROM tokens
+        WHERE user_id = $2 
+        AND family IN (SELECT family FROM tokens WHERE id = $1 AND user_id = $2 AND scope = $3 AND family <> '')`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.db.Exec(ctx, query, id, userID, ScopeRefresh)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteFamilyForUser deletes all the tokens of a specific token family belonging to a
+// specific user. It returns a ErrRecordNotFound if no matching token is found.
+func (m TokenStore) DeleteFamilyForUser(family string, userID int64) error {
+	query := `
+        DELETE FROM tokens
+        WHERE family = $1 AND user_id = $2 AND family <> ''`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.db.Exec(ctx, query, family, userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// UpdateLastUsed records the time at which the token with a specific hash, and so the
+// session that it belongs to, was last used.
+func (m TokenStore) UpdateLastUsed(hash []byte, lastUsedAt time.Time) error {
+	query := `
+        UPDATE tokens
+        SET last_used_at = $1
+        WHERE hash = $2 
+        OR family IN (SELECT family FROM tokens WHERE hash = $2 AND family <> '')`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.db.Exec(ctx, query, lastUsedAt, hash)
+	return err
+}
+
+// GetFamilyByHash returns the token family of the token with a specific hash. Tokens
+// which were not issued as part of a session belong to the empty family "".
+// It returns a ErrRecordNotFound if no matching token is found.
+func (m TokenStore) GetFamilyByHash(hash []byte) (string, error) {
+	query := `
+        SELECT family
+        FROM tokens
+        WHERE hash = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var family string
+
+	err := m.db.QueryRow(ctx, query, hash).Scan(&family)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+
+	return family, nil
+}
+
+// Reissue replaces the tokens for a specific user and scope with a new one, unless the
+// last of them was issued less than minInterval ago. In that case no token is issued, and
+// the time left until the next one can be is returned instead. The user record is locked
+// while the tokens are replaced, so that concurrent calls can't all issue a token.
+func (m TokenStore) Reissue(userID int64, ttl time.Duration, scope string, minInterval time.Duration) (*Token, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.db.Begin(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var issuedAt *time.Time
+
+	err = tx.QueryRow(ctx, `SELECT MAX(created_at) FROM tokens WHERE scope = $1 AND user_id = $2`, scope, userID).Scan(&issuedAt)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if issuedAt != nil {
+		if retryAfter := time.Until(issuedAt.Add(minInterval)); retryAfter > 0 {
+			return nil, retryAfter, nil
+		}
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM tokens WHERE scope = $1 AND user_id = $2`, scope, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+        INSERT INTO tokens (hash, user_id, expiry, scope)
+        VALUES ($1, $2, $3, $4)`
+
+	_, err = tx.Exec(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return token, 0, nil
+}
+
+// Rotate exchanges a refresh token for a new refresh token in the same token family.
+// The old refresh token is kept, marked as rotated, so that it can be recognised if it is
+// presented again, and the authentication tokens issued alongside it are deleted.
+//
+// If a rotated refresh token is presented, the whole token family is deleted and
+// ErrTokenReused is returned. If the token doesn't exist or has expired, Rotate
+// returns ErrRecordNotFound.
+func (m TokenStore) Rotate(tokenPlaintext string, ttl time.Duration, info SessionInfo) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	hash := HashTokenPlaintext(tokenPlaintext)
+
+	var (
+		old       Token
+		createdAt time.Time
+		rotatedAt *time.Time
+	)
+
+	// Lock the row so that concurrent attempts to rotate the same token are serialized.
+	query := `
+        SELECT user_id, expiry, family, created_at, rotated_at
+        FROM tokens
+        WHERE hash = $1 AND scope = $2
+        FOR UPDATE`
+
+	err = tx.QueryRow(ctx, query, hash, ScopeRefresh).Scan(&old.UserID, &old.Expiry, &old.Family, &createdAt, &rotatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if rotatedAt != nil {
+		_, err = tx.Exec(ctx, `DELETE FROM tokens WHERE family = $1`, old.Family)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, ErrTokenReused
+	}
+
+	now := time.Now().UTC()
+
+	if !old.Expiry.After(now) {
+		return nil, ErrRecordNotFound
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE tokens SET rotated_at = $1 WHERE hash = $2`, now, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM tokens WHERE family = $1 AND scope = $2`, old.Family, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := generateToken(old.UserID, ttl, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Family = old.Family
+	token.ClientIP = info.ClientIP
+	token.UserAgent = info.UserAgent
+
+	// The new refresh token keeps the creation time of the session that it continues.
+	query = `
+        INSERT INTO tokens (hash, user_id, expiry, scope, client_ip, user_agent, family, created_at, last_used_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	args := []any{
+		token.Hash, token.UserID, token.Expiry, token.Scope,
+		token.ClientIP, token.UserAgent, token.Family, createdAt, now,
+	}
+
+	_, err = tx.Exec(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
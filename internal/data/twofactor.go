@@ -0,0 +1,243 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
+	"time"
+)
+
+// recoveryCodeCount is the number of recovery codes which are issued to a user at a time.
+const recoveryCodeCount = 10
+
+var (
+	// ErrCodeReused is returned when a TOTP code from a time step which has already been
+	// used is presented again.
+	ErrCodeReused = errors.New("code reused")
+)
+
+// TwoFactor holds the TOTP secret of a user. Two-factor authentication is only enabled
+// once the enrolment has been confirmed with a valid code, which proves that the user
+// has stored the secret in their authenticator app.
+type TwoFactor struct {
+	UserID       int64
+	Secret       string
+	Confirmed    bool
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+// NewRecoveryCodes generates a new set of one-time recovery codes, which let a user log
+// in when they don't have access to their authenticator app.
+func NewRecoveryCodes() []string {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		text := rand.Text()
+		codes[i] = text[:5] + "-" + text[5:10]
+	}
+	return codes
+}
+
+// hashRecoveryCode returns the hash of a recovery code, ignoring the case and any
+// separators in the code so that it can be typed in loosely.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return HashTokenPlaintext(code)
+}
+
+type TwoFactorStore struct {
+	db *pgxpool.Pool
+}
+
+// Get returns the TOTP enrolment of a specific user.
+// It returns a ErrRecordNotFound if the user hasn't enrolled.
+func (s TwoFactorStore) Get(userID int64) (*TwoFactor, error) {
+	query := `
+        SELECT user_id, secret, confirmed, last_used_step, created_at
+        FROM user_totp
+        WHERE user_id = $1`
+
+	var tf TwoFactor
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, userID).Scan(&tf.UserID, &tf.Secret, &tf.Confirmed, &tf.LastUsedStep, &tf.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &tf, nil
+}
+
+// Enrol stores a new, unconfirmed TOTP secret for a specific user, replacing any earlier
+// enrolment which was never confirmed. It returns a ErrEditConflict if the user already
+// has two-factor authentication enabled.
+func (s TwoFactorStore) Enrol(userID int64, secret string) error {
+	query := `
+        INSERT INTO user_totp (user_id, secret)
+        VALUES ($1, $2)
+        ON CONFLICT (user_id) DO UPDATE
+        SET secret = EXCLUDED.secret, last_used_step = 0, created_at = NOW()
+        WHERE user_totp.confirmed = false`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := s.db.Exec(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// Confirm enables two-factor authentication for a specific user, recording the time step
+// of the code which confirmed the enrolment, and stores their first recovery codes in the
+// same transaction, so that two-factor authentication is never enabled without them. It
+// returns a ErrEditConflict if the enrolment has already been confirmed.
+func (s TwoFactorStore) Confirm(userID, step int64, recoveryCodes []string) error {
+	query := `
+        UPDATE user_totp
+        SET confirmed = true, last_used_step = $2
+        WHERE user_id = $1 AND confirmed = false`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrEditConflict
+	}
+
+	err = replaceRecoveryCodes(ctx, tx, userID, recoveryCodes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// UseStep records that a code from a specific time step has been used by a specific user.
+// It returns a ErrCodeReused if a code from the same or a later step was used before.
+func (s TwoFactorStore) UseStep(userID, step int64) error {
+	query := `
+        UPDATE user_totp
+        SET last_used_step = $2
+        WHERE user_id = $1 AND last_used_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := s.db.Exec(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrCodeReused
+	}
+
+	return nil
+}
+
+// Delete disables two-factor authentication for a specific user, deleting their TOTP
+// secret and recovery codes.
+func (s TwoFactorStore) Delete(userID int64) error {
+	query := `
+        WITH deleted_codes AS (
+            DELETE FROM recovery_codes WHERE user_id = $1
+        )
+        DELETE FROM user_totp
+        WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := s.db.Exec(ctx, query, userID)
+	return err
+}
+
+// ReplaceRecoveryCodes replaces the recovery codes of a specific user. Only the hashes
+// of the codes are stored.
+func (s TwoFactorStore) ReplaceRecoveryCodes(userID int64, codes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = replaceRecoveryCodes(ctx, tx, userID, codes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// replaceRecoveryCodes replaces the recovery codes of a specific user within a transaction.
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userID int64, codes []string) error {
+	hashes := make([][]byte, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+
+	_, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        INSERT INTO recovery_codes (user_id, hash)
+        SELECT $1, unnest($2::bytea[])`
+
+	_, err = tx.Exec(ctx, query, userID, hashes)
+	return err
+}
+
+// UseRecoveryCode deletes a recovery code of a specific user, so that it can't be used again.
+// It returns a ErrRecordNotFound if the user has no such code.
+func (s TwoFactorStore) UseRecoveryCode(userID int64, code string) error {
+	query := `
+        DELETE FROM recovery_codes
+        WHERE user_id = $1 AND hash = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := s.db.Exec(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
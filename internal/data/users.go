@@ -1,15 +1,21 @@
 package data
 
 import (
+	"bytes"
 	"context"
-	"crypto/sha256"
-	"database/sql"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"github.com/96malhar/greenlight/internal/validator"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
+	"sync"
 	"time"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -21,13 +27,14 @@ var AnonymousUser = &User{}
 
 // User represents a user account in the database.
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Name       string     `json:"name"`
+	Email      string     `json:"email"`
+	Password   password   `json:"-"`
+	Activated  bool       `json:"activated"`
+	DisabledAt *time.Time `json:"disabled_at,omitzero"`
+	Version    int        `json:"-"`
 }
 
 // IsAnonymous returns true if the user is the special AnonymousUser user.
@@ -35,14 +42,22 @@ func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+// IsDisabled returns true if the user account was deactivated by an administrator. Unlike
+// an account which hasn't been activated yet, a disabled account can't log in, and can
+// only be activated again by an administrator.
+func (u *User) IsDisabled() bool {
+	return u.DisabledAt != nil
+}
+
 type password struct {
 	plaintext *string
 	hash      []byte
 }
 
-// Set generates a hash of the plaintext password and stores it in the hash field.
-func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+// Set generates a hash of the plaintext password with the given PasswordHasher and stores
+// it in the hash field.
+func (p *password) Set(plaintextPassword string, hasher PasswordHasher) error {
+	hash, err := hasher.Hash(plaintextPassword)
 	if err != nil {
 		return err
 	}
@@ -54,8 +69,201 @@ func (p *password) Set(plaintextPassword string) error {
 }
 
 // Matches compares the plaintext password against the hash and returns true if they match.
+// The hash is checked with the algorithm it was generated with, so hashes generated by an
+// earlier PasswordHasher still work. The parameters are read from the hash itself.
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+	hasher, err := hasherFor(p.hash)
+	if err != nil {
+		return false, err
+	}
+
+	return hasher.Compare(p.hash, plaintextPassword)
+}
+
+// NeedsRehash returns true if the hash wasn't generated with the algorithm and parameters
+// of the given PasswordHasher. The hash can then be replaced the next time the user
+// provides their plaintext password.
+func (p *password) NeedsRehash(hasher PasswordHasher) bool {
+	return !hasher.Recognizes(p.hash) || hasher.Outdated(p.hash)
+}
+
+// dummyPasswordHashes holds the hash which SimulatePasswordCheck compares against for
+// each PasswordHasher. A hash is generated on first use, since generating it is
+// deliberately slow.
+var dummyPasswordHashes sync.Map
+
+// SimulatePasswordCheck compares a plaintext password against a dummy hash generated with
+// the given PasswordHasher. It takes about as long as Matches, and is used when there is
+// no user to check the password of, so that response times don't reveal whether a user
+// exists.
+func SimulatePasswordCheck(plaintextPassword string, hasher PasswordHasher) {
+	hash, ok := dummyPasswordHashes.Load(hasher)
+	if !ok {
+		generated, err := hasher.Hash("greenlight dummy password")
+		if err != nil {
+			return
+		}
+		hash, _ = dummyPasswordHashes.LoadOrStore(hasher, generated)
+	}
+
+	_, _ = hasher.Compare(hash.([]byte), plaintextPassword)
+}
+
+// ErrInvalidPasswordHash is returned when a stored password hash can't be parsed, or was
+// generated with an algorithm which isn't supported.
+var ErrInvalidPasswordHash = errors.New("invalid password hash")
+
+// PasswordHasher generates and checks self-describing password hashes, which record the
+// algorithm and parameters they were generated with.
+type PasswordHasher interface {
+	// Hash generates a hash of the plaintext password.
+	Hash(plaintextPassword string) ([]byte, error)
+	// Recognizes returns true if the hash was generated with the algorithm of the hasher.
+	Recognizes(hash []byte) bool
+	// Compare compares the plaintext password against a hash generated with the algorithm
+	// of the hasher and returns true if they match.
+	Compare(hash []byte, plaintextPassword string) (bool, error)
+	// Outdated returns true if the hash was generated with different parameters than the
+	// ones the hasher is configured with.
+	Outdated(hash []byte) bool
+	// MaxLength returns the maximum length of a plaintext password in bytes.
+	MaxLength() int
+}
+
+var (
+	// DefaultArgon2idHasher uses the parameters recommended by RFC 9106 for memory
+	// constrained environments.
+	DefaultArgon2idHasher = Argon2idHasher{Memory: 64 * 1024, Iterations: 3, Parallelism: 4, SaltLength: 16, KeyLength: 32}
+	DefaultBcryptHasher   = BcryptHasher{Cost: 12}
+)
+
+// knownPasswordHashers are used to check hashes generated with any of the supported
+// algorithms. Their parameters don't matter, since each hash records its own.
+var knownPasswordHashers = []PasswordHasher{DefaultArgon2idHasher, DefaultBcryptHasher}
+
+// hasherFor returns the PasswordHasher for the algorithm a hash was generated with.
+func hasherFor(hash []byte) (PasswordHasher, error) {
+	for _, hasher := range knownPasswordHashers {
+		if hasher.Recognizes(hash) {
+			return hasher, nil
+		}
+	}
+
+	return nil, ErrInvalidPasswordHash
+}
+
+// Argon2idHasher hashes passwords with Argon2id. Hashes are stored in the PHC string format,
+// for example $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>, with the salt and key encoded
+// in unpadded base64. Memory is in KiB.
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+func (h Argon2idHasher) Hash(plaintextPassword string) ([]byte, error) {
+	salt := make([]byte, h.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintextPassword), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	hash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+
+	return []byte(hash), nil
+}
+
+func (h Argon2idHasher) Recognizes(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$argon2id$"))
+}
+
+func (h Argon2idHasher) Compare(hash []byte, plaintextPassword string) (bool, error) {
+	params, salt, key, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return false, err
+	}
+
+	otherKey := argon2.IDKey([]byte(plaintextPassword), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+func (h Argon2idHasher) Outdated(hash []byte) bool {
+	params, _, _, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return true
+	}
+
+	return params != h
+}
+
+// MaxLength is only there to bound the work done for a single request, since Argon2id
+// handles passwords of any length.
+func (h Argon2idHasher) MaxLength() int {
+	return 1024
+}
+
+// decodeArgon2idHash parses a hash generated by Argon2idHasher into the parameters, salt
+// and key it contains.
+func decodeArgon2idHash(hash []byte) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil || params.Iterations == 0 || params.Parallelism == 0 {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
+
+// BcryptHasher hashes passwords with bcrypt. Its hashes record the cost they were generated
+// with, for example $2a$12$<salt and hash>.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(plaintextPassword string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(plaintextPassword), h.Cost)
+}
+
+func (h BcryptHasher) Recognizes(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$2a$")) || bytes.HasPrefix(hash, []byte("$2b$")) || bytes.HasPrefix(hash, []byte("$2y$"))
+}
+
+func (h BcryptHasher) Compare(hash []byte, plaintextPassword string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword(hash, []byte(plaintextPassword))
 	if err != nil {
 		switch {
 		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
@@ -68,27 +276,42 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 	return true, nil
 }
 
+func (h BcryptHasher) Outdated(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.Cost
+}
+
+// MaxLength is the limit of the bcrypt algorithm, which only uses the first 72 bytes of a
+// password.
+func (h BcryptHasher) MaxLength() int {
+	return 72
+}
+
 func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(email != "", "email", "must be provided")
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
 
-func ValidatePasswordPlaintext(v *validator.Validator, password string) {
+// ValidatePasswordPlaintext checks the length of a plaintext password against the limits
+// of the PasswordHasher that hashes it.
+func ValidatePasswordPlaintext(v *validator.Validator, password string, hasher PasswordHasher) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(len(password) <= hasher.MaxLength(), "password", fmt.Sprintf("must not be more than %d bytes long", hasher.MaxLength()))
 }
 
 // ValidateUser checks the values provided by the user are valid. It performs validation on the
-// Name, Email and Password fields.
-func ValidateUser(v *validator.Validator, user *User) {
+// Name, Email and Password fields. A new password is checked against the limits of the
+// PasswordHasher and the PasswordPolicy.
+func ValidateUser(v *validator.Validator, user *User, hasher PasswordHasher, policy PasswordPolicy) {
 	v.Check(user.Name != "", "name", "must be provided")
 	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
 
 	ValidateEmail(v, user.Email)
 
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		ValidatePasswordPlaintext(v, *user.Password.plaintext, hasher)
+		ValidatePasswordStrength(v, policy, *user.Password.plaintext, user.Name, user.Email)
 	}
 
 	// If the password hash is ever nil, this will be due to a logic error in our codebase.
@@ -119,7 +342,7 @@ func (s UserStore) Insert(user *User) error {
 	err := s.db.QueryRow(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `ERROR: duplicate key value violates unique constraint "users_email_key" (SQLSTATE 23505)`:
+		case isUniqueViolation(err, "users_email_key"):
 			return ErrDuplicateEmail
 		default:
 			return err
@@ -133,9 +356,9 @@ func (s UserStore) Insert(user *User) error {
 // It returns a ErrRecordNotFound if no matching record is found.
 func (s UserStore) GetByEmail(email string) (*User, error) {
 	query := `
-        SELECT id, created_at, name, email, password_hash, activated, version
+        SELECT id, created_at, name, email, password_hash, activated, disabled_at, version
         FROM users
-        WHERE email = $1`
+        WHERE email = $1 AND deleted_at IS NULL`
 
 	var user User
 
@@ -144,7 +367,41 @@ func (s UserStore) GetByEmail(email string) (*User, error) {
 
 	err := s.db.QueryRow(ctx, query, email).Scan(
 		&user.ID, &user.CreatedAt, &user.Name, &user.Email,
-		&user.Password.hash, &user.Activated, &user.Version,
+		&user.Password.hash, &user.Activated, &user.DisabledAt, &user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// Get fetches a user record from the database using the user ID.
+// It returns a ErrRecordNotFound if no matching record is found.
+func (s UserStore) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+        SELECT id, created_at, name, email, password_hash, activated, disabled_at, version
+        FROM users
+        WHERE id = $1 AND deleted_at IS NULL`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, id).Scan(
+		&user.ID, &user.CreatedAt, &user.Name, &user.Email,
+		&user.Password.hash, &user.Activated, &user.DisabledAt, &user.Version,
 	)
 
 	if err != nil {
@@ -159,16 +416,69 @@ func (s UserStore) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+// GetAll returns the users whose name or email address contains the search term, and
+// whose activation state matches activated unless it is nil.
+func (s UserStore) GetAll(search string, activated *bool, filters Filters) ([]*User, PaginationMetadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, created_at, name, email, activated, disabled_at, version
+        FROM users
+        WHERE (strpos(lower(name), lower($1)) > 0 OR strpos(lower(email::text), lower($1)) > 0 OR $1 = '')
+        AND (activated = $2 OR $2 IS NULL)
+        AND deleted_at IS NULL
+        ORDER BY %s %s, id ASC
+        LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{search, activated, filters.limit(), filters.offset()}
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := make([]*User, 0)
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.DisabledAt,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, PaginationMetadata{}, err
+		}
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+
+	metadata := calculatePaginationMetadata(totalRecords, filters.Page, filters.PageSize)
+	return users, metadata, nil
+}
+
 // Update the details for a specific user.
 func (s UserStore) Update(user *User) error {
 	query := `
         UPDATE users 
-        SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-        WHERE id = $5 AND version = $6
+        SET name = $1, email = $2, password_hash = $3, activated = $4, disabled_at = $5, version = version + 1
+        WHERE id = $6 AND version = $7
         RETURNING version`
 
 	args := []any{
-		user.Name, user.Email, user.Password.hash, user.Activated, user.ID, user.Version,
+		user.Name, user.Email, user.Password.hash, user.Activated, user.DisabledAt, user.ID, user.Version,
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -177,9 +487,61 @@ func (s UserStore) Update(user *User) error {
 	err := s.db.QueryRow(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case isUniqueViolation(err, "users_email_key"):
+			return ErrDuplicateEmail
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetPendingEmail stores a new email address for a specific user. The address only
+// replaces the current one once it has been confirmed with ConfirmPendingEmail.
+func (s UserStore) SetPendingEmail(userID int64, email string) error {
+	query := `
+        UPDATE users
+        SET pending_email = $1
+        WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := s.db.Exec(ctx, query, email, userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// ConfirmPendingEmail swaps the email address of a user for their pending email address.
+// It returns ErrDuplicateEmail if the address has been taken by another user in the
+// meantime, and ErrEditConflict if the user record has changed or there is no pending
+// email address.
+func (s UserStore) ConfirmPendingEmail(user *User) error {
+	query := `
+        UPDATE users
+        SET email = pending_email, pending_email = NULL, version = version + 1
+        WHERE id = $1 AND version = $2 AND pending_email IS NOT NULL
+        RETURNING email, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, user.ID, user.Version).Scan(&user.Email, &user.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err, "users_email_key"):
 			return ErrDuplicateEmail
-		case errors.Is(err, sql.ErrNoRows):
+		case errors.Is(err, pgx.ErrNoRows):
 			return ErrEditConflict
 		default:
 			return err
@@ -189,20 +551,183 @@ func (s UserStore) Update(user *User) error {
 	return nil
 }
 
+// Delete removes a specific user record from the database. The user's tokens and
+// permissions are removed along with it by the ON DELETE CASCADE constraints.
+func (s UserStore) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+        DELETE FROM users
+        WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := s.db.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// SoftDelete marks a specific user as deleted, revokes all of their tokens and issues a
+// restore token which expires after the grace period. The user can no longer log in, and
+// is no longer found by the other methods of UserStore, except GetForToken for restore
+// tokens. The record, and with it the email address, is kept until it is removed by
+// PurgeDeleted, so that the deletion can be undone with Restore. The restore token is
+// issued in the same transaction, so that a deleted user always has a way back.
+//
+// It returns the restore token, whose expiry is the time the user is due to be purged,
+// or a ErrRecordNotFound if there is no such user which isn't deleted already.
+func (s UserStore) SoftDelete(id int64, gracePeriod time.Duration) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+        UPDATE users
+        SET deleted_at = $1, version = version + 1
+        WHERE id = $2 AND deleted_at IS NULL
+        RETURNING deleted_at`
+
+	var deletedAt time.Time
+
+	err = tx.QueryRow(ctx, query, time.Now().UTC(), id).Scan(&deletedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM tokens WHERE user_id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := generateToken(id, gracePeriod, ScopeRestore)
+	if err != nil {
+		return nil, err
+	}
+	token.Expiry = deletedAt.Add(gracePeriod)
+
+	query = `
+        INSERT INTO tokens (hash, user_id, expiry, scope)
+        VALUES ($1, $2, $3, $4)`
+
+	_, err = tx.Exec(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// Restore undoes the soft deletion of a specific user. It returns a ErrRecordNotFound if
+// there is no such deleted user.
+func (s UserStore) Restore(id int64) error {
+	query := `
+        UPDATE users
+        SET deleted_at = NULL, version = version + 1
+        WHERE id = $1 AND deleted_at IS NOT NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := s.db.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// PurgeDeleted permanently removes the users who were soft deleted before a specific
+// time, and returns how many were removed. All the data of the users goes with them
+// through the ON DELETE CASCADE constraints, except for the login attempts for their
+// email addresses, which aren't tied to the users table and are deleted explicitly.
+func (s UserStore) PurgeDeleted(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `DELETE FROM users WHERE deleted_at <= $1 RETURNING email`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	var emails []string
+
+	for rows.Next() {
+		var email string
+
+		err := rows.Scan(&email)
+		if err != nil {
+			return 0, err
+		}
+
+		emails = append(emails, email)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(emails) == 0 {
+		return 0, nil
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM login_attempts WHERE email = ANY($1)`, emails)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(emails)), tx.Commit(ctx)
+}
+
 // GetForToken fetches a user record from the database for a specific token and scope.
+// Users who deleted their account are only found for restore tokens.
 func (s UserStore) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
-	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	tokenHash := HashTokenPlaintext(tokenPlaintext)
 
 	query := `
-        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.disabled_at, users.version
         FROM users
         INNER JOIN tokens
         ON users.id = tokens.user_id
         WHERE tokens.hash = $1
         AND tokens.scope = $2 
-        AND tokens.expiry > $3`
+        AND tokens.expiry > $3
+        AND (users.deleted_at IS NULL OR tokens.scope = $4)`
 
-	args := []any{tokenHash[:], tokenScope, time.Now().UTC()}
+	args := []any{tokenHash, tokenScope, time.Now().UTC(), ScopeRestore}
 
 	var user User
 
@@ -212,7 +737,7 @@ func (s UserStore) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	err := s.db.QueryRow(ctx, query, args...).Scan(
 		&user.ID, &user.CreatedAt, &user.Name,
 		&user.Email, &user.Password.hash, &user.Activated,
-		&user.Version,
+		&user.DisabledAt, &user.Version,
 	)
 	if err != nil {
 		switch {
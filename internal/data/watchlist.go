@@ -0,0 +1,337 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"github.com/96malhar/greenlight/internal/validator"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// WatchlistEntry is a movie which a user wants to watch. Entries for movies in the trash
+// are left out of the watchlist until the movies are restored, and are removed along with
+// the movies when they're purged. The same goes for watched entries. Only the data export
+// of the user, through GetAllForUser, includes them in the meantime.
+type WatchlistEntry struct {
+	Movie   *Movie    `json:"movie"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// WatchedEntry records the date on which a user watched a movie.
+type WatchedEntry struct {
+	Movie     *Movie `json:"movie"`
+	WatchedOn Date   `json:"watched_on"`
+}
+
+// ValidateWatchedOn checks the date on which a movie was watched.
+func ValidateWatchedOn(v *validator.Validator, watchedOn Date) {
+	v.Check(!watchedOn.After(Today().Time), "watched_on", "must not be in the future")
+}
+
+type WatchlistStore struct {
+	db *pgxpool.Pool
+}
+
+// Add puts a movie on the watchlist of a user. Adding a movie which is already on the
+// watchlist keeps the time it was first added.
+func (s WatchlistStore) Add(userID int64, movie *Movie) (*WatchlistEntry, error) {
+	query := `
+        INSERT INTO watchlist_entries (user_id, movie_id)
+        VALUES ($1, $2)
+        ON CONFLICT (user_id, movie_id) DO UPDATE SET added_at = watchlist_entries.added_at
+        RETURNING added_at`
+
+	entry := &WatchlistEntry{Movie: movie}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, userID, movie.ID).Scan(&entry.AddedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// Remove takes a movie off the watchlist of a user. It returns ErrRecordNotFound if the
+// movie isn't on the watchlist.
+func (s WatchlistStore) Remove(userID, movieID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := s.db.Exec(ctx, `DELETE FROM watchlist_entries WHERE user_id = $1 AND movie_id = $2`, userID, movieID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetAll returns the watchlist of a user. The title and genres parameters filter the
+// movies in the same way as MovieStore.GetAll.
+func (s WatchlistStore) GetAll(userID int64, title string, genres []string, filters Filters) ([]*WatchlistEntry, PaginationMetadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, average_rating, rating_count, version, added_at
+        FROM watchlist_entries
+        INNER JOIN movies ON movies.id = watchlist_entries.movie_id %s
+        WHERE user_id = $1
+        AND (to_tsvector('simple', title) @@ plainto_tsquery('simple', $2) OR $2 = '')
+        AND (genres @> $3 OR $3 = '{}')
+        AND deleted_at IS NULL
+        ORDER BY %s %s, id ASC
+        LIMIT $4 OFFSET $5`, movieRatings, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{userID, title, genres, filters.limit(), filters.offset()}
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := make([]*WatchlistEntry, 0)
+
+	for rows.Next() {
+		var movie Movie
+		entry := WatchlistEntry{Movie: &movie}
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.Genres,
+			&movie.AverageRating,
+			&movie.RatingCount,
+			&movie.Version,
+			&entry.AddedAt,
+		)
+		if err != nil {
+			return nil, PaginationMetadata{}, err
+		}
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+
+	metadata := calculatePaginationMetadata(totalRecords, filters.Page, filters.PageSize)
+	return entries, metadata, nil
+}
+
+// GetAllForUser returns the whole watchlist of a user, oldest entries first. Unlike GetAll,
+// it includes the movies in the trash, whose DeletedAt field is set.
+func (s WatchlistStore) GetAllForUser(userID int64) ([]*WatchlistEntry, error) {
+	query := fmt.Sprintf(`
+        SELECT id, created_at, title, year, runtime, genres, average_rating, rating_count, version, deleted_at, added_at
+        FROM watchlist_entries
+        INNER JOIN movies ON movies.id = watchlist_entries.movie_id %s
+        WHERE user_id = $1
+        ORDER BY added_at, id`, movieRatings)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*WatchlistEntry, 0)
+
+	for rows.Next() {
+		var movie Movie
+		entry := WatchlistEntry{Movie: &movie}
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.Genres,
+			&movie.AverageRating,
+			&movie.RatingCount,
+			&movie.Version,
+			&movie.DeletedAt,
+			&entry.AddedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+type WatchedStore struct {
+	db *pgxpool.Pool
+}
+
+// Set records the date on which a user watched a movie, replacing any date which was
+// recorded before.
+func (s WatchedStore) Set(userID int64, movie *Movie, watchedOn Date) (*WatchedEntry, error) {
+	query := `
+        INSERT INTO watched_entries (user_id, movie_id, watched_on)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (user_id, movie_id) DO UPDATE SET watched_on = EXCLUDED.watched_on
+        RETURNING watched_on`
+
+	entry := &WatchedEntry{Movie: movie}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRow(ctx, query, userID, movie.ID, watchedOn).Scan(&entry.WatchedOn)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// Remove deletes the record of a user having watched a movie. It returns
+// ErrRecordNotFound if there is no such record.
+func (s WatchedStore) Remove(userID, movieID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := s.db.Exec(ctx, `DELETE FROM watched_entries WHERE user_id = $1 AND movie_id = $2`, userID, movieID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetAll returns the movies which a user has watched. The title and genres parameters
+// filter the movies in the same way as MovieStore.GetAll.
+func (s WatchedStore) GetAll(userID int64, title string, genres []string, filters Filters) ([]*WatchedEntry, PaginationMetadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, average_rating, rating_count, version, watched_on
+        FROM watched_entries
+        INNER JOIN movies ON movies.id = watched_entries.movie_id %s
+        WHERE user_id = $1
+        AND (to_tsvector('simple', title) @@ plainto_tsquery('simple', $2) OR $2 = '')
+        AND (genres @> $3 OR $3 = '{}')
+        AND deleted_at IS NULL
+        ORDER BY %s %s, id ASC
+        LIMIT $4 OFFSET $5`, movieRatings, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{userID, title, genres, filters.limit(), filters.offset()}
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := make([]*WatchedEntry, 0)
+
+	for rows.Next() {
+		var movie Movie
+		entry := WatchedEntry{Movie: &movie}
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.Genres,
+			&movie.AverageRating,
+			&movie.RatingCount,
+			&movie.Version,
+			&entry.WatchedOn,
+		)
+		if err != nil {
+			return nil, PaginationMetadata{}, err
+		}
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, PaginationMetadata{}, err
+	}
+
+	metadata := calculatePaginationMetadata(totalRecords, filters.Page, filters.PageSize)
+	return entries, metadata, nil
+}
+
+// GetAllForUser returns all the movies which a user has watched, in the order they were
+// watched. Unlike GetAll, it includes the movies in the trash, whose DeletedAt field is set.
+func (s WatchedStore) GetAllForUser(userID int64) ([]*WatchedEntry, error) {
+	query := fmt.Sprintf(`
+        SELECT id, created_at, title, year, runtime, genres, average_rating, rating_count, version, deleted_at, watched_on
+        FROM watched_entries
+        INNER JOIN movies ON movies.id = watched_entries.movie_id %s
+        WHERE user_id = $1
+        ORDER BY watched_on, id`, movieRatings)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*WatchedEntry, 0)
+
+	for rows.Next() {
+		var movie Movie
+		entry := WatchedEntry{Movie: &movie}
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.Genres,
+			&movie.AverageRating,
+			&movie.RatingCount,
+			&movie.Version,
+			&movie.DeletedAt,
+			&entry.WatchedOn,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
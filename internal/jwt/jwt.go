@@ -0,0 +1,297 @@
+// Package jwt implements the subset of JSON Web Tokens (RFC 7519) that the API uses for
+// stateless authentication: compact JWS tokens signed with EdDSA (Ed25519) or HS256.
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	AlgEdDSA = "EdDSA"
+	AlgHS256 = "HS256"
+)
+
+var (
+	// ErrInvalidToken is returned when a token is malformed, is signed with an unknown
+	// key or has an invalid signature.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrExpiredToken is returned when a token is valid but has expired.
+	ErrExpiredToken = errors.New("expired token")
+)
+
+// Claims holds the claims carried by the tokens issued by the API.
+type Claims struct {
+	Issuer      string   `json:"iss"`
+	Subject     string   `json:"sub"`
+	IssuedAt    int64    `json:"iat"`
+	Expiry      int64    `json:"exp"`
+	SessionID   string   `json:"sid,omitempty"`
+	Activated   bool     `json:"activated"`
+	Permissions []string `json:"perms"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// Key is a named signing key. Ed25519 keys without a private key can only be used to
+// verify tokens, which allows a key to be kept in a key set after it has been retired.
+type Key struct {
+	ID         string
+	Algorithm  string
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+func (k Key) canSign() bool {
+	switch k.Algorithm {
+	case AlgHS256:
+		return len(k.secret) > 0
+	default:
+		return k.privateKey != nil
+	}
+}
+
+func (k Key) sign(input []byte) []byte {
+	switch k.Algorithm {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	default:
+		return ed25519.Sign(k.privateKey, input)
+	}
+}
+
+func (k Key) verify(input, signature []byte) bool {
+	switch k.Algorithm {
+	case AlgHS256:
+		return hmac.Equal(k.sign(input), signature)
+	default:
+		return ed25519.Verify(k.publicKey, input, signature)
+	}
+}
+
+// NewHS256Key returns a key which signs tokens with HMAC-SHA256 using the given secret.
+func NewHS256Key(id string, secret []byte) (Key, error) {
+	if len(secret) < 32 {
+		return Key{}, fmt.Errorf("jwt: HS256 key %q must be at least 32 bytes long", id)
+	}
+	return Key{ID: id, Algorithm: AlgHS256, secret: secret}, nil
+}
+
+// NewEdDSAKey returns a key which signs tokens with the Ed25519 private key derived
+// from the given seed.
+func NewEdDSAKey(id string, seed []byte) (Key, error) {
+	if len(seed) != ed25519.SeedSize {
+		return Key{}, fmt.Errorf("jwt: EdDSA key %q must have a %d byte seed", id, ed25519.SeedSize)
+	}
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	return Key{ID: id, Algorithm: AlgEdDSA, privateKey: privateKey, publicKey: privateKey.Public().(ed25519.PublicKey)}, nil
+}
+
+// NewEdDSAVerificationKey returns a key which can only verify tokens signed by the
+// corresponding Ed25519 private key.
+func NewEdDSAVerificationKey(id string, publicKey []byte) (Key, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return Key{}, fmt.Errorf("jwt: EdDSA public key %q must be %d bytes long", id, ed25519.PublicKeySize)
+	}
+	return Key{ID: id, Algorithm: AlgEdDSA, publicKey: ed25519.PublicKey(publicKey)}, nil
+}
+
+// KeySet holds the keys which tokens are verified with, identified by the "kid" header
+// of each token, and the key that new tokens are signed with. Keys are rotated by adding
+// a new key to the set, making it the signing key, and removing the old key once the
+// tokens signed with it have expired.
+type KeySet struct {
+	keys       map[string]Key
+	signingKey Key
+}
+
+// NewKeySet returns a key set which signs tokens with the key identified by signingKeyID.
+func NewKeySet(signingKeyID string, keys ...Key) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]Key, len(keys))}
+
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, errors.New("jwt: key id must be provided")
+		}
+		if _, exists := ks.keys[key.ID]; exists {
+			return nil, fmt.Errorf("jwt: duplicate key id %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+
+	signingKey, ok := ks.keys[signingKeyID]
+	if !ok {
+		return nil, fmt.Errorf("jwt: signing key %q not found in key set", signingKeyID)
+	}
+	if !signingKey.canSign() {
+		return nil, fmt.Errorf("jwt: key %q cannot be used for signing", signingKeyID)
+	}
+	ks.signingKey = signingKey
+
+	return ks, nil
+}
+
+// LoadKeySet reads a key set from a JSON file in the following format, where "key" holds
+// the base64-encoded HS256 secret or Ed25519 seed and "public_key" holds the
+// base64-encoded public key of a retired Ed25519 key:
+//
+//	{"keys": [{"kid": "2024-06", "alg": "EdDSA", "key": "..."}, {"kid": "2024-01", "alg": "HS256", "key": "..."}]}
+//
+// If signingKeyID is empty, the first key in the file is used for signing.
+func LoadKeySet(path, signingKeyID string) (*KeySet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Keys []struct {
+			ID        string `json:"kid"`
+			Algorithm string `json:"alg"`
+			Key       string `json:"key"`
+			PublicKey string `json:"public_key"`
+		} `json:"keys"`
+	}
+
+	err = json.Unmarshal(b, &file)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: parsing key set: %w", err)
+	}
+
+	if len(file.Keys) == 0 {
+		return nil, errors.New("jwt: key set is empty")
+	}
+
+	keys := make([]Key, 0, len(file.Keys))
+
+	for _, k := range file.Keys {
+		var (
+			key     Key
+			encoded = k.Key
+		)
+		if encoded == "" {
+			encoded = k.PublicKey
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: decoding key %q: %w", k.ID, err)
+		}
+
+		switch {
+		case k.Algorithm == AlgHS256:
+			key, err = NewHS256Key(k.ID, raw)
+		case k.Algorithm == AlgEdDSA && k.Key != "":
+			key, err = NewEdDSAKey(k.ID, raw)
+		case k.Algorithm == AlgEdDSA:
+			key, err = NewEdDSAVerificationKey(k.ID, raw)
+		default:
+			err = fmt.Errorf("jwt: key %q has unsupported algorithm %q", k.ID, k.Algorithm)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	if signingKeyID == "" {
+		signingKeyID = keys[0].ID
+	}
+
+	return NewKeySet(signingKeyID, keys...)
+}
+
+// Sign returns a token carrying the given claims, signed with the signing key of the set.
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	h, err := json.Marshal(header{Alg: ks.signingKey.Algorithm, Typ: "JWT", Kid: ks.signingKey.ID})
+	if err != nil {
+		return "", err
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	signature := ks.signingKey.sign([]byte(input))
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature of a token against the key named by its "kid" header and
+// returns its claims. It returns ErrInvalidToken if the token can't be verified and
+// ErrExpiredToken if the token has expired at the given time.
+func (ks *KeySet) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	// The algorithm must match the one of the key, so that a token can't pick a weaker
+	// algorithm than the key was meant for.
+	key, ok := ks.keys[h.Kid]
+	if !ok || h.Alg != key.Algorithm {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if now.Unix() >= claims.Expiry {
+		return nil, ErrExpiredToken
+	}
+
+	return &claims, nil
+}
+
+// NewClaims returns claims for a token issued now which expires after ttl.
+func NewClaims(issuer, subject string, ttl time.Duration) Claims {
+	now := time.Now()
+	return Claims{
+		Issuer:   issuer,
+		Subject:  subject,
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(ttl).Unix(),
+	}
+}
+
+func decodeSegment(segment string, dst any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
@@ -0,0 +1,337 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestEdDSAKey(t *testing.T, id string, seed byte) Key {
+	key, err := NewEdDSAKey(id, bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+	require.NoError(t, err)
+	return key
+}
+
+func newTestHS256Key(t *testing.T, id string, secret byte) Key {
+	key, err := NewHS256Key(id, bytes.Repeat([]byte{secret}, 32))
+	require.NoError(t, err)
+	return key
+}
+
+func newTestKeySet(t *testing.T, signingKeyID string, keys ...Key) *KeySet {
+	ks, err := NewKeySet(signingKeyID, keys...)
+	require.NoError(t, err)
+	return ks
+}
+
+func testClaims() Claims {
+	claims := NewClaims("greenlight", "1", time.Hour)
+	claims.SessionID = "session"
+	claims.Activated = true
+	claims.Permissions = []string{"movies:read"}
+	return claims
+}
+
+// encodeSegment base64url encodes the JSON encoding of v, as in a token.
+func encodeSegment(t *testing.T, v any) string {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestSignAndVerify(t *testing.T) {
+	for _, key := range []Key{newTestEdDSAKey(t, "ed", 1), newTestHS256Key(t, "hs", 1)} {
+		t.Run(key.Algorithm, func(t *testing.T) {
+			ks := newTestKeySet(t, key.ID, key)
+			claims := testClaims()
+
+			token, err := ks.Sign(claims)
+			require.NoError(t, err)
+
+			got, err := ks.Verify(token, time.Now())
+			require.NoError(t, err)
+			assert.Equal(t, claims, *got)
+		})
+	}
+}
+
+func TestVerify_TamperedToken(t *testing.T) {
+	ks := newTestKeySet(t, "ed", newTestEdDSAKey(t, "ed", 1))
+
+	token, err := ks.Sign(testClaims())
+	require.NoError(t, err)
+	parts := strings.Split(token, ".")
+
+	tampered := testClaims()
+	tampered.Permissions = append(tampered.Permissions, "users:admin")
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	signature[0] ^= 0xff
+
+	testcases := []struct {
+		name  string
+		token string
+	}{
+		{name: "Tampered payload", token: parts[0] + "." + encodeSegment(t, tampered) + "." + parts[2]},
+		{name: "Tampered signature", token: parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(signature)},
+		{name: "Missing signature", token: parts[0] + "." + parts[1] + "."},
+		{name: "Too few segments", token: parts[0] + "." + parts[1]},
+		{name: "Too many segments", token: token + ".extra"},
+		{name: "Invalid header encoding", token: "!!!." + parts[1] + "." + parts[2]},
+		{name: "Invalid signature encoding", token: parts[0] + "." + parts[1] + ".!!!"},
+		{name: "Empty", token: ""},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ks.Verify(tc.token, time.Now())
+			assert.ErrorIs(t, err, ErrInvalidToken)
+		})
+	}
+}
+
+func TestVerify_Algorithm(t *testing.T) {
+	edKey := newTestEdDSAKey(t, "ed", 1)
+	hsKey := newTestHS256Key(t, "hs", 1)
+	ks := newTestKeySet(t, "ed", edKey, hsKey)
+
+	payload := encodeSegment(t, testClaims())
+
+	// signWith signs a token with the given key, but with arbitrary header values, as an
+	// attacker who knows the key material could.
+	signWith := func(key Key, alg, kid string) string {
+		input := encodeSegment(t, header{Alg: alg, Typ: "JWT", Kid: kid}) + "." + payload
+		return input + "." + base64.RawURLEncoding.EncodeToString(key.sign([]byte(input)))
+	}
+
+	// An HS256 key which uses the public key of the EdDSA key as its secret, as in the
+	// classic algorithm confusion attack.
+	confusedKey := Key{ID: "ed", Algorithm: AlgHS256, secret: edKey.publicKey}
+
+	testcases := []struct {
+		name  string
+		token string
+	}{
+		{name: "alg none", token: encodeSegment(t, header{Alg: "none", Typ: "JWT", Kid: "ed"}) + "." + payload + "."},
+		{name: "alg none with a signature", token: signWith(edKey, "none", "ed")},
+		{name: "Empty alg", token: signWith(edKey, "", "ed")},
+		{name: "HS256 with the EdDSA public key", token: signWith(confusedKey, AlgHS256, "ed")},
+		{name: "EdDSA key with the HS256 alg", token: signWith(edKey, AlgHS256, "ed")},
+		{name: "HS256 key with the EdDSA alg", token: signWith(hsKey, AlgEdDSA, "hs")},
+		{name: "Lowercase alg", token: signWith(edKey, "eddsa", "ed")},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ks.Verify(tc.token, time.Now())
+			assert.ErrorIs(t, err, ErrInvalidToken)
+		})
+	}
+
+	// The same helper produces a valid token with the right header values.
+	_, err := ks.Verify(signWith(edKey, AlgEdDSA, "ed"), time.Now())
+	assert.NoError(t, err)
+}
+
+func TestVerify_KeyRotation(t *testing.T) {
+	oldKey := newTestEdDSAKey(t, "2024-01", 1)
+	newKey := newTestEdDSAKey(t, "2024-06", 2)
+
+	oldSet := newTestKeySet(t, oldKey.ID, oldKey)
+	oldToken, err := oldSet.Sign(testClaims())
+	require.NoError(t, err)
+
+	// After rotating, tokens signed with the old key are still accepted as long as the
+	// key remains in the set, even if only its public key is kept.
+	retiredKey, err := NewEdDSAVerificationKey(oldKey.ID, oldKey.publicKey)
+	require.NoError(t, err)
+	rotatedSet := newTestKeySet(t, newKey.ID, newKey, retiredKey)
+
+	_, err = rotatedSet.Verify(oldToken, time.Now())
+	assert.NoError(t, err)
+
+	newToken, err := rotatedSet.Sign(testClaims())
+	require.NoError(t, err)
+
+	_, err = rotatedSet.Verify(newToken, time.Now())
+	assert.NoError(t, err)
+
+	// The old set doesn't know the new key.
+	_, err = oldSet.Verify(newToken, time.Now())
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// Once the old key is removed, its tokens are rejected.
+	newSet := newTestKeySet(t, newKey.ID, newKey)
+	_, err = newSet.Verify(oldToken, time.Now())
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestVerify_UnknownKid(t *testing.T) {
+	key := newTestEdDSAKey(t, "ed", 1)
+	ks := newTestKeySet(t, "ed", key)
+
+	payload := encodeSegment(t, testClaims())
+
+	for _, kid := range []string{"", "unknown", "ED"} {
+		t.Run(kid, func(t *testing.T) {
+			input := encodeSegment(t, header{Alg: AlgEdDSA, Typ: "JWT", Kid: kid}) + "." + payload
+			token := input + "." + base64.RawURLEncoding.EncodeToString(key.sign([]byte(input)))
+
+			_, err := ks.Verify(token, time.Now())
+			assert.ErrorIs(t, err, ErrInvalidToken)
+		})
+	}
+}
+
+func TestVerify_WrongKey(t *testing.T) {
+	testcases := []struct {
+		name     string
+		signer   Key
+		verifier Key
+	}{
+		{name: "EdDSA", signer: newTestEdDSAKey(t, "key", 1), verifier: newTestEdDSAKey(t, "key", 2)},
+		{name: "HS256", signer: newTestHS256Key(t, "key", 1), verifier: newTestHS256Key(t, "key", 2)},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			token, err := newTestKeySet(t, "key", tc.signer).Sign(testClaims())
+			require.NoError(t, err)
+
+			_, err = newTestKeySet(t, "key", tc.verifier).Verify(token, time.Now())
+			assert.ErrorIs(t, err, ErrInvalidToken)
+		})
+	}
+}
+
+func TestVerify_Expiry(t *testing.T) {
+	ks := newTestKeySet(t, "ed", newTestEdDSAKey(t, "ed", 1))
+
+	claims := testClaims()
+	token, err := ks.Sign(claims)
+	require.NoError(t, err)
+
+	expiry := time.Unix(claims.Expiry, 0)
+
+	_, err = ks.Verify(token, expiry.Add(-time.Second))
+	assert.NoError(t, err)
+
+	_, err = ks.Verify(token, expiry)
+	assert.ErrorIs(t, err, ErrExpiredToken)
+
+	_, err = ks.Verify(token, expiry.Add(time.Hour))
+	assert.ErrorIs(t, err, ErrExpiredToken)
+
+	// A token without an expiry has expired.
+	claims.Expiry = 0
+	token, err = ks.Sign(claims)
+	require.NoError(t, err)
+
+	_, err = ks.Verify(token, time.Now())
+	assert.ErrorIs(t, err, ErrExpiredToken)
+}
+
+func TestNewKeySet(t *testing.T) {
+	edKey := newTestEdDSAKey(t, "ed", 1)
+	verificationKey, err := NewEdDSAVerificationKey("public", edKey.publicKey)
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name         string
+		signingKeyID string
+		keys         []Key
+		wantErr      string
+	}{
+		{name: "Valid", signingKeyID: "ed", keys: []Key{edKey, verificationKey}},
+		{name: "Missing key id", signingKeyID: "ed", keys: []Key{edKey, {Algorithm: AlgEdDSA}}, wantErr: "key id must be provided"},
+		{name: "Duplicate key id", signingKeyID: "ed", keys: []Key{edKey, edKey}, wantErr: `duplicate key id "ed"`},
+		{name: "Unknown signing key", signingKeyID: "unknown", keys: []Key{edKey}, wantErr: `signing key "unknown" not found`},
+		{name: "Verification-only signing key", signingKeyID: "public", keys: []Key{verificationKey}, wantErr: `key "public" cannot be used for signing`},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewKeySet(tc.signingKeyID, tc.keys...)
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewKeys_InvalidLength(t *testing.T) {
+	_, err := NewHS256Key("hs", make([]byte, 31))
+	assert.Error(t, err)
+
+	_, err = NewEdDSAKey("ed", make([]byte, ed25519.SeedSize-1))
+	assert.Error(t, err)
+
+	_, err = NewEdDSAVerificationKey("ed", make([]byte, ed25519.PublicKeySize+1))
+	assert.Error(t, err)
+}
+
+func TestLoadKeySet(t *testing.T) {
+	edKey := newTestEdDSAKey(t, "2024-06", 1)
+	seed := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	publicKey := base64.StdEncoding.EncodeToString(edKey.publicKey)
+
+	writeFile := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "keys.json")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		path := writeFile(t, `{"keys": [
+			{"kid": "2024-06", "alg": "EdDSA", "key": "`+seed+`"},
+			{"kid": "2024-01", "alg": "HS256", "key": "`+secret+`"},
+			{"kid": "2023-06", "alg": "EdDSA", "public_key": "`+publicKey+`"}
+		]}`)
+
+		ks, err := LoadKeySet(path, "")
+		require.NoError(t, err)
+		assert.Equal(t, "2024-06", ks.signingKey.ID)
+		assert.Len(t, ks.keys, 3)
+
+		ks, err = LoadKeySet(path, "2024-01")
+		require.NoError(t, err)
+		assert.Equal(t, "2024-01", ks.signingKey.ID)
+
+		_, err = LoadKeySet(path, "2023-06")
+		assert.ErrorContains(t, err, "cannot be used for signing")
+	})
+
+	testcases := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "Invalid JSON", content: `{"keys":`, wantErr: "parsing key set"},
+		{name: "Empty key set", content: `{"keys": []}`, wantErr: "key set is empty"},
+		{name: "Invalid base64", content: `{"keys": [{"kid": "a", "alg": "HS256", "key": "!!!"}]}`, wantErr: `decoding key "a"`},
+		{name: "Unsupported algorithm", content: `{"keys": [{"kid": "a", "alg": "none", "key": "` + secret + `"}]}`, wantErr: `unsupported algorithm "none"`},
+		{name: "Short secret", content: `{"keys": [{"kid": "a", "alg": "HS256", "key": "c2hvcnQ="}]}`, wantErr: "at least 32 bytes"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := LoadKeySet(writeFile(t, tc.content), "")
+			assert.ErrorContains(t, err, tc.wantErr)
+		})
+	}
+
+	_, err := LoadKeySet(filepath.Join(t.TempDir(), "missing.json"), "")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
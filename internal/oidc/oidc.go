@@ -0,0 +1,411 @@
+// Package oidc implements the relying party side of the OpenID Connect authorization code
+// flow with PKCE (RFC 7636): discovery of the provider from its issuer URL, the exchange
+// of the authorization code and the verification of RS256 ID tokens against the JSON Web
+// Key Set (JWKS) of the provider.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// leeway is the clock skew allowed when checking the expiry and issue time of ID tokens.
+	leeway = time.Minute
+	// keysRefetchInterval is the minimum time between two fetches of the JWKS, so that
+	// tokens with made up key ids can't make the API hammer the provider.
+	keysRefetchInterval = time.Minute
+)
+
+var (
+	// ErrInvalidIDToken is returned when an ID token is malformed, has an invalid
+	// signature or wasn't issued for this client and login.
+	ErrInvalidIDToken = errors.New("oidc: invalid ID token")
+)
+
+// Config holds the client registration of the API with the provider.
+type Config struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+// Claims holds the claims of an ID token that the API uses.
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expiry        int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// audience is the "aud" claim, which is either a single string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// Provider is an OpenID Connect provider discovered from its issuer URL. The signing keys
+// of the provider are fetched when they are first needed and fetched again when an ID
+// token is signed with a key which isn't known yet, so that key rotation is picked up.
+// The keys are fetched at most once per keysRefetchInterval.
+type Provider struct {
+	Issuer                string
+	AuthorizationEndpoint string
+	TokenEndpoint         string
+	JWKSURI               string
+
+	config Config
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	// fetching is closed once the fetch of the keys which is in progress has finished,
+	// and is nil if no fetch is in progress.
+	fetching chan struct{}
+}
+
+// Discover fetches the discovery document of the provider with the given issuer URL.
+func Discover(ctx context.Context, issuer string, cfg Config, client *http.Client) (*Provider, error) {
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+
+	err := getJSON(ctx, client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	// The issuer in the document must be exactly the one it was discovered from, as
+	// required by OpenID Connect Discovery 1.0 section 4.3.
+	if doc.Issuer != issuer {
+		return nil, fmt.Errorf("oidc: discovered issuer %q does not match %q", doc.Issuer, issuer)
+	}
+
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document is missing required endpoints")
+	}
+
+	return &Provider{
+		Issuer:                doc.Issuer,
+		AuthorizationEndpoint: doc.AuthorizationEndpoint,
+		TokenEndpoint:         doc.TokenEndpoint,
+		JWKSURI:               doc.JWKSURI,
+		config:                cfg,
+		client:                client,
+	}, nil
+}
+
+// NewPKCE returns a new random PKCE code verifier and its S256 code challenge.
+func NewPKCE() (verifier, challenge string) {
+	b := make([]byte, 32)
+	rand.Read(b)
+	verifier = base64.RawURLEncoding.EncodeToString(b)
+	return verifier, S256Challenge(verifier)
+}
+
+// S256Challenge returns the S256 code challenge for a PKCE code verifier.
+func S256Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the URL of the authorization endpoint that the user is sent to in
+// order to log in with the provider.
+func (p *Provider) AuthCodeURL(state, nonce, challenge string) string {
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.config.ClientID)
+	params.Set("redirect_uri", p.config.RedirectURL)
+	params.Set("scope", "openid email profile")
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", challenge)
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return p.AuthorizationEndpoint + separator + params.Encode()
+}
+
+// Exchange exchanges an authorization code and the PKCE code verifier of the login for
+// the tokens of the user, and returns the raw ID token.
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("client_id", p.config.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	// Confidential clients authenticate with client_secret_basic, which every provider
+	// has to support. Public clients rely on PKCE alone.
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc: token endpoint returned status %d", res.StatusCode)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&tokens)
+	if err != nil {
+		return "", fmt.Errorf("oidc: decoding token response: %w", err)
+	}
+
+	if tokens.IDToken == "" {
+		return "", errors.New("oidc: token response contains no ID token")
+	}
+
+	return tokens.IDToken, nil
+}
+
+// VerifyIDToken verifies the signature of an ID token and checks that it was issued by
+// the provider, for this client and for the login with the given nonce, and that it
+// hasn't expired at the given time. It returns ErrInvalidIDToken if any check fails.
+func (p *Provider) VerifyIDToken(ctx context.Context, rawIDToken, nonce string, now time.Time) (*Claims, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	// Only RS256 is accepted, which every provider has to support, so that a token can't
+	// pick a different algorithm such as "none".
+	if header.Alg != "RS256" {
+		return nil, ErrInvalidIDToken
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	switch {
+	case claims.Issuer != p.Issuer:
+		return nil, ErrInvalidIDToken
+	case !claims.Audience.contains(p.config.ClientID):
+		return nil, ErrInvalidIDToken
+	case claims.Nonce != nonce:
+		return nil, ErrInvalidIDToken
+	case now.Add(-leeway).Unix() >= claims.Expiry:
+		return nil, ErrInvalidIDToken
+	case now.Add(leeway).Unix() < claims.IssuedAt:
+		return nil, ErrInvalidIDToken
+	case claims.Subject == "":
+		return nil, ErrInvalidIDToken
+	}
+
+	return &claims, nil
+}
+
+// key returns the signing key of the provider with a specific key id. Unknown key ids
+// cause the key set to be fetched again, unless it has been fetched recently. The fetch
+// happens without holding the lock, and concurrent callers wait for the fetch which is
+// in progress instead of starting their own. It returns ErrInvalidIDToken if the provider
+// doesn't have the key.
+func (p *Provider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	for {
+		p.mu.Lock()
+
+		if key, ok := p.keys[kid]; ok {
+			p.mu.Unlock()
+			return key, nil
+		}
+
+		if fetching := p.fetching; fetching != nil {
+			p.mu.Unlock()
+
+			select {
+			case <-fetching:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		if !p.fetchedAt.IsZero() && time.Since(p.fetchedAt) < keysRefetchInterval {
+			p.mu.Unlock()
+			return nil, ErrInvalidIDToken
+		}
+
+		fetching := make(chan struct{})
+		p.fetching = fetching
+		p.fetchedAt = time.Now()
+		p.mu.Unlock()
+
+		keys, err := p.fetchKeys(ctx)
+
+		p.mu.Lock()
+		if err == nil {
+			p.keys = keys
+		}
+		p.fetching = nil
+		close(fetching)
+		p.mu.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// fetchKeys fetches the RSA signing keys from the JWKS of the provider.
+func (p *Provider) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+
+	err := getJSON(ctx, p.client, p.JWKSURI, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(jwks.Keys))
+
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("oidc: decoding key %q: %w", k.Kid, err)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("oidc: decoding key %q: %w", k.Kid, err)
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return keys, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: %s returned status %d", url, res.StatusCode)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(dst)
+	if err != nil {
+		return fmt.Errorf("oidc: decoding %s: %w", url, err)
+	}
+
+	return nil
+}
+
+func decodeSegment(segment string, dst any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
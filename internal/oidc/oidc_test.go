@@ -0,0 +1,306 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testProvider serves the discovery document and the JWKS of a provider, and counts how
+// often the JWKS is fetched.
+type testProvider struct {
+	server      *httptest.Server
+	jwksFetches atomic.Int32
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	p := &testProvider{keys: map[string]*rsa.PrivateKey{"key-1": newRSAKey(t)}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/authorize",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.jwksFetches.Add(1)
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		keys := []map[string]string{}
+		for kid, key := range p.keys {
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"kid": kid,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return key
+}
+
+func (p *testProvider) setKey(kid string, key *rsa.PrivateKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys[kid] = key
+}
+
+func (p *testProvider) discover(t *testing.T) *Provider {
+	provider, err := Discover(context.Background(), p.server.URL, Config{ClientID: "greenlight"}, p.server.Client())
+	require.NoError(t, err)
+	return provider
+}
+
+// validClaims returns the claims of an ID token which passes every check.
+func (p *testProvider) validClaims() map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":   p.server.URL,
+		"sub":   "user-1",
+		"aud":   "greenlight",
+		"exp":   now.Add(time.Hour).Unix(),
+		"iat":   now.Unix(),
+		"nonce": "nonce",
+		"email": "alice@gmail.com",
+	}
+}
+
+func signToken(t *testing.T, header map[string]string, claims map[string]any, key *rsa.PrivateKey) string {
+	h, err := json.Marshal(header)
+	require.NoError(t, err)
+	c, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (p *testProvider) sign(t *testing.T, kid string, claims map[string]any) string {
+	p.mu.Lock()
+	key := p.keys[kid]
+	p.mu.Unlock()
+
+	return signToken(t, map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid}, claims, key)
+}
+
+func TestDiscover(t *testing.T) {
+	p := newTestProvider(t)
+
+	provider := p.discover(t)
+	assert.Equal(t, p.server.URL, provider.Issuer)
+	assert.Equal(t, p.server.URL+"/authorize", provider.AuthorizationEndpoint)
+	assert.Equal(t, p.server.URL+"/token", provider.TokenEndpoint)
+	assert.Equal(t, p.server.URL+"/jwks", provider.JWKSURI)
+
+	// The issuer has to match the discovery document exactly.
+	_, err := Discover(context.Background(), p.server.URL+"/", Config{}, p.server.Client())
+	assert.ErrorContains(t, err, "does not match")
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	p := newTestProvider(t)
+	provider := p.discover(t)
+
+	claims, err := provider.VerifyIDToken(context.Background(), p.sign(t, "key-1", p.validClaims()), "nonce", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", claims.Subject)
+	assert.Equal(t, "alice@gmail.com", claims.Email)
+
+	// with returns the valid claims with some of them replaced, or removed if the new
+	// value is nil.
+	with := func(changes map[string]any) map[string]any {
+		claims := p.validClaims()
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+
+	now := time.Now()
+
+	testcases := []struct {
+		name    string
+		claims  map[string]any
+		wantErr bool
+	}{
+		{name: "Audience in an array", claims: with(map[string]any{"aud": []string{"other", "greenlight"}})},
+		{name: "Wrong audience", claims: with(map[string]any{"aud": "other"}), wantErr: true},
+		{name: "Wrong audience in an array", claims: with(map[string]any{"aud": []string{"other"}}), wantErr: true},
+		{name: "Missing audience", claims: with(map[string]any{"aud": nil}), wantErr: true},
+		{name: "Wrong issuer", claims: with(map[string]any{"iss": "https://evil.example.com"}), wantErr: true},
+		{name: "Issuer with a trailing slash", claims: with(map[string]any{"iss": p.server.URL + "/"}), wantErr: true},
+		{name: "Wrong nonce", claims: with(map[string]any{"nonce": "other"}), wantErr: true},
+		{name: "Missing nonce", claims: with(map[string]any{"nonce": nil}), wantErr: true},
+		{name: "Expired within the leeway", claims: with(map[string]any{"exp": now.Add(-30 * time.Second).Unix()})},
+		{name: "Expired beyond the leeway", claims: with(map[string]any{"exp": now.Add(-2 * time.Minute).Unix()}), wantErr: true},
+		{name: "Missing expiry", claims: with(map[string]any{"exp": nil}), wantErr: true},
+		{name: "Issued in the future within the leeway", claims: with(map[string]any{"iat": now.Add(30 * time.Second).Unix()})},
+		{name: "Issued in the future beyond the leeway", claims: with(map[string]any{"iat": now.Add(2 * time.Minute).Unix()}), wantErr: true},
+		{name: "Missing subject", claims: with(map[string]any{"sub": nil}), wantErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := provider.VerifyIDToken(context.Background(), p.sign(t, "key-1", tc.claims), "nonce", now)
+			if tc.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidIDToken)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestVerifyIDToken_Signature(t *testing.T) {
+	p := newTestProvider(t)
+	provider := p.discover(t)
+
+	token := p.sign(t, "key-1", p.validClaims())
+	parts := strings.Split(token, ".")
+
+	tampered := p.validClaims()
+	tampered["sub"] = "user-2"
+	tamperedPayload, err := json.Marshal(tampered)
+	require.NoError(t, err)
+
+	unsigned := func(alg string) string {
+		h, err := json.Marshal(map[string]string{"alg": alg, "kid": "key-1"})
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(h) + "." + parts[1] + "."
+	}
+
+	testcases := []struct {
+		name  string
+		token string
+	}{
+		{name: "Signed with another key", token: signToken(t, map[string]string{"alg": "RS256", "kid": "key-1"}, p.validClaims(), newRSAKey(t))},
+		{name: "Tampered payload", token: parts[0] + "." + base64.RawURLEncoding.EncodeToString(tamperedPayload) + "." + parts[2]},
+		{name: "Missing signature", token: parts[0] + "." + parts[1] + "."},
+		{name: "Invalid signature encoding", token: parts[0] + "." + parts[1] + ".!!!"},
+		{name: "alg none", token: unsigned("none")},
+		{name: "alg HS256", token: unsigned("HS256")},
+		{name: "Too few segments", token: parts[0] + "." + parts[1]},
+		{name: "Invalid header", token: "!!!." + parts[1] + "." + parts[2]},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := provider.VerifyIDToken(context.Background(), tc.token, "nonce", time.Now())
+			assert.ErrorIs(t, err, ErrInvalidIDToken)
+		})
+	}
+}
+
+func TestVerifyIDToken_KeyRotation(t *testing.T) {
+	p := newTestProvider(t)
+	provider := p.discover(t)
+
+	_, err := provider.VerifyIDToken(context.Background(), p.sign(t, "key-1", p.validClaims()), "nonce", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), p.jwksFetches.Load())
+
+	// Known keys don't cause the keys to be fetched again.
+	_, err = provider.VerifyIDToken(context.Background(), p.sign(t, "key-1", p.validClaims()), "nonce", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), p.jwksFetches.Load())
+
+	// Unknown key ids are only looked up once per interval, so that made up key ids
+	// can't be used to make the API hammer the provider.
+	p.setKey("key-2", newRSAKey(t))
+	rotated := p.sign(t, "key-2", p.validClaims())
+
+	_, err = provider.VerifyIDToken(context.Background(), rotated, "nonce", time.Now())
+	assert.ErrorIs(t, err, ErrInvalidIDToken)
+	assert.Equal(t, int32(1), p.jwksFetches.Load())
+
+	// Once the interval has passed, a rotated key is picked up.
+	provider.fetchedAt = time.Now().Add(-keysRefetchInterval)
+
+	_, err = provider.VerifyIDToken(context.Background(), rotated, "nonce", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), p.jwksFetches.Load())
+
+	// A key id which the provider doesn't have is rejected without fetching the keys
+	// again.
+	_, err = provider.VerifyIDToken(context.Background(), signToken(t, map[string]string{"alg": "RS256", "kid": "unknown"}, p.validClaims(), newRSAKey(t)), "nonce", time.Now())
+	assert.ErrorIs(t, err, ErrInvalidIDToken)
+	assert.Equal(t, int32(2), p.jwksFetches.Load())
+}
+
+func TestVerifyIDToken_ConcurrentUnknownKeys(t *testing.T) {
+	p := newTestProvider(t)
+	provider := p.discover(t)
+
+	// Concurrent tokens with unknown key ids share a single fetch of the keys.
+	var wg sync.WaitGroup
+
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token := signToken(t, map[string]string{"alg": "RS256", "kid": "unknown"}, p.validClaims(), newRSAKey(t))
+			_, err := provider.VerifyIDToken(context.Background(), token, "nonce", time.Now())
+			assert.ErrorIs(t, err, ErrInvalidIDToken)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), p.jwksFetches.Load())
+
+	// The keys which were fetched are still used for known key ids.
+	_, err := provider.VerifyIDToken(context.Background(), p.sign(t, "key-1", p.validClaims()), "nonce", time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), p.jwksFetches.Load())
+}
+
+func TestNewPKCE(t *testing.T) {
+	verifier, challenge := NewPKCE()
+	assert.Len(t, verifier, 43)
+	assert.Len(t, challenge, 43)
+	assert.Equal(t, S256Challenge(verifier), challenge)
+
+	other, _ := NewPKCE()
+	assert.NotEqual(t, verifier, other)
+}
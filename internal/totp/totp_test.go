@@ -0,0 +1,152 @@
+package totp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed from RFC 6238 Appendix B, base32 encoded.
+var rfcSecret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode_RFC6238Vectors(t *testing.T) {
+	// The RFC lists 8 digit codes, the last 6 digits of which are the 6 digit codes.
+	testcases := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(time.Unix(tc.unix, 0).UTC().Format(time.RFC3339), func(t *testing.T) {
+			code, err := Code(rfcSecret, Step(time.Unix(tc.unix, 0)))
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, code)
+		})
+	}
+}
+
+func TestCode_InvalidSecret(t *testing.T) {
+	_, err := Code("not base32!", 1)
+	assert.Error(t, err)
+}
+
+func TestCode_LowercaseSecret(t *testing.T) {
+	upper, err := Code(rfcSecret, 1)
+	require.NoError(t, err)
+
+	lower, err := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", 1)
+	require.NoError(t, err)
+	assert.Equal(t, upper, lower)
+}
+
+func TestValidate_Window(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	codeAt := func(step int64) string {
+		code, err := Code(rfcSecret, step)
+		require.NoError(t, err)
+		return code
+	}
+
+	testcases := []struct {
+		name     string
+		code     string
+		now      time.Time
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "Current step", code: codeAt(current), now: now, wantStep: current, wantOK: true},
+		{name: "Previous step", code: codeAt(current - 1), now: now, wantStep: current - 1, wantOK: true},
+		{name: "Next step", code: codeAt(current + 1), now: now, wantStep: current + 1, wantOK: true},
+		{name: "Two steps behind", code: codeAt(current - 2), now: now, wantOK: false},
+		{name: "Two steps ahead", code: codeAt(current + 2), now: now, wantOK: false},
+		{name: "First second of the step", code: codeAt(current + 1), now: time.Unix((current+2)*30, 0), wantStep: current + 1, wantOK: true},
+		{name: "Last second of the step after the window", code: codeAt(current - 1), now: time.Unix((current+1)*30-1, 0), wantStep: current - 1, wantOK: true},
+		{name: "First second after the window", code: codeAt(current - 1), now: time.Unix((current+1)*30, 0), wantOK: false},
+		{name: "Wrong code", code: "000000", now: now, wantOK: false},
+		{name: "Too short", code: "12345", now: now, wantOK: false},
+		{name: "Too long", code: "1234567", now: now, wantOK: false},
+		{name: "Empty", code: "", now: now, wantOK: false},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			step, ok := Validate(rfcSecret, tc.code, tc.now, 0)
+			assert.Equal(t, tc.wantOK, ok)
+			if tc.wantOK {
+				assert.Equal(t, tc.wantStep, step)
+			}
+		})
+	}
+}
+
+func TestValidate_RejectsUsedSteps(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	code, err := Code(rfcSecret, current)
+	require.NoError(t, err)
+
+	step, ok := Validate(rfcSecret, code, now, 0)
+	require.True(t, ok)
+
+	// The same code can't be used again once its step has been used.
+	_, ok = Validate(rfcSecret, code, now, step)
+	assert.False(t, ok)
+
+	// Neither can a code from an earlier step which is still within the window.
+	previous, err := Code(rfcSecret, current-1)
+	require.NoError(t, err)
+
+	_, ok = Validate(rfcSecret, previous, now, step)
+	assert.False(t, ok)
+
+	// A code from a later step is still accepted.
+	next, err := Code(rfcSecret, current+1)
+	require.NoError(t, err)
+
+	step, ok = Validate(rfcSecret, next, now, step)
+	assert.True(t, ok)
+	assert.Equal(t, current+1, step)
+}
+
+func TestValidate_InvalidSecret(t *testing.T) {
+	_, ok := Validate("not base32!", "123456", time.Now(), 0)
+	assert.False(t, ok)
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret := GenerateSecret()
+	assert.Len(t, secret, 32)
+	assert.NotEqual(t, secret, GenerateSecret())
+
+	key, err := encoding.DecodeString(secret)
+	require.NoError(t, err)
+	assert.Len(t, key, 20)
+}
+
+func TestProvisioningURI(t *testing.T) {
+	u, err := url.Parse(ProvisioningURI(rfcSecret, "Greenlight", "alice@gmail.com"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "otpauth", u.Scheme)
+	assert.Equal(t, "totp", u.Host)
+	assert.Equal(t, "/Greenlight:alice@gmail.com", u.Path)
+
+	params := u.Query()
+	assert.Equal(t, rfcSecret, params.Get("secret"))
+	assert.Equal(t, "Greenlight", params.Get("issuer"))
+	assert.Equal(t, "SHA1", params.Get("algorithm"))
+	assert.Equal(t, "6", params.Get("digits"))
+	assert.Equal(t, "30", params.Get("period"))
+}
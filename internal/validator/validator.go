@@ -1,6 +1,7 @@
 package validator
 
 import (
+	"math"
 	"regexp"
 	"slices"
 )
@@ -63,3 +64,55 @@ func Unique[T comparable](values []T) bool {
 
 	return len(values) == len(uniqueValues)
 }
+
+// Entropy returns a rough estimate of the entropy of a password in bits. It is the
+// number of characters times the bits needed for a character from the character classes
+// used (lowercase and uppercase letters, digits, other ASCII symbols and everything else).
+// Characters which repeat the previous one more than once, or continue a sequence such as
+// "abc" or "321" past its second character, add nothing.
+func Entropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+
+	runes := []rune(password)
+	length := 0
+
+	for i, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r >= ' ' && r <= '~':
+			symbol = true
+		default:
+			other = true
+		}
+
+		if i >= 2 {
+			step := r - runes[i-1]
+			if step == runes[i-1]-runes[i-2] && step >= -1 && step <= 1 {
+				continue
+			}
+		}
+
+		length++
+	}
+
+	base := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			base += class.size
+		}
+	}
+
+	if base == 0 {
+		return 0
+	}
+
+	return float64(length) * math.Log2(float64(base))
+}
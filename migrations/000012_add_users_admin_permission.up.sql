@@ -0,0 +1,11 @@
+INSERT INTO permissions (code)
+SELECT 'users:admin'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'users:admin');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles,
+     permissions
+WHERE roles.name = 'admin'
+  AND permissions.code = 'users:admin'
+ON CONFLICT DO NOTHING;
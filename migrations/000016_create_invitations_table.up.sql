@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS invitations
+(
+    id          bigserial PRIMARY KEY,
+    email       citext                      NOT NULL,
+    hash        bytea UNIQUE                NOT NULL,
+    permissions text[]                      NOT NULL,
+    invited_by  bigint                      REFERENCES users ON DELETE SET NULL,
+    created_at  timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expiry      timestamp(0) with time zone NOT NULL
+);
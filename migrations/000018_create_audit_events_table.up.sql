@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS audit_events
+(
+    id          bigserial PRIMARY KEY,
+    created_at  timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    actor_id    bigint                      REFERENCES users ON DELETE SET NULL,
+    action      text                        NOT NULL,
+    target_type text                        NOT NULL,
+    target_id   bigint,
+    client_ip   text                        NOT NULL DEFAULT '',
+    request_id  text                        NOT NULL DEFAULT '',
+    changes     jsonb
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_actor_id_idx ON audit_events (actor_id);
+CREATE INDEX IF NOT EXISTS audit_events_target_idx ON audit_events (target_type, target_id);
+CREATE INDEX IF NOT EXISTS audit_events_action_idx ON audit_events (action);
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS movie_revisions
+(
+    movie_id   bigint                      NOT NULL,
+    version    integer                     NOT NULL,
+    operation  text                        NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    title      text                        NOT NULL,
+    year       integer                     NOT NULL,
+    runtime    integer                     NOT NULL,
+    genres     text[]                      NOT NULL,
+    PRIMARY KEY (movie_id, version)
+);
+
+-- Movies which existed before revisions were recorded start with their current state.
+INSERT INTO movie_revisions (movie_id, version, operation, title, year, runtime, genres)
+SELECT id, version, CASE WHEN version = 1 THEN 'insert' ELSE 'update' END, title, year, runtime, genres
+FROM movies
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS watched_entries;
+DROP TABLE IF EXISTS watchlist_entries;